@@ -2,34 +2,56 @@ package pacmir
 
 import (
 	"log"
+	"path/filepath"
 	"sync"
 	"time"
 
 	paconf "github.com/Morganamilo/go-pacmanconf"
+	"github.com/fsnotify/fsnotify"
 	"github.com/pkg/errors"
 )
 
+// how long to wait for a burst of filesystem events to settle before reparsing.
+const settle = 100 * time.Millisecond
+
 // NewCachedConfig returns a caching wrapper around
-// the pacman configuration.
+// the pacman configuration. the configuration and every file it includes
+// are watched for changes.
 func NewCachedConfig(path string) *CachedConfig {
-	return &CachedConfig{
-		path:       path,
-		m:          &sync.RWMutex{},
-		stalestamp: time.Now(),
+	c := &CachedConfig{
+		path:        path,
+		m:           &sync.RWMutex{},
+		subscribers: map[chan *paconf.Config]struct{}{},
+		done:        make(chan struct{}),
+	}
+
+	c.refresh()
+
+	if err := c.watch(); err != nil {
+		log.Println(errors.Wrap(err, "unable to watch pacman configuration, changes will be ignored"))
 	}
+
+	return c
 }
 
 // CachedConfig a caching wrapper around a pacman configuration.
 type CachedConfig struct {
-	path       string
-	m          *sync.RWMutex
-	stalestamp time.Time
-	config     *paconf.Config
+	path        string
+	m           *sync.RWMutex
+	config      *paconf.Config
+	err         error
+	repos       []Repository
+	files       []string
+	patterns    []string
+	watcher     *fsnotify.Watcher
+	subscribers map[chan *paconf.Config]struct{}
+	done        chan struct{}
+	closed      sync.Once
 }
 
 // Current returns the current pacman configuration
 func (t *CachedConfig) Current() *paconf.Config {
-	t.refresh()
+	t.ensure()
 	t.m.RLock()
 	defer t.m.RUnlock()
 
@@ -38,54 +60,246 @@ func (t *CachedConfig) Current() *paconf.Config {
 
 // Mirrors of the given repository.
 func (t *CachedConfig) Mirrors(repository string) []string {
-	t.refresh()
+	if repo, ok := t.Repository(repository); ok && len(repo.Servers) > 0 {
+		return repo.Servers
+	}
+
+	return []string{}
+}
+
+// Repository returns the view of the named repository.
+func (t *CachedConfig) Repository(name string) (Repository, bool) {
+	t.ensure()
 	t.m.RLock()
 	defer t.m.RUnlock()
 
-	if t.config == nil {
-		return []string{}
+	for _, repo := range t.repos {
+		if repo.Name == name {
+			return repo, true
+		}
 	}
 
-	if repo := t.config.Repository(repository); repo != nil {
-		return repo.Servers
+	return Repository{}, false
+}
+
+// Repositories returns the views of every repository in the configuration.
+func (t *CachedConfig) Repositories() []Repository {
+	t.ensure()
+	t.m.RLock()
+	defer t.m.RUnlock()
+
+	return append([]Repository(nil), t.repos...)
+}
+
+// Architectures returns the effective architectures of the host.
+// the first architecture is the one pacman substitutes into server templates.
+func (t *CachedConfig) Architectures() []string {
+	if c := t.Current(); c != nil {
+		return architectures(c.Architecture)
 	}
 
-	return []string{}
+	return architectures("auto")
 }
 
-func (t *CachedConfig) refresh() {
-	var (
-		err    error
-		config *paconf.Config
-	)
+// Files returns the configuration file and every file it includes.
+func (t *CachedConfig) Files() []string {
+	t.m.RLock()
+	defer t.m.RUnlock()
+
+	return append([]string(nil), t.files...)
+}
+
+// Err returns the error of the most recent reparse, nil if it succeeded.
+func (t *CachedConfig) Err() error {
+	t.m.RLock()
+	defer t.m.RUnlock()
+
+	return t.err
+}
+
+// Subscribe to configuration changes. the returned channel receives the new
+// configuration every time it is successfully reparsed. slow subscribers only
+// observe the most recent configuration. the returned function cancels the subscription.
+func (t *CachedConfig) Subscribe() (<-chan *paconf.Config, func()) {
+	ch := make(chan *paconf.Config, 1)
+
+	t.m.Lock()
+	t.subscribers[ch] = struct{}{}
+	t.m.Unlock()
+
+	return ch, func() {
+		t.m.Lock()
+		defer t.m.Unlock()
+		if _, ok := t.subscribers[ch]; ok {
+			delete(t.subscribers, ch)
+			close(ch)
+		}
+	}
+}
+
+// Close stops watching the configuration.
+func (t *CachedConfig) Close() (err error) {
+	t.closed.Do(func() {
+		close(t.done)
+		if t.watcher != nil {
+			err = t.watcher.Close()
+		}
+	})
+
+	return err
+}
 
+// ensure a configuration has been loaded, retrying if the previous
+// attempts failed.
+func (t *CachedConfig) ensure() {
 	t.m.RLock()
-	required := t.config == nil || t.stalestamp.After(time.Now())
+	required := t.config == nil
 	t.m.RUnlock()
 
 	if !required {
 		return
 	}
 
-	// refresh config
+	t.refresh()
+}
+
+// refresh reparses the configuration, keeping the last good configuration
+// when parsing fails.
+func (t *CachedConfig) refresh() {
+	var (
+		err error
+		p   parsed
+	)
+
+	if p, err = parse(t.path); err != nil {
+		log.Println(errors.Wrap(err, "failed to parse config"))
+		t.m.Lock()
+		t.err = err
+		t.m.Unlock()
+		return
+	}
+
 	t.m.Lock()
 	defer t.m.Unlock()
 
-	// check again
-	if !(t.config == nil || t.stalestamp.After(time.Now())) {
-		return
+	t.err = nil
+	t.config = p.config
+	t.repos = p.repositories
+	t.files = p.files
+	t.patterns = p.patterns
+
+	for ch := range t.subscribers {
+		notify(ch, p.config)
 	}
+}
 
-	if config, _, err = paconf.ParseFile(t.path); err != nil {
-		log.Println(errors.Wrap(err, "failed to parse config"))
-		t.reset(nil)
-		return
+func (t *CachedConfig) watch() (err error) {
+	if t.watcher, err = fsnotify.NewWatcher(); err != nil {
+		return errors.WithStack(err)
+	}
+
+	if err = t.rewatch(); err != nil {
+		return err
 	}
 
-	t.reset(config)
+	go t.background()
+
+	return nil
 }
 
-func (t *CachedConfig) reset(c *paconf.Config) {
-	t.config = c
-	t.stalestamp = time.Now().Add(time.Minute)
+// rewatch ensures the directories of every file contributing to the configuration
+// are watched. directories are watched instead of the files directly because
+// editors and package managers replace files by renaming over them.
+func (t *CachedConfig) rewatch() error {
+	dirs := map[string]bool{
+		filepath.Dir(t.path): true,
+	}
+
+	t.m.RLock()
+	for _, path := range t.files {
+		dirs[filepath.Dir(path)] = true
+	}
+	for _, pattern := range t.patterns {
+		dirs[filepath.Dir(pattern)] = true
+	}
+	t.m.RUnlock()
+
+	for dir := range dirs {
+		if err := t.watcher.Add(dir); err != nil {
+			return errors.Wrapf(err, "unable to watch %s", dir)
+		}
+	}
+
+	return nil
+}
+
+// relevant returns true if the path contributes to the configuration.
+func (t *CachedConfig) relevant(path string) bool {
+	t.m.RLock()
+	defer t.m.RUnlock()
+
+	if path == t.path {
+		return true
+	}
+
+	for _, f := range t.files {
+		if f == path {
+			return true
+		}
+	}
+
+	for _, pattern := range t.patterns {
+		if ok, _ := filepath.Match(pattern, path); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (t *CachedConfig) background() {
+	var (
+		pending <-chan time.Time
+	)
+
+	for {
+		select {
+		case <-t.done:
+			return
+		case evt, ok := <-t.watcher.Events:
+			if !ok {
+				return
+			}
+
+			if evt.Op == fsnotify.Chmod || !t.relevant(evt.Name) {
+				continue
+			}
+
+			pending = time.After(settle)
+		case err, ok := <-t.watcher.Errors:
+			if !ok {
+				return
+			}
+			log.Println(errors.Wrap(err, "pacman configuration watch failed"))
+		case <-pending:
+			pending = nil
+			t.refresh()
+			if err := t.rewatch(); err != nil {
+				log.Println(err)
+			}
+		}
+	}
+}
+
+// notify replaces any pending configuration with the latest.
+func notify(ch chan *paconf.Config, c *paconf.Config) {
+	select {
+	case <-ch:
+	default:
+	}
+
+	select {
+	case ch <- c:
+	default:
+	}
 }
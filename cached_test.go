@@ -0,0 +1,158 @@
+package pacmir_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	. "github.com/james-lawrence/pacmir"
+	"github.com/james-lawrence/pacmir/internal/testingx"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCachedConfig(t *testing.T) {
+	g := testingx.Init(t)
+
+	write := func(path string, content string) {
+		require.Nil(t, ioutil.WriteFile(path, []byte(content), 0600))
+	}
+
+	setup := func() (dir, conf, mirrorlist string) {
+		dir, err := ioutil.TempDir("", "pacmir.cached.*")
+		require.Nil(t, err)
+
+		conf = filepath.Join(dir, "pacman.conf")
+		mirrorlist = filepath.Join(dir, "mirrorlist")
+		write(mirrorlist, "Server = https://example.com/$repo/os/$arch\n")
+		write(conf, fmt.Sprintf("[options]\nArchitecture = x86_64\n\n[core]\nInclude = %s\n", mirrorlist))
+
+		return dir, conf, mirrorlist
+	}
+
+	g.Describe("Mirrors", func() {
+		g.It("should expand includes and templates", func() {
+			dir, conf, _ := setup()
+			defer os.RemoveAll(dir)
+
+			c := NewCachedConfig(conf)
+			defer c.Close()
+
+			require.Equal(t, []string{"https://example.com/core/os/x86_64"}, c.Mirrors("core"))
+			require.Equal(t, []string{}, c.Mirrors("extra"))
+		})
+
+		g.It("should ignore inline comments", func() {
+			dir, conf, mirrorlist := setup()
+			defer os.RemoveAll(dir)
+
+			write(mirrorlist, "Server = https://example.com/$repo/os/$arch # primary\n")
+			write(conf, fmt.Sprintf("[options]\nArchitecture = x86_64 # host\n\n[core] # official\nInclude = %s # local\n", mirrorlist))
+
+			c := NewCachedConfig(conf)
+			defer c.Close()
+
+			require.Equal(t, []string{"https://example.com/core/os/x86_64"}, c.Mirrors("core"))
+		})
+
+		g.It("should pick up changes to included files", func() {
+			dir, conf, mirrorlist := setup()
+			defer os.RemoveAll(dir)
+
+			c := NewCachedConfig(conf)
+			defer c.Close()
+
+			changes, cancel := c.Subscribe()
+			defer cancel()
+
+			write(mirrorlist, "Server = https://example.org/$repo/os/$arch\n")
+
+			select {
+			case <-changes:
+			case <-time.After(5 * time.Second):
+				require.FailNow(t, "timed out waiting for configuration change")
+			}
+
+			require.Equal(t, []string{"https://example.org/core/os/x86_64"}, c.Mirrors("core"))
+		})
+
+		g.It("should keep the last good configuration when parsing fails", func() {
+			dir, conf, mirrorlist := setup()
+			defer os.RemoveAll(dir)
+
+			c := NewCachedConfig(conf)
+			defer c.Close()
+
+			require.Nil(t, os.Remove(mirrorlist))
+			write(conf, fmt.Sprintf("[options]\n[core]\nInclude = %s\n[core]\nInclude = %s\n", conf, mirrorlist))
+
+			// wait for the watcher to reparse the broken configuration.
+			deadline := time.Now().Add(5 * time.Second)
+			for c.Err() == nil {
+				require.True(t, time.Now().Before(deadline), "timed out waiting for the configuration to be reparsed")
+				time.Sleep(10 * time.Millisecond)
+			}
+
+			require.Equal(t, []string{"https://example.com/core/os/x86_64"}, c.Mirrors("core"))
+		})
+	})
+
+	g.Describe("Repository", func() {
+		g.It("should separate cache servers and resolve the signature policy", func() {
+			dir, conf, mirrorlist := setup()
+			defer os.RemoveAll(dir)
+
+			write(conf, fmt.Sprintf(
+				"[options]\nArchitecture = x86_64\nSigLevel = Required DatabaseOptional\n\n[core]\nCacheServer = http://localhost:4000/$repo/os/$arch\nInclude = %s\n\n[custom]\nSigLevel = PackageNever\nUsage = Sync Search\nServer = file:///srv/$repo\n",
+				mirrorlist,
+			))
+
+			c := NewCachedConfig(conf)
+			defer c.Close()
+
+			core, ok := c.Repository("core")
+			require.True(t, ok)
+			require.Equal(t, []string{"http://localhost:4000/core/os/x86_64"}, core.CacheServers)
+			require.Equal(t, []string{"https://example.com/core/os/x86_64"}, core.Servers)
+			require.Equal(t, append(core.CacheServers, core.Servers...), core.Sources())
+			require.True(t, core.SigLevel.Package.Verified())
+			require.Equal(t, SigOptional, core.SigLevel.Database.Check)
+			require.Equal(t, UsageAll, core.Usage)
+
+			custom, ok := c.Repository("custom")
+			require.True(t, ok)
+			require.Equal(t, []string{"file:///srv/custom"}, custom.Servers)
+			require.Equal(t, SigNever, custom.SigLevel.Package.Check)
+			require.True(t, custom.Usage.Has(UsageSync|UsageSearch))
+			require.False(t, custom.Usage.Has(UsageInstall))
+		})
+
+		g.It("should resolve servers for every architecture used by the host", func() {
+			dir, conf, mirrorlist := setup()
+			defer os.RemoveAll(dir)
+
+			write(conf, fmt.Sprintf("[options]\nArchitecture = x86_64 x86_64_v3\n\n[core]\nInclude = %s\n", mirrorlist))
+
+			c := NewCachedConfig(conf)
+			defer c.Close()
+
+			require.Equal(t, []string{"x86_64", "x86_64_v3"}, c.Architectures())
+
+			core, ok := c.Repository("core")
+			require.True(t, ok)
+			require.Equal(t, []string{"https://example.com/core/os/x86_64"}, core.Servers)
+
+			v3, ok := core.Arch("x86_64_v3")
+			require.True(t, ok)
+			require.Equal(t, []string{"https://example.com/core/os/x86_64_v3"}, v3.Servers)
+			require.True(t, v3.Supports("any"))
+
+			_, ok = core.Arch("aarch64")
+			require.False(t, ok)
+			require.False(t, core.Supports("aarch64"))
+		})
+	})
+}
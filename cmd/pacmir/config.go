@@ -0,0 +1,65 @@
+package main
+
+import (
+	"os"
+
+	"github.com/james-lawrence/pacmir/config"
+)
+
+// Overrides flags that take precedence over the configuration file and environment.
+type Overrides struct {
+	HTTPBind       string            `help:"HTTP address to bind the mirror" placeholder:"localhost:4000"`
+	Mode           string            `help:"how pacmir is added to the mirrorlists" enum:"auto,server,cacheserver," default:""`
+	Mirrors        []string          `help:"mirror list files to rewrite" placeholder:"/etc/pacman.d/mirrorlist"`
+	Chroots        map[string]string `help:"additional named pacman configurations, served under /{name}/{repo}/os/{arch}. i.e.) --chroots=extra-x86_64=/var/lib/archbuild/extra-x86_64/root/etc/pacman.conf"`
+	CacheDirectory string            `help:"pacmir cache directory" placeholder:"/var/cache/pacmir"`
+}
+
+// apply the flags to the configuration.
+func (t Overrides) apply(c config.Config) config.Config {
+	if t.HTTPBind != "" {
+		c.HTTPBind = t.HTTPBind
+	}
+
+	if t.Mode != "" {
+		c.Mode = t.Mode
+	}
+
+	if len(t.Mirrors) > 0 {
+		c.Mirrors = t.Mirrors
+	}
+
+	if len(t.Chroots) > 0 {
+		c.Chroots = t.Chroots
+	}
+
+	if t.CacheDirectory != "" {
+		c.Cache.Directory = t.CacheDirectory
+	}
+
+	return c
+}
+
+// Configuration command
+type Configuration struct {
+	Show ConfigShow `cmd:"" help:"print the merged configuration"`
+}
+
+// ConfigShow command
+type ConfigShow struct {
+	Overrides `embed:""`
+}
+
+// Run the command
+func (t *ConfigShow) Run(ctx *CmdContext) (err error) {
+	var (
+		encoded []byte
+	)
+
+	if encoded, err = config.Encode(t.apply(ctx.Config)); err != nil {
+		return err
+	}
+
+	_, err = os.Stdout.Write(encoded)
+	return err
+}
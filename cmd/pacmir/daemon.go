@@ -1,35 +1,35 @@
 package main
 
 import (
+	"context"
 	"io"
 	"log"
 	"net/http"
 	"os"
-	"path/filepath"
+	"os/signal"
+	"syscall"
 
-	"github.com/gorilla/mux"
-	"github.com/james-lawrence/pacmir"
-	"github.com/james-lawrence/pacmir/internal/httputilx"
+	"github.com/james-lawrence/pacmir/config"
+	"github.com/james-lawrence/pacmir/internal/daemon"
 	"github.com/james-lawrence/pacmir/localmir"
-	"github.com/justinas/alice"
+	"github.com/james-lawrence/pacmir/swarm"
 	"github.com/pkg/errors"
 )
 
 // Daemon command
 type Daemon struct {
-	HTTPBind string   `default:"localhost:4000" help:"HTTP address to bind the mirror"`
-	Mirrors  []string `default:"/etc/pacman.d/mirrorlist" help:"mirror list files to rewrite"`
+	Overrides `embed:""`
 }
 
 // Run the command
 func (t *Daemon) Run(ctx *CmdContext) (err error) {
 	var (
+		c = t.apply(ctx.Config)
 		// tsocket    *utp.Socket
 		// tclient    *torrent.Client
-		middleware = alice.New(
-			httputilx.RouteInvokedHandler,
-		)
-		router = mux.NewRouter()
+		upstreams = &daemon.Upstreams{}
+		sharing   = map[string]localmir.Sharer{}
+		sighup    = make(chan os.Signal, 1)
 	)
 
 	// var (
@@ -77,28 +77,33 @@ func (t *Daemon) Run(ctx *CmdContext) (err error) {
 
 	// go muxer.Background(context.Background(), m, l)
 
-	log.Println("initiating local mirror daemon", t.HTTPBind)
+	log.Println("initiating local mirror daemon", c.HTTPBind)
 
-	cconfig := pacmir.NewCachedConfig(ctx.Config)
-	prouter := router.PathPrefix("/{repo}/os/{arch}").Subrouter()
-	fallback := localmir.Proxied{
-		HTTPAddress: t.HTTPBind,
-		Pacman:      cconfig,
+	if s, ok := c.Source("swarm"); ok && !s.Disabled {
+		sctx, done := context.WithCancel(context.Background())
+		defer done()
+
+		if sharing["swarm"], err = swarm.NewNode(sctx); err != nil {
+			return errors.Wrap(err, "failed to initialize swarm")
+		}
 	}
-	fallback.Bind(middleware, prouter)
 
-	localmir.Download{
-		Downloader: fspackager{
-			cached: cconfig,
-		},
-		Fallback: http.HandlerFunc(fallback.Proxy),
-	}.Bind(middleware.Append(
-		httputilx.DumpRequestHandler,
-	), prouter)
+	signal.Notify(sighup, syscall.SIGHUP)
+	defer signal.Stop(sighup)
+
+	reload := func() (config.Config, error) {
+		updated, err := ctx.Reload()
+		if err != nil {
+			return updated, err
+		}
+
+		return t.apply(updated), nil
+	}
 
-	httputilx.NotFound(middleware).Bind(router)
+	return daemon.Reload(context.Background(), c, sighup, reload, func(c config.Config) (http.Handler, []io.Closer, error) {
+		return daemon.Routes(c, upstreams, sharing)
+	})
 
-	return http.ListenAndServe(t.HTTPBind, router)
 	// return func(l net.Listener, err error) error {
 	// 	if err != nil {
 	// 		return err
@@ -109,26 +114,6 @@ func (t *Daemon) Run(ctx *CmdContext) (err error) {
 	// }(m.Default("http", l.Addr()))
 }
 
-type fspackager struct {
-	cached *pacmir.CachedConfig
-}
-
-func (t fspackager) Package(repo string, name string) (io.ReadCloser, error) {
-	config := t.cached.Current()
-	if config == nil {
-		return nil, errors.New("missing pacman configuration")
-	}
-
-	for _, d := range config.CacheDir {
-		path := filepath.Join(d, name)
-		if _, err := os.Stat(path); err == nil {
-			return os.Open(path)
-		}
-	}
-
-	return nil, errors.New("package not found")
-}
-
 // type torrentpackager struct {
 // 	client   *torrent.Client
 // 	cached   *pacmir.CachedConfig
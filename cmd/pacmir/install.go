@@ -0,0 +1,84 @@
+package main
+
+import (
+	"log"
+
+	"github.com/james-lawrence/pacmir"
+	"github.com/james-lawrence/pacmir/internal/fsx"
+	"github.com/james-lawrence/pacmir/mirrors"
+)
+
+// Install command
+type Install struct {
+	Overrides `embed:""`
+	State     string `help:"file recording the modifications made to mirrorlists" default:"${installstate}"`
+}
+
+// Run the command
+func (t *Install) Run(ctx *CmdContext) (err error) {
+	var (
+		c        = t.apply(ctx.Config)
+		state    mirrors.State
+		included []string
+	)
+
+	if state, err = mirrors.LoadState(t.State); err != nil {
+		return err
+	}
+
+	if included, err = pacmir.Includes(c.Pacman); err != nil {
+		return err
+	}
+
+	paths := dedup(append(included, c.Mirrors...)...)
+
+	mode := mirrors.Mode(c.Mode).Resolve()
+	log.Println("installing", mirrors.LocalURL(c.HTTPBind), mode, "into", paths)
+	ierr := mirrors.Install(&state, mode.Entry(c.HTTPBind), paths...)
+
+	// always persist the state, some mirrorlists may have been modified before the failure.
+	if err = mirrors.SaveState(t.State, state); err != nil {
+		return err
+	}
+
+	return ierr
+}
+
+// Uninstall command
+type Uninstall struct {
+	State string `help:"file recording the modifications made to mirrorlists" default:"${installstate}"`
+}
+
+// Run the command
+func (t *Uninstall) Run(ctx *CmdContext) (err error) {
+	var (
+		state mirrors.State
+	)
+
+	if state, err = mirrors.LoadState(t.State); err != nil {
+		return err
+	}
+
+	log.Println("uninstalling", state.Paths())
+	uerr := mirrors.Uninstall(&state)
+
+	if err = mirrors.SaveState(t.State, state); err != nil {
+		return err
+	}
+
+	return uerr
+}
+
+// dedup returns the unique existing files.
+func dedup(paths ...string) (results []string) {
+	seen := map[string]bool{}
+	for _, p := range paths {
+		if seen[p] || !fsx.FileExists(p) {
+			continue
+		}
+		seen[p] = true
+		results = append(results, p)
+	}
+
+	return results
+}
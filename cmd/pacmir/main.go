@@ -1,28 +1,63 @@
 package main
 
 import (
+	"os"
+
 	"github.com/alecthomas/kong"
+	"github.com/james-lawrence/pacmir/config"
+	"github.com/james-lawrence/pacmir/mirrors"
 )
 
 // CmdContext ...
 type CmdContext struct {
-	Config string
+	// Config merged from the configuration file, environment and global flags.
+	Config config.Config
+	// Reload the configuration from the file, environment and global flags.
+	Reload func() (config.Config, error)
 }
 
 func main() {
 	type CLI struct {
-		Config string `required:"" default:"/etc/pacman.conf"`
-		Daemon Daemon `cmd:"" help:"local mirror daemon" default:"1"`
-		Mirror Mirror `cmd:"" help:"hosted mirrior daemon"`
-		Spike  Spike  `cmd:"" help:"spike"`
+		Config        string        `help:"pacman configuration file" placeholder:"/etc/pacman.conf"`
+		PacmirConfig  string        `help:"pacmir configuration file" default:"${pacmirconfig}" env:"PACMIR_CONFIG"`
+		Daemon        Daemon        `cmd:"" help:"local mirror daemon" default:"1"`
+		Mirror        Mirror        `cmd:"" help:"hosted mirrior daemon"`
+		Spike         Spike         `cmd:"" help:"spike"`
+		Configuration Configuration `cmd:"" name:"config" help:"inspect the pacmir configuration"`
+		Install       Install       `cmd:"" help:"add pacmir to the mirrorlists included by the pacman configuration"`
+		Uninstall     Uninstall     `cmd:"" help:"restore the mirrorlists modified by install"`
+		Mirrors       Mirrors       `cmd:"" help:"manage mirrorlists"`
 	}
 
 	var (
 		cli CLI
 	)
 
-	ctx := kong.Parse(&cli)
+	ctx := kong.Parse(&cli, kong.Vars{
+		"pacmirconfig": config.DefaultPath,
+		"installstate": mirrors.DefaultStatePath,
+	})
+
+	load := func() (c config.Config, err error) {
+		if c, err = config.Load(cli.PacmirConfig); err != nil {
+			return c, err
+		}
+
+		if c, err = config.Environ(c, os.LookupEnv); err != nil {
+			return c, err
+		}
+
+		if cli.Config != "" {
+			c.Pacman = cli.Config
+		}
+
+		return c, nil
+	}
+
+	c, err := load()
+	ctx.FatalIfErrorf(err)
+
 	ctx.FatalIfErrorf(
-		ctx.Run(&CmdContext{Config: cli.Config}),
+		ctx.Run(&CmdContext{Config: c, Reload: load}),
 	)
 }
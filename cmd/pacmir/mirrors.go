@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"time"
+
+	"github.com/james-lawrence/pacmir/mirrors"
+	"github.com/pkg/errors"
+)
+
+// Mirrors command
+type Mirrors struct {
+	Generate MirrorsGenerate `cmd:"" help:"generate a mirrorlist from the archlinux mirror status"`
+}
+
+// MirrorsGenerate command
+type MirrorsGenerate struct {
+	Overrides  `embed:""`
+	State      string        `help:"file recording the modifications made to mirrorlists" default:"${installstate}"`
+	Status     string        `help:"mirror status json, a url or local file" placeholder:"https://archlinux.org/mirrors/status/json/"`
+	Output     string        `help:"mirrorlist to write, - writes to stdout. defaults to the first configured mirrorlist"`
+	Country    []string      `help:"only include mirrors in the countries, names or codes. i.e.) --country=DE,France"`
+	Protocol   []string      `help:"only include mirrors using the protocols" default:"https"`
+	IPv6       bool          `name:"ipv6" help:"only include mirrors supporting ipv6"`
+	Completion float64       `help:"minimum completion percentage of the mirrors, between 0 and 1" default:"1"`
+	Delay      time.Duration `help:"maximum sync delay of the mirrors, zero is unlimited" default:"0"`
+}
+
+// Run the command
+func (t *MirrorsGenerate) Run(ctx *CmdContext) (err error) {
+	var (
+		c      = t.apply(ctx.Config)
+		status mirrors.Status
+		state  mirrors.State
+		output = t.Output
+		source = c.Status
+	)
+
+	if t.Status != "" {
+		source = t.Status
+	}
+
+	if output == "" && len(c.Mirrors) > 0 {
+		output = c.Mirrors[0]
+	}
+
+	if output == "" {
+		return errors.New("no mirrorlist to write, specify --output")
+	}
+
+	if status, err = mirrors.FetchStatus(context.Background(), source); err != nil {
+		return err
+	}
+
+	list := mirrors.Generate(status, mirrors.Filter{
+		Countries:  t.Country,
+		Protocols:  t.Protocol,
+		IPv6:       t.IPv6,
+		Completion: t.Completion,
+		Delay:      t.Delay,
+	})
+
+	if len(list.Entries()) == 0 {
+		return errors.Errorf("no mirrors in %s matched the filters", source)
+	}
+
+	entry := mirrors.Mode(c.Mode).Resolve().Entry(c.HTTPBind)
+
+	if output == "-" {
+		list.Insert(entry, 0)
+		_, err = list.WriteTo(os.Stdout)
+		return err
+	}
+
+	if state, err = mirrors.LoadState(t.State); err != nil {
+		return err
+	}
+
+	log.Println("generated", len(list.Entries()), "mirrors from", source, "into", output)
+	if err = mirrors.Replace(&state, entry, output, list); err != nil {
+		return err
+	}
+
+	return mirrors.SaveState(t.State, state)
+}
@@ -14,8 +14,7 @@ import (
 
 // Spike command
 type Spike struct {
-	HTTPBind string   `default:"localhost:4000" help:"HTTP address to bind the mirror"`
-	Mirrors  []string `default:"/etc/pacman.d/mirrorlist" help:"mirror list files to rewrite"`
+	HTTPBind string `default:"localhost:4000" help:"HTTP address to bind the mirror"`
 }
 
 // Run the command
@@ -0,0 +1,334 @@
+// Package config provides the pacmir daemon configuration.
+//
+// configuration is layered, each layer overriding the previous:
+// compiled in defaults < configuration file < environment < flags.
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v3"
+)
+
+// DefaultPath location of the configuration file.
+const DefaultPath = "/etc/pacmir/config.yaml"
+
+// Default configuration.
+func Default() Config {
+	return Config{
+		HTTPBind: "localhost:4000",
+		Mode:     "auto",
+		Pacman:   "/etc/pacman.conf",
+		Mirrors:  []string{"/etc/pacman.d/mirrorlist"},
+		Status:   "https://archlinux.org/mirrors/status/json/",
+		Cache: Cache{
+			Directory:  "/var/cache/pacmir",
+			Revalidate: time.Minute,
+		},
+		Sources: []Source{{Name: "local"}, {Name: "mirror"}},
+		Hedge:   250 * time.Millisecond,
+		Stale: Stale{
+			Threshold: 24 * time.Hour,
+			Tolerance: time.Hour,
+		},
+		Breaker: Breaker{
+			Failures: 3,
+			Cooldown: 5 * time.Minute,
+		},
+		Segments: Segments{
+			Mirrors:   3,
+			Threshold: 64 * humanize.MiByte,
+			Size:      16 * humanize.MiByte,
+			Stall:     30 * time.Second,
+		},
+	}
+}
+
+// Config for the pacmir daemon.
+type Config struct {
+	// HTTPBind address to serve the mirror on.
+	HTTPBind string `yaml:"http_bind"`
+	// Mode how pacmir is added to the mirrorlists: auto, server or cacheserver.
+	// cacheserver requires pacman >= 6.1, auto detects the installed pacman version.
+	Mode string `yaml:"mode"`
+	// Pacman configuration file.
+	Pacman string `yaml:"pacman"`
+	// Chroots additional named pacman configurations, served under /{name}/{repo}/os/{arch}.
+	Chroots map[string]string `yaml:"chroots,omitempty"`
+	// Mirrors mirrorlist files to rewrite.
+	Mirrors []string `yaml:"mirrors"`
+	// Status archlinux mirror status json used to generate mirrorlists, a url or local file.
+	Status string `yaml:"mirror_status"`
+	// Cache pacmir's own cache.
+	Cache Cache `yaml:"cache"`
+	// Sources order in which package sources are consulted.
+	Sources []Source `yaml:"sources"`
+	// Hedge delay before the remaining remote sources race the first remote source,
+	// the local sources are always consulted first. zero consults the sources in order.
+	Hedge time.Duration `yaml:"hedge"`
+	// Peers LAN peers to retrieve packages from.
+	Peers []string `yaml:"peers,omitempty"`
+	// Bandwidth limits.
+	Bandwidth Bandwidth `yaml:"bandwidth"`
+	// Stale when upstream mirrors are too out of date to serve databases.
+	Stale Stale `yaml:"stale"`
+	// Breaker when failing upstream mirrors are skipped.
+	Breaker Breaker `yaml:"breaker"`
+	// Segments when large packages are downloaded from several mirrors in parallel.
+	Segments Segments `yaml:"segments"`
+	// Repositories per repository overrides.
+	Repositories map[string]Repository `yaml:"repositories,omitempty"`
+}
+
+// Cache configuration.
+type Cache struct {
+	Directory string `yaml:"directory"`
+	// Revalidate how long cached databases are served before revalidating them upstream.
+	Revalidate time.Duration `yaml:"revalidate"`
+}
+
+// Bandwidth limits in bytes per second, zero is unlimited.
+type Bandwidth struct {
+	Download Bytes `yaml:"download"`
+	Upload   Bytes `yaml:"upload"`
+}
+
+// Stale mirror detection.
+type Stale struct {
+	// Threshold maximum time since a mirror last synced, zero disables.
+	Threshold time.Duration `yaml:"threshold"`
+	// Tolerance how far a mirror may lag behind the freshest known mirror, zero disables.
+	Tolerance time.Duration `yaml:"tolerance"`
+}
+
+// Breaker skips upstream mirrors that repeatedly fail.
+type Breaker struct {
+	// Failures consecutive failures before a mirror is skipped, zero disables.
+	Failures int `yaml:"failures"`
+	// Cooldown how long a failing mirror is skipped.
+	Cooldown time.Duration `yaml:"cooldown"`
+}
+
+// Segments downloads large packages in ranges from several mirrors in parallel.
+type Segments struct {
+	// Mirrors downloaded from concurrently, less than two disables.
+	Mirrors int `yaml:"mirrors"`
+	// Threshold packages smaller than the threshold are downloaded from a single mirror.
+	Threshold Bytes `yaml:"threshold"`
+	// Size of the ranges initially requested from each mirror.
+	Size Bytes `yaml:"size"`
+	// Stall how long a mirror may deliver nothing before its range is retried elsewhere, zero disables.
+	Stall time.Duration `yaml:"stall"`
+}
+
+// Source of packages, i.e.) local, peers, swarm or mirror. in yaml a source is either
+// its name or a mapping including its options.
+type Source struct {
+	Name string `yaml:"name"`
+	// Disabled sources are never consulted.
+	Disabled bool `yaml:"disabled,omitempty"`
+	// Timeout how long the source has to provide the package, zero is unlimited.
+	Timeout time.Duration `yaml:"timeout,omitempty"`
+	// MinSize packages smaller than the minimum are never retrieved from the source.
+	MinSize Bytes `yaml:"min_size,omitempty"`
+	// MaxSize packages larger than the maximum are never retrieved from the source, zero is unlimited.
+	MaxSize Bytes `yaml:"max_size,omitempty"`
+}
+
+// MarshalYAML implements yaml.Marshaler.
+func (t Source) MarshalYAML() (interface{}, error) {
+	type plain Source
+
+	if t == (Source{Name: t.Name}) {
+		return t.Name, nil
+	}
+
+	return plain(t), nil
+}
+
+// UnmarshalYAML implements yaml.Unmarshaler.
+func (t *Source) UnmarshalYAML(n *yaml.Node) (err error) {
+	type plain Source
+
+	if n.Kind == yaml.ScalarNode {
+		*t = Source{}
+		return n.Decode(&t.Name)
+	}
+
+	if err = n.Decode((*plain)(t)); err != nil {
+		return err
+	}
+
+	if t.Name == "" {
+		return errors.Errorf("line %d: source is missing its name", n.Line)
+	}
+
+	return nil
+}
+
+// Source returns the named source, false if it isn't configured.
+func (t Config) Source(name string) (Source, bool) {
+	for _, s := range t.Sources {
+		if s.Name == name {
+			return s, true
+		}
+	}
+
+	return Source{}, false
+}
+
+// Repository overrides for a single repository.
+type Repository struct {
+	// Disabled repositories are not served.
+	Disabled bool `yaml:"disabled,omitempty"`
+	// Servers replace the servers from the pacman configuration.
+	Servers []string `yaml:"servers,omitempty"`
+	// Sources replace the global source order for the repository, the sources' options
+	// are those of the global sources.
+	Sources []string `yaml:"sources,omitempty"`
+}
+
+// Repository returns the overrides for the named repository.
+func (t Config) Repository(name string) Repository {
+	return t.Repositories[name]
+}
+
+// Bytes a human readable byte size. i.e.) 10MiB
+type Bytes uint64
+
+// MarshalYAML implements yaml.Marshaler.
+func (t Bytes) MarshalYAML() (interface{}, error) {
+	if t == 0 {
+		return "0", nil
+	}
+
+	return humanize.IBytes(uint64(t)), nil
+}
+
+// UnmarshalYAML implements yaml.Unmarshaler.
+func (t *Bytes) UnmarshalYAML(n *yaml.Node) (err error) {
+	var (
+		raw string
+		v   uint64
+	)
+
+	if err = n.Decode(&raw); err != nil {
+		return err
+	}
+
+	if v, err = humanize.ParseBytes(raw); err != nil {
+		return errors.Wrapf(err, "invalid byte size: %s", raw)
+	}
+
+	*t = Bytes(v)
+
+	return nil
+}
+
+// Load the configuration file at the given path on top of the defaults.
+// a missing file is not an error.
+func Load(path string) (c Config, err error) {
+	var (
+		raw []byte
+	)
+
+	c = Default()
+
+	if raw, err = ioutil.ReadFile(path); os.IsNotExist(err) {
+		return c, nil
+	} else if err != nil {
+		return c, errors.WithStack(err)
+	}
+
+	if err = yaml.Unmarshal(raw, &c); err != nil {
+		return c, errors.Wrapf(err, "unable to parse %s", path)
+	}
+
+	return c, nil
+}
+
+// Environ applies the environment on top of the configuration.
+// lists are comma separated.
+func Environ(c Config, lookup func(string) (string, bool)) (_ Config, err error) {
+	str := func(name string, dst *string) {
+		if v, ok := lookup(name); ok && v != "" {
+			*dst = v
+		}
+	}
+
+	list := func(name string, dst *[]string) {
+		if v, ok := lookup(name); ok && v != "" {
+			*dst = strings.Split(v, ",")
+		}
+	}
+
+	duration := func(name string, dst *time.Duration) (err error) {
+		if v, ok := lookup(name); ok && v != "" {
+			if *dst, err = time.ParseDuration(v); err != nil {
+				return errors.Wrapf(err, "invalid %s", name)
+			}
+		}
+
+		return nil
+	}
+
+	size := func(name string, dst *Bytes) error {
+		if v, ok := lookup(name); ok && v != "" {
+			return dst.UnmarshalYAML(&yaml.Node{Kind: yaml.ScalarNode, Value: v})
+		}
+
+		return nil
+	}
+
+	str("PACMIR_HTTP_BIND", &c.HTTPBind)
+	str("PACMIR_MODE", &c.Mode)
+	str("PACMIR_PACMAN_CONFIG", &c.Pacman)
+	str("PACMIR_CACHE_DIRECTORY", &c.Cache.Directory)
+	str("PACMIR_MIRROR_STATUS", &c.Status)
+	list("PACMIR_MIRRORS", &c.Mirrors)
+	var sources []string
+	list("PACMIR_SOURCES", &sources)
+	if len(sources) > 0 {
+		// options configured by the file are retained.
+		replaced := make([]Source, 0, len(sources))
+		for _, name := range sources {
+			s, _ := c.Source(name)
+			s.Name = name
+			replaced = append(replaced, s)
+		}
+		c.Sources = replaced
+	}
+	list("PACMIR_PEERS", &c.Peers)
+
+	if err = size("PACMIR_BANDWIDTH_DOWNLOAD", &c.Bandwidth.Download); err != nil {
+		return c, err
+	}
+
+	if err = size("PACMIR_BANDWIDTH_UPLOAD", &c.Bandwidth.Upload); err != nil {
+		return c, err
+	}
+
+	if err = duration("PACMIR_HEDGE", &c.Hedge); err != nil {
+		return c, err
+	}
+
+	if err = duration("PACMIR_STALE_THRESHOLD", &c.Stale.Threshold); err != nil {
+		return c, err
+	}
+
+	if err = duration("PACMIR_STALE_TOLERANCE", &c.Stale.Tolerance); err != nil {
+		return c, err
+	}
+
+	return c, nil
+}
+
+// Encode the configuration as yaml.
+func Encode(c Config) ([]byte, error) {
+	return yaml.Marshal(c)
+}
@@ -0,0 +1,133 @@
+package config_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	. "github.com/james-lawrence/pacmir/config"
+	"github.com/james-lawrence/pacmir/internal/testingx"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestConfig(t *testing.T) {
+	g := testingx.Init(t)
+
+	g.Describe("Load", func() {
+		g.It("should return the defaults when the file is missing", func() {
+			c, err := Load(filepath.Join(os.TempDir(), "pacmir.missing.yaml"))
+			require.Nil(t, err)
+			require.Equal(t, Default(), c)
+		})
+
+		g.It("should layer the file over the defaults and the environment over the file", func() {
+			dir, err := ioutil.TempDir("", "pacmir.config.*")
+			require.Nil(t, err)
+			defer os.RemoveAll(dir)
+
+			path := filepath.Join(dir, "config.yaml")
+			require.Nil(t, ioutil.WriteFile(path, []byte(`
+http_bind: localhost:5000
+cache:
+  directory: /srv/pacmir
+bandwidth:
+  download: 10MiB
+stale:
+  threshold: 6h
+repositories:
+  testing:
+    disabled: true
+`), 0600))
+
+			c, err := Load(path)
+			require.Nil(t, err)
+			require.Equal(t, "localhost:5000", c.HTTPBind)
+			require.Equal(t, "/srv/pacmir", c.Cache.Directory)
+			require.Equal(t, Default().Pacman, c.Pacman)
+			require.Equal(t, Bytes(10*1024*1024), c.Bandwidth.Download)
+			require.Equal(t, 6*time.Hour, c.Stale.Threshold)
+			require.Equal(t, Default().Stale.Tolerance, c.Stale.Tolerance)
+			require.True(t, c.Repository("testing").Disabled)
+			require.False(t, c.Repository("core").Disabled)
+
+			env := map[string]string{
+				"PACMIR_HTTP_BIND":        ":4000",
+				"PACMIR_PEERS":            "10.0.0.1:4000,10.0.0.2:4000",
+				"PACMIR_BANDWIDTH_UPLOAD": "1MB",
+				"PACMIR_STALE_TOLERANCE":  "30m",
+			}
+			c, err = Environ(c, func(k string) (string, bool) {
+				v, ok := env[k]
+				return v, ok
+			})
+			require.Nil(t, err)
+			require.Equal(t, ":4000", c.HTTPBind)
+			require.Equal(t, "/srv/pacmir", c.Cache.Directory)
+			require.Equal(t, []string{"10.0.0.1:4000", "10.0.0.2:4000"}, c.Peers)
+			require.Equal(t, Bytes(1000*1000), c.Bandwidth.Upload)
+			require.Equal(t, 30*time.Minute, c.Stale.Tolerance)
+		})
+	})
+
+	g.Describe("Sources", func() {
+		g.It("should accept names and sources with options", func() {
+			dir, err := ioutil.TempDir("", "pacmir.config.*")
+			require.Nil(t, err)
+			defer os.RemoveAll(dir)
+
+			path := filepath.Join(dir, "config.yaml")
+			require.Nil(t, ioutil.WriteFile(path, []byte(`
+sources:
+  - local
+  - name: peers
+    timeout: 2s
+    max_size: 512MiB
+  - name: swarm
+    disabled: true
+  - mirror
+`), 0600))
+
+			c, err := Load(path)
+			require.Nil(t, err)
+			require.Equal(t, []Source{
+				{Name: "local"},
+				{Name: "peers", Timeout: 2 * time.Second, MaxSize: 512 * 1024 * 1024},
+				{Name: "swarm", Disabled: true},
+				{Name: "mirror"},
+			}, c.Sources)
+
+			encoded, err := Encode(c)
+			require.Nil(t, err)
+			require.Contains(t, string(encoded), "- local\n")
+			require.Contains(t, string(encoded), "max_size: 512 MiB\n")
+
+			c, err = Environ(c, func(k string) (string, bool) {
+				if k == "PACMIR_SOURCES" {
+					return "peers,mirror", true
+				}
+				return "", false
+			})
+			require.Nil(t, err)
+			require.Equal(t, []Source{
+				{Name: "peers", Timeout: 2 * time.Second, MaxSize: 512 * 1024 * 1024},
+				{Name: "mirror"},
+			}, c.Sources)
+		})
+
+		g.It("should reject sources without a name", func() {
+			dir, err := ioutil.TempDir("", "pacmir.config.*")
+			require.Nil(t, err)
+			defer os.RemoveAll(dir)
+
+			path := filepath.Join(dir, "config.yaml")
+			require.Nil(t, ioutil.WriteFile(path, []byte("sources:\n  - timeout: 2s\n"), 0600))
+
+			_, err = Load(path)
+			require.NotNil(t, err)
+			require.Contains(t, err.Error(), "source is missing its name")
+		})
+	})
+}
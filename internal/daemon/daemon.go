@@ -0,0 +1,245 @@
+// Package daemon assembles the routes served by the pacmir daemon.
+package daemon
+
+import (
+	"context"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/james-lawrence/pacmir"
+	"github.com/james-lawrence/pacmir/config"
+	"github.com/james-lawrence/pacmir/internal/httputilx"
+	"github.com/james-lawrence/pacmir/localmir"
+	"github.com/james-lawrence/pacmir/mirrors"
+	"github.com/james-lawrence/pacmir/pdex"
+	"github.com/justinas/alice"
+	"github.com/pkg/errors"
+	"golang.org/x/time/rate"
+)
+
+// Routes builds the routes for the configuration, the returned closers
+// release the resources used by the routes.
+// the upstream mirror state is retained across calls, it's only replaced when its configuration changes.
+func Routes(c config.Config, upstreams *Upstreams, sharing map[string]localmir.Sharer) (_ http.Handler, closers []io.Closer, err error) {
+	var (
+		middleware = alice.New(
+			httputilx.RouteInvokedHandler,
+		)
+		router = mux.NewRouter()
+		// packages are identified by their filename, every configuration shares the cache.
+		packages = localmir.NewPackageCache(
+			filepath.Join(c.Cache.Directory, "packages"),
+			pdex.New(filepath.Join(c.Cache.Directory, "index")),
+			sharing,
+		)
+		// the bandwidth limits apply to the daemon as a whole, not to each configuration.
+		s = shared{
+			packages: packages,
+			download: localmir.NewLimiter(uint64(c.Bandwidth.Download)),
+			upload:   localmir.NewLimiter(uint64(c.Bandwidth.Upload)),
+		}
+		verified []*localmir.Integrity
+	)
+
+	if s.ranking, s.breaker, err = upstreams.resolve(c); err != nil {
+		return nil, nil, err
+	}
+
+	// every configuration, including the chroots, is bound using the resolved mode.
+	c.Mode = string(mirrors.Mode(c.Mode).Resolve())
+	log.Println("mode", c.Mode)
+
+	// pacmir's cache is watched by the inventories, it must exist before they're created.
+	if err = os.MkdirAll(packages.Directory, 0755); err != nil {
+		return nil, nil, errors.WithStack(err)
+	}
+
+	for name, path := range c.Chroots {
+		if name == "" || strings.Contains(name, "/") {
+			Release(closers...)
+			return nil, nil, errors.Errorf("invalid chroot name: %s", name)
+		}
+
+		log.Println("serving chroot", name, path)
+		cconfig := pacmir.NewCachedConfig(path)
+		inventory := localmir.NewInventory(cconfig, packages.Directory)
+		closers = append(closers, cconfig, inventory, probe(c.HTTPBind, s.ranking, cconfig))
+		databases := localmir.NewDBCache(filepath.Join(c.Cache.Directory, "chroots", name, "databases"), c.Cache.Revalidate)
+		integrity, err := bind(c, router.PathPrefix("/"+name+"/{repo}/os/{arch}").Subrouter(), middleware, s, cconfig, databases, inventory)
+		if err != nil {
+			Release(closers...)
+			return nil, nil, err
+		}
+		verified = append(verified, integrity)
+	}
+
+	cconfig := pacmir.NewCachedConfig(c.Pacman)
+	inventory := localmir.NewInventory(cconfig, packages.Directory)
+	closers = append(closers, cconfig, inventory, probe(c.HTTPBind, s.ranking, cconfig))
+	databases := localmir.NewDBCache(filepath.Join(c.Cache.Directory, "databases"), c.Cache.Revalidate)
+	integrity, err := bind(c, router.PathPrefix("/{repo}/os/{arch}").Subrouter(), middleware, s, cconfig, databases, inventory)
+	if err != nil {
+		Release(closers...)
+		return nil, nil, err
+	}
+
+	localmir.Status{
+		Ranking:   s.ranking,
+		Staleness: staleness(c),
+		Breaker:   s.breaker,
+		Inventory: inventory,
+		Integrity: append(verified, integrity),
+	}.Bind(middleware, router)
+
+	httputilx.NotFound(middleware).Bind(router)
+
+	upstreams.retain(c, s.ranking, s.breaker)
+
+	return router, closers, nil
+}
+
+// Serve the handler on the address in the background, errors are reported to the failed channel.
+func Serve(addr string, h http.Handler, failed chan error) (_ *http.Server, err error) {
+	var (
+		l net.Listener
+	)
+
+	if l, err = net.Listen("tcp", addr); err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	srv := &http.Server{Handler: h}
+	go func() {
+		if err := srv.Serve(l); err != http.ErrServerClosed {
+			select {
+			case failed <- err:
+			default:
+			}
+		}
+	}()
+
+	return srv, nil
+}
+
+// probe periodically ranks the mirrors of the pacman configuration until closed.
+// pacmir's own entry is ignored.
+func probe(local string, ranking *mirrors.Ranker, cconfig *pacmir.CachedConfig) io.Closer {
+	ctx, done := context.WithCancel(context.Background())
+
+	go ranking.Background(ctx, time.Hour, func() (servers []string) {
+		for _, r := range cconfig.Repositories() {
+			for _, s := range r.Servers {
+				if strings.Contains(s, local) {
+					continue
+				}
+				servers = append(servers, s)
+			}
+		}
+
+		return servers
+	})
+
+	return cancelcloser(done)
+}
+
+type cancelcloser context.CancelFunc
+
+func (t cancelcloser) Close() error {
+	t()
+	return nil
+}
+
+// Release the resources, failures are logged.
+func Release(closers ...io.Closer) {
+	for _, c := range closers {
+		if err := c.Close(); err != nil {
+			log.Println(errors.Wrap(err, "failed to release resources"))
+		}
+	}
+}
+
+// shared resources used by every pacman configuration.
+type shared struct {
+	ranking  *mirrors.Ranker
+	breaker  *mirrors.Breaker
+	packages *localmir.PackageCache
+	download *rate.Limiter
+	upload   *rate.Limiter
+}
+
+// bind the mirror routes for the pacman configuration to the router, returns the
+// integrity verifying the configuration's packages.
+func bind(c config.Config, prouter *mux.Router, middleware alice.Chain, s shared, cconfig *pacmir.CachedConfig, databases *localmir.DBCache, inventory *localmir.Inventory) (*localmir.Integrity, error) {
+	fallback := localmir.Proxied{
+		HTTPAddress: c.HTTPBind,
+		Pacman:      cconfig,
+		Overrides:   c.Repositories,
+		Bandwidth:   s.download,
+		CacheServer: mirrors.Mode(c.Mode) == mirrors.ModeCacheServer,
+		Ranking:     s.ranking,
+		Staleness:   staleness(c),
+		Databases:   databases,
+		Breaker:     s.breaker,
+		Packages:    s.packages,
+		Segmented:   segmented(c),
+	}
+	rmiddleware := middleware.Append(
+		localmir.Enabled(c),
+		localmir.Architecture(cconfig),
+	)
+	fallback.Bind(rmiddleware, prouter)
+
+	local := localmir.Local{Inventory: inventory}
+	chain, err := localmir.NewChain(c.Sources, map[string]localmir.Link{
+		"local":  {Source: local, Local: true},
+		"peers":  {Source: localmir.Peers{Addresses: c.Peers}},
+		"mirror": {Source: fallback, Trusted: true},
+		// the swarm only seeds packages, content ids can't be resolved from filenames.
+		"swarm": {},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	integrity := localmir.NewIntegrity(fallback, time.Hour)
+	localmir.Download{
+		Sources:   chain,
+		Overrides: c.Repositories,
+		Hedge:     c.Hedge,
+		Fallback:  http.HandlerFunc(fallback.Proxy),
+		Bandwidth: s.upload,
+		Index:     s.packages.Index,
+		Integrity: integrity,
+	}.Bind(rmiddleware.Append(
+		httputilx.DumpRequestHandler,
+	), prouter)
+
+	return integrity, nil
+}
+
+func segmented(c config.Config) *localmir.Segmented {
+	if c.Segments.Mirrors < 2 {
+		return nil
+	}
+
+	return &localmir.Segmented{
+		Mirrors:   c.Segments.Mirrors,
+		Segment:   int64(c.Segments.Size),
+		Threshold: int64(c.Segments.Threshold),
+		Stall:     c.Segments.Stall,
+	}
+}
+
+func staleness(c config.Config) mirrors.Staleness {
+	return mirrors.Staleness{
+		Threshold: c.Stale.Threshold,
+		Tolerance: c.Stale.Tolerance,
+	}
+}
@@ -0,0 +1,182 @@
+package daemon_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/james-lawrence/pacmir/config"
+	. "github.com/james-lawrence/pacmir/internal/daemon"
+	"github.com/james-lawrence/pacmir/internal/testingx"
+	"github.com/james-lawrence/pacmir/localmir"
+	"github.com/james-lawrence/pacmir/mirrors"
+
+	"github.com/stretchr/testify/require"
+)
+
+// upstream serves the database for every repository, everything else is missing.
+func upstream(db string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		if filepath.Base(req.URL.Path) != "core.db" {
+			resp.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		resp.Write([]byte(db))
+	}))
+}
+
+func TestRoutes(t *testing.T) {
+	g := testingx.Init(t)
+
+	const pkgname = "example-1.0-1-x86_64.pkg.tar.zst"
+
+	write := func(path string, content []byte) {
+		require.Nil(t, os.MkdirAll(filepath.Dir(path), 0755))
+		require.Nil(t, ioutil.WriteFile(path, content, 0600))
+	}
+
+	// pacman writes a pacman configuration using the upstream, its cache and database directories
+	// are within the root.
+	pacman := func(root string, u *httptest.Server) string {
+		conf := filepath.Join(root, "pacman.conf")
+		write(conf, []byte(fmt.Sprintf(
+			"[options]\nArchitecture = x86_64\nCacheDir = %s/\nDBPath = %s/\n\n[core]\nServer = %s/$repo/os/$arch\n",
+			filepath.Join(root, "cache"), filepath.Join(root, "db"), u.URL,
+		)))
+		return conf
+	}
+
+	// setup a default configuration and an arm chroot, the package is only cached by the chroot.
+	setup := func(mode string) (local *httptest.Server, done func()) {
+		dir, err := ioutil.TempDir("", "pacmir.daemon.*")
+		require.Nil(t, err)
+
+		primary := upstream("default database")
+		chroot := upstream("chroot database")
+
+		contents := []byte("package contents")
+		write(filepath.Join(dir, "arm", "cache", pkgname), contents)
+		write(filepath.Join(dir, "arm", "db", "sync", "core.db"), testingx.SyncDB(map[string][]byte{pkgname: contents}))
+
+		c := config.Default()
+		c.Mode = mode
+		c.Pacman = pacman(filepath.Join(dir, "default"), primary)
+		c.Chroots = map[string]string{"arm": pacman(filepath.Join(dir, "arm"), chroot)}
+		c.Cache.Directory = filepath.Join(dir, "pacmir")
+
+		h, closers, err := Routes(c, &Upstreams{}, map[string]localmir.Sharer{})
+		require.Nil(t, err)
+		local = httptest.NewServer(h)
+
+		return local, func() {
+			local.Close()
+			Release(closers...)
+			primary.Close()
+			chroot.Close()
+			os.RemoveAll(dir)
+		}
+	}
+
+	get := func(url string) (*http.Response, string) {
+		resp, err := http.Get(url)
+		require.Nil(t, err)
+		defer resp.Body.Close()
+
+		body, err := ioutil.ReadAll(resp.Body)
+		require.Nil(t, err)
+
+		return resp, string(body)
+	}
+
+	g.Describe("routes", func() {
+		g.It("should serve chroots from their own mirrors", func() {
+			local, done := setup(string(mirrors.ModeServer))
+			defer done()
+
+			resp, body := get(local.URL + "/core/os/x86_64/core.db")
+			require.Equal(t, http.StatusOK, resp.StatusCode)
+			require.Equal(t, "default database", body)
+
+			resp, body = get(local.URL + "/arm/core/os/x86_64/core.db")
+			require.Equal(t, http.StatusOK, resp.StatusCode)
+			require.Equal(t, "chroot database", body)
+		})
+
+		g.It("should serve chroots from their own cache directories", func() {
+			local, done := setup(string(mirrors.ModeServer))
+			defer done()
+
+			resp, body := get(local.URL + "/arm/core/os/x86_64/" + pkgname)
+			require.Equal(t, http.StatusOK, resp.StatusCode)
+			require.Equal(t, "package contents", body)
+			require.Equal(t, "local", resp.Header.Get(localmir.SourceHeader))
+
+			resp, _ = get(local.URL + "/core/os/x86_64/" + pkgname)
+			require.Equal(t, http.StatusNotFound, resp.StatusCode)
+		})
+
+		g.It("should retain the upstream state unless its configuration changes", func() {
+			dir, err := ioutil.TempDir("", "pacmir.daemon.*")
+			require.Nil(t, err)
+			defer os.RemoveAll(dir)
+
+			primary := upstream("default database")
+			defer primary.Close()
+
+			c := config.Default()
+			c.Mode = string(mirrors.ModeServer)
+			c.Pacman = pacman(filepath.Join(dir, "default"), primary)
+			c.Cache.Directory = filepath.Join(dir, "pacmir")
+
+			upstreams := &Upstreams{}
+			reload := func(c config.Config) {
+				_, closers, err := Routes(c, upstreams, map[string]localmir.Sharer{})
+				require.Nil(t, err)
+				Release(closers...)
+			}
+
+			reload(c)
+			ranking, breaker := upstreams.Ranking(), upstreams.Breaker()
+			require.NotNil(t, ranking)
+			require.NotNil(t, breaker)
+
+			reload(c)
+			require.True(t, ranking == upstreams.Ranking())
+			require.True(t, breaker == upstreams.Breaker())
+
+			c.Breaker.Cooldown = time.Minute
+			reload(c)
+			require.True(t, ranking == upstreams.Ranking())
+			require.False(t, breaker == upstreams.Breaker())
+
+			c.Breaker.Failures = 0
+			reload(c)
+			require.Nil(t, upstreams.Breaker())
+
+			c.Cache.Directory = filepath.Join(dir, "moved")
+			reload(c)
+			require.False(t, ranking == upstreams.Ranking())
+		})
+
+		g.It("should not serve databases from chroots as a cache server", func() {
+			local, done := setup(string(mirrors.ModeCacheServer))
+			defer done()
+
+			resp, _ := get(local.URL + "/core/os/x86_64/core.db")
+			require.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+			resp, _ = get(local.URL + "/arm/core/os/x86_64/core.db")
+			require.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+			resp, body := get(local.URL + "/arm/core/os/x86_64/" + pkgname)
+			require.Equal(t, http.StatusOK, resp.StatusCode)
+			require.Equal(t, "package contents", body)
+		})
+	})
+}
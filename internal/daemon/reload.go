@@ -0,0 +1,85 @@
+package daemon
+
+import (
+	"context"
+	"io"
+	"log"
+	"net/http"
+	"os"
+
+	"github.com/james-lawrence/pacmir/config"
+	"github.com/james-lawrence/pacmir/internal/httputilx"
+	"github.com/pkg/errors"
+)
+
+// Reload serves the routes for the configuration until the server fails or the context
+// is cancelled. every signal reloads the configuration and rebuilds the routes in place,
+// requests in flight complete using the routes they started with. the listener is only
+// replaced when the address changes, failed reloads continue with the previous routes.
+func Reload(ctx context.Context, c config.Config, signals <-chan os.Signal, reload func() (config.Config, error), routes func(config.Config) (http.Handler, []io.Closer, error)) (err error) {
+	var (
+		h       http.Handler
+		closers []io.Closer
+		srv     *http.Server
+		failed  = make(chan error, 1)
+	)
+
+	if h, closers, err = routes(c); err != nil {
+		return err
+	}
+	// closers are replaced on every reload, release the latest.
+	defer func() { Release(closers...) }()
+
+	handler := httputilx.NewSwappable(h)
+
+	if srv, err = Serve(c.HTTPBind, handler, failed); err != nil {
+		return err
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return srv.Shutdown(context.Background())
+		case err = <-failed:
+			return err
+		case <-signals:
+		}
+
+		log.Println("reloading configuration")
+
+		updated, err := reload()
+		if err != nil {
+			log.Println(errors.Wrap(err, "reload failed, continuing with the previous configuration"))
+			continue
+		}
+
+		h, replaced, err := routes(updated)
+		if err != nil {
+			log.Println(errors.Wrap(err, "reload failed, continuing with the previous configuration"))
+			continue
+		}
+
+		if updated.HTTPBind != c.HTTPBind {
+			log.Println("rebinding", c.HTTPBind, "->", updated.HTTPBind)
+			rebound, err := Serve(updated.HTTPBind, handler, failed)
+			if err != nil {
+				Release(replaced...)
+				log.Println(errors.Wrap(err, "reload failed, continuing with the previous configuration"))
+				continue
+			}
+
+			// shutdown waits for active requests to complete.
+			go func(previous *http.Server) {
+				if err := previous.Shutdown(context.Background()); err != nil {
+					log.Println(errors.Wrap(err, "failed to shutdown previous listener"))
+				}
+			}(srv)
+			srv = rebound
+		}
+
+		handler.Swap(h)
+		Release(closers...)
+		c, closers = updated, replaced
+		log.Println("reloaded configuration")
+	}
+}
@@ -0,0 +1,222 @@
+package daemon_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/james-lawrence/pacmir/config"
+	. "github.com/james-lawrence/pacmir/internal/daemon"
+	"github.com/james-lawrence/pacmir/internal/testingx"
+
+	"github.com/stretchr/testify/require"
+)
+
+// closer records if it was closed.
+type closer struct {
+	closed int32
+}
+
+func (t *closer) Close() error {
+	atomic.StoreInt32(&t.closed, 1)
+	return nil
+}
+
+func TestReload(t *testing.T) {
+	g := testingx.Init(t)
+
+	// address available for listening.
+	address := func() string {
+		l, err := net.Listen("tcp", "localhost:0")
+		require.Nil(t, err)
+		defer l.Close()
+		return l.Addr().String()
+	}
+
+	get := func(addr string) (string, error) {
+		resp, err := http.Get("http://" + addr)
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+
+		body, err := ioutil.ReadAll(resp.Body)
+		return string(body), err
+	}
+
+	// eventually waits for the address to serve the body.
+	eventually := func(addr string, expected string) {
+		deadline := time.Now().Add(2 * time.Second)
+		for {
+			if body, err := get(addr); err == nil && body == expected {
+				return
+			}
+			require.True(t, time.Now().Before(deadline), "%s never served %s", addr, expected)
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	// daemon serves the initial routes on the address, routes built by reloads serve "reloaded".
+	// the signals are unbuffered, a signal is received once the previous reload completed.
+	daemon := func(addr string, reload func() (config.Config, error), initial http.Handler, failing bool) (signals chan os.Signal, initialc *closer, done func()) {
+		var (
+			generation int32
+			ctx, stop  = context.WithCancel(context.Background())
+			stopped    = make(chan error)
+		)
+
+		c := config.Default()
+		c.HTTPBind = addr
+		signals = make(chan os.Signal)
+		initialc = &closer{}
+
+		routes := func(c config.Config) (http.Handler, []io.Closer, error) {
+			if atomic.AddInt32(&generation, 1) == 1 {
+				return initial, []io.Closer{initialc}, nil
+			}
+
+			if failing {
+				return nil, nil, errors.New("routes failed")
+			}
+
+			return http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+				resp.Write([]byte("reloaded"))
+			}), nil, nil
+		}
+
+		go func() {
+			stopped <- Reload(ctx, c, signals, reload, routes)
+		}()
+		eventually(addr, "initial")
+
+		return signals, initialc, func() {
+			stop()
+			require.Nil(t, <-stopped)
+		}
+	}
+
+	initial := http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		resp.Write([]byte("initial"))
+	})
+
+	reloaded := func(c config.Config) func() (config.Config, error) {
+		return func() (config.Config, error) {
+			return c, nil
+		}
+	}
+
+	g.Describe("Reload", func() {
+		g.It("should complete requests in flight using the previous routes", func() {
+			var (
+				started = make(chan struct{})
+				release = make(chan struct{})
+				body    = make(chan string)
+				addr    = address()
+				c       = config.Default()
+			)
+
+			c.HTTPBind = addr
+			blocking := http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+				if req.URL.Path == "/blocked" {
+					close(started)
+					<-release
+				}
+				resp.Write([]byte("initial"))
+			})
+
+			signals, initialc, done := daemon(addr, reloaded(c), blocking, false)
+			defer done()
+
+			go func() {
+				resp, err := http.Get("http://" + addr + "/blocked")
+				require.Nil(t, err)
+				defer resp.Body.Close()
+				raw, err := ioutil.ReadAll(resp.Body)
+				require.Nil(t, err)
+				body <- string(raw)
+			}()
+			<-started
+
+			signals <- syscall.SIGHUP
+			eventually(addr, "reloaded")
+			require.Equal(t, int32(1), atomic.LoadInt32(&initialc.closed))
+
+			close(release)
+			require.Equal(t, "initial", <-body)
+		})
+
+		g.It("should not rebind when the address is unchanged", func() {
+			addr := address()
+			c := config.Default()
+			c.HTTPBind = addr
+
+			// rebinding an address in use would fail the reload.
+			signals, _, done := daemon(addr, reloaded(c), initial, false)
+			defer done()
+
+			signals <- syscall.SIGHUP
+			eventually(addr, "reloaded")
+		})
+
+		g.It("should rebind when the address changes", func() {
+			previous, addr := address(), address()
+			c := config.Default()
+			c.HTTPBind = addr
+
+			signals, _, done := daemon(previous, reloaded(c), initial, false)
+			defer done()
+
+			signals <- syscall.SIGHUP
+			eventually(addr, "reloaded")
+
+			deadline := time.Now().Add(2 * time.Second)
+			for _, err := get(previous); err == nil; _, err = get(previous) {
+				require.True(t, time.Now().Before(deadline), "the previous listener was never shutdown")
+				time.Sleep(10 * time.Millisecond)
+			}
+		})
+
+		g.It("should continue with the previous routes when the configuration fails to load", func() {
+			addr := address()
+			failed := func() (config.Config, error) {
+				return config.Config{}, errors.New("invalid configuration")
+			}
+
+			signals, initialc, done := daemon(addr, failed, initial, false)
+			defer done()
+
+			signals <- syscall.SIGHUP
+			signals <- syscall.SIGHUP
+
+			body, err := get(addr)
+			require.Nil(t, err)
+			require.Equal(t, "initial", body)
+			require.Zero(t, atomic.LoadInt32(&initialc.closed))
+		})
+
+		g.It("should continue with the previous routes when the routes fail to build", func() {
+			addr := address()
+			c := config.Default()
+			c.HTTPBind = addr
+
+			signals, initialc, done := daemon(addr, reloaded(c), initial, true)
+			defer done()
+
+			signals <- syscall.SIGHUP
+			signals <- syscall.SIGHUP
+
+			body, err := get(addr)
+			require.Nil(t, err)
+			require.Equal(t, "initial", body)
+			require.Zero(t, atomic.LoadInt32(&initialc.closed))
+		})
+	})
+}
@@ -0,0 +1,72 @@
+package daemon
+
+import (
+	"log"
+	"path/filepath"
+
+	"github.com/james-lawrence/pacmir/config"
+	"github.com/james-lawrence/pacmir/mirrors"
+	"github.com/pkg/errors"
+)
+
+// Upstreams the state of the upstream mirrors, retained across reloads.
+type Upstreams struct {
+	path     string
+	ranking  *mirrors.Ranker
+	settings config.Breaker
+	breaker  *mirrors.Breaker
+}
+
+// Ranking of the upstream mirrors, nil until routes are built.
+func (t *Upstreams) Ranking() *mirrors.Ranker {
+	return t.ranking
+}
+
+// Breaker of the upstream mirrors, nil when disabled.
+func (t *Upstreams) Breaker() *mirrors.Breaker {
+	return t.breaker
+}
+
+// resolve the ranking and breaker for the configuration. the ranking is reloaded when the
+// cache directory changes, the breaker is replaced when its settings change. the upstreams
+// are unchanged until the resolved state is retained.
+func (t *Upstreams) resolve(c config.Config) (ranking *mirrors.Ranker, breaker *mirrors.Breaker, err error) {
+	path := filepath.Join(c.Cache.Directory, "mirrors.json")
+
+	if ranking = t.ranking; ranking == nil || path != t.path {
+		if ranking, err = mirrors.NewRanker(path); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if breaker = t.breaker; t.ranking == nil || c.Breaker != t.settings {
+		breaker = nil
+		if c.Breaker.Failures > 0 {
+			breaker = mirrors.NewBreaker(c.Breaker.Failures, c.Breaker.Cooldown)
+		}
+	}
+
+	return ranking, breaker, nil
+}
+
+// retain the resolved state.
+func (t *Upstreams) retain(c config.Config, ranking *mirrors.Ranker, breaker *mirrors.Breaker) {
+	path := filepath.Join(c.Cache.Directory, "mirrors.json")
+
+	if t.ranking != nil && t.ranking != ranking {
+		log.Println("mirror scores moved", t.path, "->", path)
+		// persist the previous scores before they're abandoned.
+		if err := t.ranking.Save(); err != nil {
+			log.Println(errors.Wrap(err, "unable to persist mirror scores"))
+		}
+	}
+
+	if t.ranking != nil && t.breaker != breaker {
+		log.Println("breaker reconfigured, every circuit is closed")
+	}
+
+	t.path = path
+	t.ranking = ranking
+	t.settings = c.Breaker
+	t.breaker = breaker
+}
@@ -4,6 +4,7 @@ import (
 	"log"
 	"net/http"
 	"net/http/httputil"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/mux"
@@ -63,3 +64,25 @@ func DumpRequestHandler(original http.Handler) http.Handler {
 		original.ServeHTTP(resp, req)
 	})
 }
+
+// NewSwappable handler.
+func NewSwappable(h http.Handler) *Swappable {
+	s := &Swappable{}
+	s.Swap(h)
+	return s
+}
+
+// Swappable handler that can be replaced while serving requests.
+// requests in flight complete using the handler they started with.
+type Swappable struct {
+	current atomic.Value
+}
+
+// Swap the handler used for new requests.
+func (t *Swappable) Swap(h http.Handler) {
+	t.current.Store(&h)
+}
+
+func (t *Swappable) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	(*t.current.Load().(*http.Handler)).ServeHTTP(resp, req)
+}
@@ -0,0 +1,59 @@
+package testingx
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"fmt"
+	"io"
+)
+
+// SyncDB builds a gzip compressed sync database containing the packages.
+func SyncDB(pkgs map[string][]byte) []byte {
+	return CompressedSyncDB(func(w io.Writer) (io.WriteCloser, error) {
+		return gzip.NewWriter(w), nil
+	}, pkgs)
+}
+
+// CompressedSyncDB builds a sync database containing the packages using the compression.
+func CompressedSyncDB(compression func(io.Writer) (io.WriteCloser, error), pkgs map[string][]byte) []byte {
+	var (
+		buf bytes.Buffer
+	)
+
+	cw, err := compression(&buf)
+	if err != nil {
+		panic(err)
+	}
+
+	archive := tar.NewWriter(cw)
+	for filename, contents := range pkgs {
+		desc := fmt.Sprintf(
+			"%%FILENAME%%\n%s\n\n%%NAME%%\nexample\n\n%%VERSION%%\n1.0-1\n\n%%CSIZE%%\n%d\n\n%%SHA256SUM%%\n%x\n\n%%ARCH%%\nx86_64\n\n",
+			filename, len(contents), sha256.Sum256(contents),
+		)
+
+		if err := archive.WriteHeader(&tar.Header{Name: filename + "/", Typeflag: tar.TypeDir, Mode: 0755}); err != nil {
+			panic(err)
+		}
+
+		if err := archive.WriteHeader(&tar.Header{Name: filename + "/desc", Mode: 0644, Size: int64(len(desc))}); err != nil {
+			panic(err)
+		}
+
+		if _, err := archive.Write([]byte(desc)); err != nil {
+			panic(err)
+		}
+	}
+
+	if err := archive.Close(); err != nil {
+		panic(err)
+	}
+
+	if err := cw.Close(); err != nil {
+		panic(err)
+	}
+
+	return buf.Bytes()
+}
@@ -0,0 +1,62 @@
+package localmir
+
+import (
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/james-lawrence/pacmir"
+	"github.com/justinas/alice"
+)
+
+// Architecture rejects requests for architectures the host does not use,
+// and packages built for a different architecture. prevents serving cached
+// packages built for the wrong microarchitecture (x86_64 vs x86_64_v3).
+func Architecture(pacman *pacmir.CachedConfig) alice.Constructor {
+	return func(original http.Handler) http.Handler {
+		return http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+			var (
+				params = mux.Vars(req)
+				rname  = params["repo"]
+				arch   = params["arch"]
+			)
+
+			repo, ok := pacman.Repository(rname)
+			if !ok {
+				http.Error(resp, "unknown repository: "+rname, http.StatusNotFound)
+				return
+			}
+
+			if repo, ok = repo.Arch(arch); !ok {
+				log.Println("rejecting architecture", rname, arch, repo.Architectures)
+				http.Error(resp, "architecture not used by this host: "+arch, http.StatusNotFound)
+				return
+			}
+
+			if parch, ok := packageArch(params["package"]); ok && !repo.Supports(parch) {
+				log.Println("rejecting package architecture", rname, params["package"], repo.Architectures)
+				http.Error(resp, "package architecture not used by this host: "+parch, http.StatusNotFound)
+				return
+			}
+
+			original.ServeHTTP(resp, req)
+		})
+	}
+}
+
+// packageArch extracts the architecture from a package filename.
+// i.e.) linux-5.10.5.arch1-1-x86_64.pkg.tar.zst -> x86_64
+func packageArch(name string) (string, bool) {
+	idx := strings.Index(name, ".pkg.tar")
+	if idx < 0 {
+		return "", false
+	}
+
+	base := name[:idx]
+	if idx = strings.LastIndex(base, "-"); idx < 0 {
+		return "", false
+	}
+
+	return base[idx+1:], true
+}
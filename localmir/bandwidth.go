@@ -0,0 +1,48 @@
+package localmir
+
+import (
+	"context"
+	"io"
+
+	"golang.org/x/time/rate"
+)
+
+// NewLimiter for the given bytes per second, zero is unlimited.
+func NewLimiter(bps uint64) *rate.Limiter {
+	if bps == 0 {
+		return rate.NewLimiter(rate.Inf, 0)
+	}
+
+	// allow bursts of up to a second worth of data.
+	return rate.NewLimiter(rate.Limit(bps), int(bps))
+}
+
+// limited copies from src to dst respecting the bandwidth limit.
+func limited(ctx context.Context, l *rate.Limiter, dst io.Writer, src io.Reader) (int64, error) {
+	if l == nil || l.Limit() == rate.Inf {
+		return io.Copy(dst, src)
+	}
+
+	return io.Copy(dst, throttled{ctx: ctx, l: l, r: src})
+}
+
+type throttled struct {
+	ctx context.Context
+	l   *rate.Limiter
+	r   io.Reader
+}
+
+func (t throttled) Read(b []byte) (n int, err error) {
+	if len(b) > t.l.Burst() {
+		b = b[:t.l.Burst()]
+	}
+
+	n, err = t.r.Read(b)
+	if n > 0 {
+		if werr := t.l.WaitN(t.ctx, n); werr != nil {
+			return n, werr
+		}
+	}
+
+	return n, err
+}
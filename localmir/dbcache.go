@@ -0,0 +1,446 @@
+package localmir
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// fetcher retrieves the named file from the upstream mirror, sending the provided headers.
+type fetcher func(ctx context.Context, upstream, name string, header http.Header) (*http.Response, error)
+
+// NewDBCache caches databases within the directory. copies younger than maxage
+// are served without revalidating them upstream.
+func NewDBCache(dir string, maxage time.Duration) *DBCache {
+	return &DBCache{
+		Directory: dir,
+		MaxAge:    maxage,
+		m:         &sync.Mutex{},
+		inflight:  map[string]*revalidation{},
+	}
+}
+
+// DBCache stores the last good copy of each sync database and its signature, revalidating
+// them upstream with conditional requests. a database and its signature are always retrieved
+// from the same upstream and published together. concurrent requests for the same database
+// share a single upstream request.
+type DBCache struct {
+	Directory string
+	MaxAge    time.Duration
+	m         *sync.Mutex
+	inflight  map[string]*revalidation
+}
+
+type revalidation struct {
+	done chan struct{}
+	err  error
+}
+
+// dbmeta metadata describing a cached copy.
+type dbmeta struct {
+	ETag         string    `json:"etag,omitempty"`
+	LastModified string    `json:"last_modified,omitempty"`
+	Upstream     string    `json:"upstream"`
+	Validated    time.Time `json:"validated"`
+	// Generation directory containing the database and its signature.
+	Generation string `json:"generation"`
+	// Signed the upstream provided a signature for the database.
+	Signed bool `json:"signed"`
+}
+
+// modified the upstream modification time, zero if unknown.
+func (t dbmeta) modified() time.Time {
+	ts, err := http.ParseTime(t.LastModified)
+	if err != nil {
+		return time.Time{}
+	}
+
+	return ts
+}
+
+// dbcopy a cached copy of a database and its signature.
+type dbcopy struct {
+	dir  string
+	name string
+	meta dbmeta
+	// stale copies could not be revalidated.
+	stale bool
+}
+
+func (t dbcopy) database() string {
+	return filepath.Join(t.dir, t.meta.Generation, t.name)
+}
+
+func (t dbcopy) signature() string {
+	return t.database() + ".sig"
+}
+
+// dir containing the copies of the key.
+func (t *DBCache) dir(key string) string {
+	return filepath.Join(t.Directory, filepath.FromSlash(path.Dir(key)))
+}
+
+func (t *DBCache) metapath(key string) string {
+	return filepath.Join(t.dir(key), path.Base(key)+".json")
+}
+
+func (t *DBCache) load(key string) (c dbcopy, ok bool) {
+	var (
+		raw []byte
+		err error
+	)
+
+	c = dbcopy{dir: t.dir(key), name: path.Base(key)}
+
+	if raw, err = ioutil.ReadFile(t.metapath(key)); err != nil {
+		return c, false
+	}
+
+	if err = json.Unmarshal(raw, &c.meta); err != nil {
+		log.Println(errors.Wrapf(err, "discarding corrupt database metadata %s", key))
+		return c, false
+	}
+
+	if c.meta.Generation == "" {
+		return c, false
+	}
+
+	if _, err = os.Stat(c.database()); err != nil {
+		return c, false
+	}
+
+	return c, true
+}
+
+// save the metadata, publishing the generation it references.
+func (t *DBCache) save(key string, m dbmeta) (err error) {
+	var (
+		encoded []byte
+	)
+
+	if encoded, err = json.Marshal(m); err != nil {
+		return errors.WithStack(err)
+	}
+
+	return atomicwrite(t.metapath(key), encoded)
+}
+
+// Get the cached copy of the database key, revalidating it upstream when older than MaxAge.
+// upstreams are attempted in order. when every upstream fails the previous copy is returned
+// marked as stale.
+func (t *DBCache) Get(key string, upstreams []string, fetch fetcher) (c dbcopy, err error) {
+	t.m.Lock()
+	if c, ok := t.load(key); ok && time.Since(c.meta.Validated) < t.MaxAge {
+		t.m.Unlock()
+		return c, nil
+	}
+
+	r, ok := t.inflight[key]
+	if !ok {
+		r = &revalidation{done: make(chan struct{})}
+		t.inflight[key] = r
+		go func() {
+			r.err = t.revalidate(key, upstreams, fetch)
+			t.m.Lock()
+			delete(t.inflight, key)
+			t.m.Unlock()
+			close(r.done)
+		}()
+	}
+	t.m.Unlock()
+
+	<-r.done
+
+	c, ok = t.load(key)
+	switch {
+	case ok && r.err != nil:
+		log.Println(errors.Wrapf(r.err, "serving stale %s", key))
+		c.stale = true
+		return c, nil
+	case ok:
+		return c, nil
+	case r.err != nil:
+		return c, r.err
+	default:
+		return c, errors.Errorf("missing cached copy %s", key)
+	}
+}
+
+// revalidate the cached copy of the key. the requests are detached from the clients
+// waiting on them, a client disconnecting doesn't fail the others.
+func (t *DBCache) revalidate(key string, upstreams []string, fetch fetcher) (err error) {
+	var (
+		attempts []attempt
+	)
+
+	ctx, done := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer done()
+
+	for _, u := range upstreams {
+		if err = t.attempt(ctx, key, u, fetch); err == nil {
+			return nil
+		}
+
+		log.Println(errors.Wrapf(err, "skipping %s for %s", u, key))
+		attempts = append(attempts, attempt{upstream: u, err: err})
+	}
+
+	return failure{name: path.Base(key), attempts: attempts}
+}
+
+// attempt to retrieve the database and its signature from the upstream.
+func (t *DBCache) attempt(ctx context.Context, key string, upstream string, fetch fetcher) (err error) {
+	var (
+		resp   *http.Response
+		gen    string
+		signed bool
+		name   = path.Base(key)
+		header = http.Header{}
+	)
+
+	previous, cached := t.load(key)
+	if cached {
+		if previous.meta.ETag != "" && previous.meta.Upstream == upstream {
+			header.Set("If-None-Match", previous.meta.ETag)
+		}
+
+		if previous.meta.LastModified != "" {
+			header.Set("If-Modified-Since", previous.meta.LastModified)
+		}
+	}
+
+	if resp, err = fetch(ctx, upstream, name, header); err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusNotModified:
+		// the signature of an unmodified database is unmodified.
+		if !cached {
+			return errors.New("not modified for an uncached copy")
+		}
+
+		previous.meta.Validated = time.Now()
+		return t.save(key, previous.meta)
+	case http.StatusOK:
+	default:
+		return unexpected(resp)
+	}
+
+	if err = os.MkdirAll(t.dir(key), 0755); err != nil {
+		return errors.WithStack(err)
+	}
+
+	if gen, err = ioutil.TempDir(t.dir(key), name+"."); err != nil {
+		return errors.WithStack(err)
+	}
+
+	// remove the generation unless it was published.
+	defer func() {
+		if err != nil {
+			os.RemoveAll(gen)
+		}
+	}()
+
+	if err = store(filepath.Join(gen, name), resp.Body); err != nil {
+		return err
+	}
+
+	if signed, err = t.signature(ctx, upstream, filepath.Join(gen, name), fetch); err != nil {
+		return err
+	}
+
+	if err = t.save(key, dbmeta{
+		ETag:         resp.Header.Get("ETag"),
+		LastModified: resp.Header.Get("Last-Modified"),
+		Upstream:     upstream,
+		Validated:    time.Now(),
+		Generation:   filepath.Base(gen),
+		Signed:       signed,
+	}); err != nil {
+		return err
+	}
+
+	t.prune(key, filepath.Base(gen), previous.meta.Generation)
+
+	return nil
+}
+
+// signature retrieves the signature of the database from the upstream, ensuring it matches
+// the database. returns false if the upstream doesn't sign the database.
+func (t *DBCache) signature(ctx context.Context, upstream string, database string, fetch fetcher) (_ bool, err error) {
+	var (
+		resp *http.Response
+		db   *os.File
+		sig  *os.File
+	)
+
+	name := filepath.Base(database) + ".sig"
+	if resp, err = fetch(ctx, upstream, name, http.Header{}); err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusNotFound:
+		return false, nil
+	case http.StatusOK:
+	default:
+		return false, errors.Wrap(unexpected(resp), name)
+	}
+
+	if err = store(database+".sig", resp.Body); err != nil {
+		return false, err
+	}
+
+	if db, err = os.Open(database); err != nil {
+		return false, errors.WithStack(err)
+	}
+	defer db.Close()
+
+	if sig, err = os.Open(database + ".sig"); err != nil {
+		return false, errors.WithStack(err)
+	}
+	defer sig.Close()
+
+	if err = signed(db, sig); err != nil {
+		return false, errors.Wrapf(err, "inconsistent %s", name)
+	}
+
+	return true, nil
+}
+
+// prune removes generations other than the current and previous generation. the previous
+// generation is retained for clients that loaded it before the current was published.
+func (t *DBCache) prune(key string, retain ...string) {
+	var (
+		err   error
+		infos []os.FileInfo
+	)
+
+	if infos, err = ioutil.ReadDir(t.dir(key)); err != nil {
+		log.Println(errors.Wrap(err, "unable to prune database generations"))
+		return
+	}
+
+	for _, fi := range infos {
+		if !fi.IsDir() || !strings.HasPrefix(fi.Name(), path.Base(key)+".") || contains(retain, fi.Name()) {
+			continue
+		}
+
+		if err = os.RemoveAll(filepath.Join(t.dir(key), fi.Name())); err != nil {
+			log.Println(errors.Wrap(err, "unable to prune database generation"))
+		}
+	}
+}
+
+func contains(set []string, s string) bool {
+	for _, v := range set {
+		if v == s {
+			return true
+		}
+	}
+
+	return false
+}
+
+// store the contents at the path.
+func store(path string, src io.Reader) (err error) {
+	var (
+		dst *os.File
+	)
+
+	if dst, err = os.Create(path); err != nil {
+		return errors.WithStack(err)
+	}
+	defer dst.Close()
+
+	if _, err = io.Copy(dst, src); err != nil {
+		return errors.Wrapf(err, "failed to download %s", filepath.Base(path))
+	}
+
+	return errors.WithStack(dst.Close())
+}
+
+// Serve the database, or its signature, to the client answering conditional requests.
+func (t dbcopy) Serve(resp http.ResponseWriter, req *http.Request, signature bool) {
+	var (
+		err error
+		f   *os.File
+		fi  os.FileInfo
+	)
+
+	p := t.database()
+	if signature {
+		if !t.meta.Signed {
+			resp.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		p = t.signature()
+	}
+
+	if f, err = os.Open(p); err != nil {
+		log.Println(errors.Wrap(err, "failed to open cached database"))
+		resp.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+
+	if fi, err = f.Stat(); err != nil {
+		log.Println(errors.Wrap(err, "failed to stat cached database"))
+		resp.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	modified := t.meta.modified()
+	if modified.IsZero() {
+		modified = fi.ModTime()
+	}
+
+	if t.meta.ETag != "" && !signature {
+		resp.Header().Set("ETag", t.meta.ETag)
+	}
+
+	if t.stale {
+		resp.Header().Set("Warning", `110 pacmir "Response is Stale"`)
+	}
+
+	resp.Header().Set("Content-Type", contenttype(fi.Name()))
+	http.ServeContent(resp, req, fi.Name(), modified, f)
+}
+
+// atomicwrite writes the data to a temporary file and renames it over the path.
+func atomicwrite(path string, data []byte) (err error) {
+	var (
+		dst *os.File
+	)
+
+	if dst, err = ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".*"); err != nil {
+		return errors.WithStack(err)
+	}
+	defer os.Remove(dst.Name())
+	defer dst.Close()
+
+	if _, err = dst.Write(data); err != nil {
+		return errors.WithStack(err)
+	}
+
+	if err = dst.Close(); err != nil {
+		return errors.WithStack(err)
+	}
+
+	return errors.WithStack(os.Rename(dst.Name(), path))
+}
@@ -1,22 +1,46 @@
 package localmir
 
 import (
+	"context"
 	"io"
 	"log"
 	"net/http"
+	"os"
+	"strconv"
+	"time"
 
 	"github.com/gorilla/mux"
+	"github.com/james-lawrence/pacmir/config"
+	"github.com/james-lawrence/pacmir/pdex"
 	"github.com/justinas/alice"
+	"github.com/pkg/errors"
+	"golang.org/x/time/rate"
 )
 
-type packager interface {
-	Package(repo, name string) (io.ReadCloser, error)
+// file packages backed by a file support range and conditional requests.
+type file interface {
+	io.ReadSeeker
+	Stat() (os.FileInfo, error)
 }
 
 // Download allow downloading packages.
 type Download struct {
-	Downloader packager
-	Fallback   http.Handler
+	// Sources consulted in order, the first to provide the package serves it.
+	Sources Chain
+	// Overrides per repository source order.
+	Overrides map[string]config.Repository
+	// Fallback serves packages none of the sources provided.
+	Fallback http.Handler
+	// Bandwidth limits uploads to clients.
+	Bandwidth *rate.Limiter
+	// Index describes packages that aren't backed by a file, optional.
+	Index *pdex.DB
+	// Hedge delay before the remaining remote sources race the first, zero consults the
+	// sources in order.
+	Hedge time.Duration
+	// Integrity verifies packages from untrusted sources against the sync database before
+	// they're served, corrupt sources are skipped. optional.
+	Integrity *Integrity
 }
 
 // Bind to a router
@@ -26,23 +50,260 @@ func (t Download) Bind(c alice.Chain, r *mux.Router) {
 
 func (t Download) download(resp http.ResponseWriter, req *http.Request) {
 	var (
-		err    error
-		pdata  io.ReadCloser
+		err      error
+		expected = pdex.Package{Size: -1}
+		params   = mux.Vars(req)
+		pname    = params["package"]
+		rname    = params["repo"]
+		peer     = req.Header.Get(PeerHeader) != ""
+		// signatures are verified by pacman.
+		verify     = t.Integrity != nil && pkg(pname)
+		unverified bool
+	)
+
+	resp.Header().Set("Content-Type", contenttype(pname))
+
+	if verify {
+		var p pdex.Package
+		if p, err = t.Integrity.Expected(rname, params["arch"], pname); err == nil {
+			expected = p
+		} else {
+			// the local caches continue to serve the package unverified, the other
+			// untrusted sources are never used without verifying their packages.
+			log.Println(errors.Wrapf(err, "unable to verify %s, only consulting local and trusted sources", pname))
+			verify, unverified = false, true
+		}
+	}
+
+	// head and range requests are only answered by local sources, retrieving the entire
+	// package from the others to answer them is wasteful. the fallback answers them instead.
+	partial := req.Method == http.MethodHead || req.Header.Get("Range") != ""
+
+	var consulted Chain
+	for _, l := range t.Sources.ordered(t.Overrides[rname].Sources) {
+		// peers never consult their own peers or mirrors on behalf of another peer.
+		if (peer || partial) && !l.Local {
+			continue
+		}
+
+		if unverified && !l.Local && !l.Trusted {
+			continue
+		}
+
+		if l.accepts(expected.Size) {
+			consulted = append(consulted, l)
+		}
+	}
+
+	// when hedging the local sources go first, the remaining sources race each other.
+	sequential, raced := consulted, Chain(nil)
+	if t.Hedge > 0 {
+		sequential, raced = consulted.partition()
+	}
+
+	for _, l := range sequential {
+		served, err := t.attempt(resp, req, l, expected, verify)
+		if served {
+			return
+		}
+
+		// trusted sources are authoritative, their failures aren't retried by the fallback.
+		if l.Trusted && err != nil {
+			fail(resp, err)
+			return
+		}
+	}
+
+	if len(raced) > 0 {
+		served, err := t.race(resp, req, raced, expected, verify)
+		if served {
+			return
+		}
+
+		if err != nil {
+			fail(resp, err)
+			return
+		}
+	}
+
+	t.fallback(resp, req, peer)
+}
+
+// fallback serves the package when none of the sources provided it.
+func (t Download) fallback(resp http.ResponseWriter, req *http.Request, peer bool) {
+	if peer {
+		resp.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	resp.Header().Set(SourceHeader, "fallback")
+	t.Fallback.ServeHTTP(resp, req)
+}
+
+// attempt to serve the package from the source, returns false if the source didn't provide
+// a package that can be served and the reason the source failed.
+func (t Download) attempt(resp http.ResponseWriter, req *http.Request, l Link, expected pdex.Package, verify bool) (_ bool, err error) {
+	var (
+		pdata io.ReadCloser
+	)
+
+	ctx, done := context.WithCancel(req.Context())
+	defer done()
+
+	if pdata, err = t.acquire(ctx, done, req, l, expected, verify && !l.Trusted); err != nil {
+		return false, err
+	}
+	defer pdata.Close()
+
+	t.deliver(resp, req, l, pdata, expected, verify && !l.Trusted)
+
+	return true, nil
+}
+
+// acquire the package from the source, files are verified before they're returned. corrupt
+// sources are quarantined.
+func (t Download) acquire(ctx context.Context, cancel context.CancelFunc, req *http.Request, l Link, expected pdex.Package, verify bool) (pdata io.ReadCloser, err error) {
+	var (
 		params = mux.Vars(req)
 		pname  = params["package"]
-		rname  = params["repo"]
 	)
 
-	log.Println("torrent download", params)
-	if pdata, err = t.Downloader.Package(rname, pname); err != nil {
-		t.Fallback.ServeHTTP(resp, req)
+	if pdata, err = retrieve(ctx, cancel, l, params["repo"], params["arch"], pname); err != nil {
+		log.Println(errors.Wrapf(err, "%s unable to provide %s", l.Name, pname))
+		return nil, err
+	}
+
+	f, seekable := pdata.(file)
+	if !seekable && (req.Method == http.MethodHead || req.Header.Get("Range") != "") {
+		pdata.Close()
+		return nil, errors.Errorf("%s streams %s, it can't answer head or range requests", l.Name, pname)
+	}
+
+	source := sourceof(pdata)
+	if verify && t.Integrity.Quarantined(source) {
+		log.Println("skipping quarantined source", source, pname)
+		pdata.Close()
+		return nil, errors.Errorf("%s is quarantined", source)
+	}
+
+	if verify && seekable {
+		if err = t.Integrity.file(f, expected); err != nil {
+			t.corrupt(source, err)
+			pdata.Close()
+			return nil, err
+		}
+	}
+
+	return pdata, nil
+}
+
+// deliver the package to the client, streams are verified as they're served.
+func (t Download) deliver(resp http.ResponseWriter, req *http.Request, l Link, pdata io.Reader, expected pdex.Package, verify bool) {
+	pname := mux.Vars(req)["package"]
+	log.Println("serving", pname, "from", l.Name)
+	resp.Header().Set(SourceHeader, l.Name)
+
+	// the package couldn't be resolved from the sync database.
+	if t.Integrity != nil && !verify && !l.Trusted && pkg(pname) {
+		resp.Header().Set(UnverifiedHeader, "true")
+		t.Integrity.unverified()
+	}
+
+	if f, ok := pdata.(file); ok {
+		t.serve(resp, req, f)
 		return
 	}
 
+	if !verify {
+		t.stream(resp, req, pdata, expected)
+		return
+	}
+
+	// the response has started, a corrupt package aborts the request.
+	if err := t.Integrity.stream(req.Context(), t.Bandwidth, resp, pdata, expected); err != nil {
+		t.corrupt(sourceof(pdata), err)
+	}
+}
+
+// retrieve the package from the link's source, the timeout only bounds retrieving
+// the package, not serving it.
+func retrieve(ctx context.Context, cancel context.CancelFunc, l Link, repo, arch, name string) (pdata io.ReadCloser, err error) {
+	if l.Timeout <= 0 {
+		return l.Source.Package(ctx, repo, arch, name)
+	}
+
+	deadline := time.AfterFunc(l.Timeout, cancel)
+	pdata, err = l.Source.Package(ctx, repo, arch, name)
+	if deadline.Stop() || err != nil {
+		return pdata, err
+	}
+
+	pdata.Close()
+	return nil, errors.Errorf("timed out after %s", l.Timeout)
+}
+
+// stream the package to the client.
+func (t Download) stream(resp http.ResponseWriter, req *http.Request, pdata io.Reader, expected pdex.Package) {
+	if expected.Size >= 0 {
+		resp.Header().Set("Content-Length", strconv.FormatInt(expected.Size, 10))
+	} else if t.Index != nil {
+		if r, err := t.Index.Get(mux.Vars(req)["package"]); err == nil {
+			resp.Header().Set("Content-Length", strconv.FormatInt(r.Size, 10))
+			if !r.Modified.IsZero() {
+				resp.Header().Set("Last-Modified", r.Modified.Format(http.TimeFormat))
+			}
+		}
+	}
+
 	resp.WriteHeader(http.StatusOK)
 
-	if n, err := io.Copy(resp, pdata); err != nil {
+	if n, err := limited(req.Context(), t.Bandwidth, resp, pdata); err != nil && !disconnected(err) {
 		log.Println("proxy failed", n, err)
-		log.Printf("%T\n", err)
 	}
 }
+
+// corrupt quarantines the source if it provided a package that doesn't match the sync database.
+func (t Download) corrupt(source string, err error) {
+	var (
+		cause mismatch
+	)
+
+	if !errors.As(err, &cause) {
+		if !disconnected(err) {
+			log.Println(errors.Wrapf(err, "unable to serve package from %s", source))
+		}
+		return
+	}
+
+	log.Println(errors.Wrapf(err, "quarantining %s", source))
+	t.Integrity.Quarantine(source)
+}
+
+// serve the file answering range, conditional and head requests, allowing pacman to resume
+// interrupted downloads.
+func (t Download) serve(resp http.ResponseWriter, req *http.Request, f file) {
+	var (
+		content io.ReadSeeker = f
+	)
+
+	fi, err := f.Stat()
+	if err != nil {
+		log.Println(errors.Wrap(err, "failed to stat package"))
+		resp.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if t.Bandwidth != nil && t.Bandwidth.Limit() != rate.Inf {
+		content = throttledseeker{
+			throttled: throttled{ctx: req.Context(), l: t.Bandwidth, r: f},
+			Seeker:    f,
+		}
+	}
+
+	http.ServeContent(resp, req, fi.Name(), fi.ModTime(), content)
+}
+
+type throttledseeker struct {
+	throttled
+	io.Seeker
+}
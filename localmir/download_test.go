@@ -0,0 +1,296 @@
+package localmir_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/james-lawrence/pacmir/internal/testingx"
+	. "github.com/james-lawrence/pacmir/localmir"
+	"github.com/james-lawrence/pacmir/pdex"
+	"github.com/justinas/alice"
+
+	"github.com/stretchr/testify/require"
+)
+
+// dirpackages serves the packages within the directory.
+type dirpackages string
+
+func (t dirpackages) Package(ctx context.Context, repo, arch, name string) (io.ReadCloser, error) {
+	return os.Open(filepath.Join(string(t), name))
+}
+
+// streampackages serves the contents without a backing file.
+type streampackages []byte
+
+func (t streampackages) Package(ctx context.Context, repo, arch, name string) (io.ReadCloser, error) {
+	return stream{ReadCloser: ioutil.NopCloser(bytes.NewReader(t))}, nil
+}
+
+type stream struct {
+	io.ReadCloser
+}
+
+func (t stream) Origin() string {
+	return "stream"
+}
+
+// checksums expects the contents for every package.
+type checksums []byte
+
+func (t checksums) Expected(repo, arch, name string) (pdex.Package, error) {
+	sum := sha256.Sum256(t)
+	return pdex.Package{Filename: name, Size: int64(len(t)), SHA256: sum[:]}, nil
+}
+
+// unresolved never resolves the package, i.e.) the sync database is missing.
+type unresolved struct{}
+
+func (unresolved) Expected(repo, arch, name string) (pdex.Package, error) {
+	return pdex.Package{}, errors.New("missing sync database")
+}
+
+func TestDownload(t *testing.T) {
+	g := testingx.Init(t)
+
+	const pkgname = "example-1.0-1-x86_64.pkg.tar.zst"
+
+	serve := func(contents []byte, modified time.Time) (local *httptest.Server, done func()) {
+		dir, err := ioutil.TempDir("", "pacmir.download.*")
+		require.Nil(t, err)
+
+		require.Nil(t, ioutil.WriteFile(filepath.Join(dir, pkgname), contents, 0600))
+		require.Nil(t, os.Chtimes(filepath.Join(dir, pkgname), modified, modified))
+
+		router := mux.NewRouter()
+		Download{
+			Sources:   Chain{{Name: "local", Source: dirpackages(dir), Local: true}},
+			Fallback:  http.NotFoundHandler(),
+			Bandwidth: NewLimiter(1024 * 1024),
+		}.Bind(alice.New(), router.PathPrefix("/{repo}/os/{arch}").Subrouter())
+		local = httptest.NewServer(router)
+
+		return local, func() {
+			local.Close()
+			os.RemoveAll(dir)
+		}
+	}
+
+	get := func(url string, header http.Header) (*http.Response, string) {
+		req, err := http.NewRequest(http.MethodGet, url, nil)
+		require.Nil(t, err)
+		for k, v := range header {
+			req.Header[k] = v
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		require.Nil(t, err)
+		defer resp.Body.Close()
+
+		body, err := ioutil.ReadAll(resp.Body)
+		require.Nil(t, err)
+
+		return resp, string(body)
+	}
+
+	g.Describe("ranges", func() {
+		modified := time.Now().Add(-time.Hour).UTC().Truncate(time.Second)
+
+		g.It("should serve the entire package", func() {
+			local, done := serve([]byte("package contents"), modified)
+			defer done()
+
+			resp, body := get(local.URL+"/core/os/x86_64/"+pkgname, nil)
+			require.Equal(t, http.StatusOK, resp.StatusCode)
+			require.Equal(t, "package contents", body)
+			require.Equal(t, "bytes", resp.Header.Get("Accept-Ranges"))
+			require.Equal(t, "16", resp.Header.Get("Content-Length"))
+			require.Equal(t, modified.Format(http.TimeFormat), resp.Header.Get("Last-Modified"))
+		})
+
+		g.It("should resume partial downloads", func() {
+			local, done := serve([]byte("package contents"), modified)
+			defer done()
+
+			resp, body := get(local.URL+"/core/os/x86_64/"+pkgname, http.Header{"Range": []string{"bytes=8-"}})
+			require.Equal(t, http.StatusPartialContent, resp.StatusCode)
+			require.Equal(t, "contents", body)
+			require.Equal(t, "bytes 8-15/16", resp.Header.Get("Content-Range"))
+			require.Equal(t, "8", resp.Header.Get("Content-Length"))
+		})
+
+		g.It("should serve the entire package when it was modified", func() {
+			local, done := serve([]byte("package contents"), modified)
+			defer done()
+
+			resp, body := get(local.URL+"/core/os/x86_64/"+pkgname, http.Header{
+				"Range":    []string{"bytes=8-"},
+				"If-Range": []string{modified.Add(-time.Hour).Format(http.TimeFormat)},
+			})
+			require.Equal(t, http.StatusOK, resp.StatusCode)
+			require.Equal(t, "package contents", body)
+		})
+
+		g.It("should describe the package without the body", func() {
+			local, done := serve([]byte("package contents"), modified)
+			defer done()
+
+			resp, err := http.Head(local.URL + "/core/os/x86_64/" + pkgname)
+			require.Nil(t, err)
+			defer resp.Body.Close()
+			body, err := ioutil.ReadAll(resp.Body)
+			require.Nil(t, err)
+
+			require.Equal(t, http.StatusOK, resp.StatusCode)
+			require.Equal(t, "", string(body))
+			require.Equal(t, int64(16), resp.ContentLength)
+			require.Equal(t, "application/octet-stream", resp.Header.Get("Content-Type"))
+			require.Equal(t, modified.Format(http.TimeFormat), resp.Header.Get("Last-Modified"))
+		})
+
+		g.It("should reject unsatisfiable ranges", func() {
+			local, done := serve([]byte("package contents"), modified)
+			defer done()
+
+			resp, _ := get(local.URL+"/core/os/x86_64/"+pkgname, http.Header{"Range": []string{"bytes=100-"}})
+			require.Equal(t, http.StatusRequestedRangeNotSatisfiable, resp.StatusCode)
+		})
+	})
+
+	g.Describe("integrity", func() {
+		fallback := http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+			resp.Write([]byte("fallback contents"))
+		})
+
+		verified := func(pkgs Source, integrity *Integrity) *httptest.Server {
+			router := mux.NewRouter()
+			Download{
+				Sources:   Chain{{Name: "local", Source: pkgs}},
+				Fallback:  fallback,
+				Bandwidth: NewLimiter(1024 * 1024),
+				Integrity: integrity,
+			}.Bind(alice.New(), router.PathPrefix("/{repo}/os/{arch}").Subrouter())
+			return httptest.NewServer(router)
+		}
+
+		files := func(contents []byte) (string, func()) {
+			dir, err := ioutil.TempDir("", "pacmir.download.*")
+			require.Nil(t, err)
+			require.Nil(t, ioutil.WriteFile(filepath.Join(dir, pkgname), contents, 0600))
+			return dir, func() { os.RemoveAll(dir) }
+		}
+
+		g.It("should serve packages matching the sync database", func() {
+			dir, cleanup := files([]byte("package contents"))
+			defer cleanup()
+
+			local := verified(dirpackages(dir), NewIntegrity(checksums("package contents"), time.Hour))
+			defer local.Close()
+
+			resp, body := get(local.URL+"/core/os/x86_64/"+pkgname, nil)
+			require.Equal(t, http.StatusOK, resp.StatusCode)
+			require.Equal(t, "package contents", body)
+		})
+
+		g.It("should quarantine files that don't match the sync database", func() {
+			dir, cleanup := files([]byte("corrupt contents"))
+			defer cleanup()
+
+			integrity := NewIntegrity(checksums("package contents"), time.Hour)
+			local := verified(dirpackages(dir), integrity)
+			defer local.Close()
+
+			_, body := get(local.URL+"/core/os/x86_64/"+pkgname, nil)
+			require.Equal(t, "fallback contents", body)
+			require.True(t, integrity.Quarantined(filepath.Join(dir, pkgname)))
+
+			// quarantined sources are skipped even once repaired.
+			require.Nil(t, ioutil.WriteFile(filepath.Join(dir, pkgname), []byte("package contents"), 0600))
+			_, body = get(local.URL+"/core/os/x86_64/"+pkgname, nil)
+			require.Equal(t, "fallback contents", body)
+		})
+
+		g.It("should fallback when the size doesn't match the sync database", func() {
+			dir, cleanup := files([]byte("package"))
+			defer cleanup()
+
+			local := verified(dirpackages(dir), NewIntegrity(checksums("package contents"), time.Hour))
+			defer local.Close()
+
+			_, body := get(local.URL+"/core/os/x86_64/"+pkgname, nil)
+			require.Equal(t, "fallback contents", body)
+		})
+
+		g.It("should stream packages matching the sync database", func() {
+			integrity := NewIntegrity(checksums("package contents"), time.Hour)
+			local := verified(streampackages("package contents"), integrity)
+			defer local.Close()
+
+			resp, body := get(local.URL+"/core/os/x86_64/"+pkgname, nil)
+			require.Equal(t, http.StatusOK, resp.StatusCode)
+			require.Equal(t, "package contents", body)
+			require.False(t, integrity.Quarantined("stream"))
+		})
+
+		g.It("should serve local packages unverified when the sync database is missing", func() {
+			dir, cleanup := files([]byte("package contents"))
+			defer cleanup()
+
+			integrity := NewIntegrity(unresolved{}, time.Hour)
+			router := mux.NewRouter()
+			Download{
+				Sources: Chain{
+					{Name: "peers", Source: streampackages("peer contents")},
+					{Name: "local", Source: dirpackages(dir), Local: true},
+				},
+				Fallback:  fallback,
+				Bandwidth: NewLimiter(1024 * 1024),
+				Integrity: integrity,
+			}.Bind(alice.New(), router.PathPrefix("/{repo}/os/{arch}").Subrouter())
+			local := httptest.NewServer(router)
+			defer local.Close()
+
+			resp, body := get(local.URL+"/core/os/x86_64/"+pkgname, nil)
+			require.Equal(t, http.StatusOK, resp.StatusCode)
+			require.Equal(t, "package contents", body)
+			require.Equal(t, "local", resp.Header.Get(SourceHeader))
+			require.Equal(t, "true", resp.Header.Get(UnverifiedHeader))
+			require.Equal(t, uint64(1), integrity.Unverified())
+
+			// untrusted remote sources are never used without verification.
+			require.Nil(t, os.Remove(filepath.Join(dir, pkgname)))
+			resp, body = get(local.URL+"/core/os/x86_64/"+pkgname, nil)
+			require.Equal(t, "fallback contents", body)
+			require.Equal(t, "", resp.Header.Get(UnverifiedHeader))
+			require.Equal(t, uint64(1), integrity.Unverified())
+		})
+
+		g.It("should abort streams that don't match the sync database", func() {
+			integrity := NewIntegrity(checksums("package contents"), time.Hour)
+			local := verified(streampackages("corrupt contents"), integrity)
+			defer local.Close()
+
+			resp, err := http.Get(local.URL + "/core/os/x86_64/" + pkgname)
+			require.Nil(t, err)
+			defer resp.Body.Close()
+
+			body, err := ioutil.ReadAll(resp.Body)
+			require.Equal(t, io.ErrUnexpectedEOF, err)
+			require.Equal(t, "corrupt content", string(body))
+			require.True(t, integrity.Quarantined("stream"))
+
+			_, fallback := get(local.URL+"/core/os/x86_64/"+pkgname, nil)
+			require.Equal(t, "fallback contents", fallback)
+		})
+	})
+}
@@ -0,0 +1,164 @@
+package localmir
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// default Retry-After for transient failures when no circuit reports when it will close.
+const retryafter = 30 * time.Second
+
+// statuserror an upstream answered with an unexpected status.
+type statuserror struct {
+	status  int
+	message string
+}
+
+func (t statuserror) Error() string {
+	if t.message == "" {
+		return fmt.Sprintf("%d %s", t.status, http.StatusText(t.status))
+	}
+
+	return fmt.Sprintf("%d %s: %s", t.status, http.StatusText(t.status), t.message)
+}
+
+// unexpected reads the start of the response body, preserving the upstream's explanation.
+func unexpected(resp *http.Response) statuserror {
+	raw, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 256))
+	return statuserror{
+		status:  resp.StatusCode,
+		message: strings.Join(strings.Fields(string(raw)), " "),
+	}
+}
+
+// openerror the upstream's circuit is open.
+type openerror struct {
+	retry time.Duration
+}
+
+func (t openerror) Error() string {
+	return fmt.Sprintf("circuit open, retrying in %s", t.retry.Round(time.Second))
+}
+
+// attempt to retrieve a file from an upstream.
+type attempt struct {
+	upstream string
+	err      error
+}
+
+func (t attempt) status() int {
+	var cause statuserror
+	if errors.As(t.err, &cause) {
+		return cause.status
+	}
+
+	return 0
+}
+
+func (t attempt) timeout() bool {
+	var cause net.Error
+	return errors.Is(t.err, context.DeadlineExceeded) || (errors.As(t.err, &cause) && cause.Timeout())
+}
+
+// transient failures are expected to resolve themselves.
+func (t attempt) transient() bool {
+	var open openerror
+	return t.timeout() || t.status() >= http.StatusInternalServerError || t.status() == 0 || errors.As(t.err, &open)
+}
+
+// failure every upstream failed to provide a file.
+type failure struct {
+	name     string
+	attempts []attempt
+}
+
+func (t failure) Error() string {
+	lines := make([]string, 0, len(t.attempts)+1)
+	lines = append(lines, fmt.Sprintf("unable to retrieve %s from any upstream mirror", t.name))
+	for _, a := range t.attempts {
+		lines = append(lines, a.upstream+": "+a.err.Error())
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// Status code describing the failure to the client. missing files are 404,
+// timeouts are 504 and everything else is a 502.
+func (t failure) Status() int {
+	missing, timeouts := 0, 0
+	for _, a := range t.attempts {
+		if a.status() == http.StatusNotFound {
+			missing++
+		}
+
+		if a.timeout() {
+			timeouts++
+		}
+	}
+
+	switch n := len(t.attempts); {
+	case n > 0 && missing == n:
+		return http.StatusNotFound
+	case n > 0 && timeouts == n:
+		return http.StatusGatewayTimeout
+	default:
+		return http.StatusBadGateway
+	}
+}
+
+// retry returns how long clients should wait before retrying, false if retrying won't help.
+func (t failure) retry() (time.Duration, bool) {
+	var (
+		retry     time.Duration
+		transient bool
+	)
+
+	for _, a := range t.attempts {
+		var open openerror
+		if errors.As(a.err, &open) && (retry == 0 || open.retry < retry) {
+			retry = open.retry
+		}
+
+		transient = transient || a.transient()
+	}
+
+	if !transient {
+		return 0, false
+	}
+
+	if retry == 0 {
+		retry = retryafter
+	}
+
+	return retry, true
+}
+
+// fail writes the error to the client. aggregated failures list every attempted upstream.
+func fail(resp http.ResponseWriter, err error) {
+	var (
+		cause failure
+	)
+
+	if !errors.As(err, &cause) {
+		resp.WriteHeader(http.StatusBadGateway)
+		return
+	}
+
+	resp.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if retry, ok := cause.retry(); ok && cause.Status() != http.StatusNotFound {
+		// round up, clients retrying early would observe the same failure.
+		resp.Header().Set("Retry-After", strconv.Itoa(int((retry+time.Second-1)/time.Second)))
+	}
+
+	resp.WriteHeader(cause.Status())
+	io.WriteString(resp, cause.Error()+"\n")
+}
@@ -0,0 +1,142 @@
+package localmir
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/james-lawrence/pacmir/pdex"
+	"github.com/pkg/errors"
+)
+
+// contender a link racing to provide the package.
+type contender struct {
+	i     int
+	l     Link
+	pdata io.ReadCloser
+	err   error
+}
+
+// race the links to provide the package. the first link starts immediately, the remaining
+// links join once the hedge delay elapses or every started link failed. the first link to
+// deliver a verified file or the first bytes of a stream wins, the others are cancelled.
+// returns false if no link provided the package and the failure of the trusted links.
+func (t Download) race(resp http.ResponseWriter, req *http.Request, links Chain, expected pdex.Package, verify bool) (_ bool, failed error) {
+	var (
+		pending   int
+		cancels   []context.CancelFunc
+		remaining = links[1:]
+		results   = make(chan contender, len(links))
+		hedge     = time.NewTimer(t.Hedge)
+	)
+	defer hedge.Stop()
+
+	start := func(started Chain) {
+		for _, l := range started {
+			ctx, done := context.WithCancel(req.Context())
+			cancels = append(cancels, done)
+			pending++
+
+			go func(i int, l Link) {
+				pdata, err := t.contend(ctx, done, req, l, expected, verify && !l.Trusted)
+				results <- contender{i: i, l: l, pdata: pdata, err: err}
+			}(len(cancels)-1, l)
+		}
+	}
+
+	start(links[:1])
+
+	for pending > 0 {
+		var hedged <-chan time.Time
+		if len(remaining) > 0 {
+			hedged = hedge.C
+		}
+
+		select {
+		case <-hedged:
+			start(remaining)
+			remaining = nil
+		case c := <-results:
+			pending--
+
+			if c.err != nil {
+				cancels[c.i]()
+				if c.l.Trusted {
+					failed = c.err
+				}
+
+				// nothing is in flight, the remaining links don't wait for the hedge.
+				if pending == 0 {
+					start(remaining)
+					remaining = nil
+				}
+				continue
+			}
+
+			for i, done := range cancels {
+				if i != c.i {
+					done()
+				}
+			}
+			go discard(results, pending, cancels)
+
+			defer cancels[c.i]()
+			defer c.pdata.Close()
+			t.deliver(resp, req, c.l, c.pdata, expected, verify && !c.l.Trusted)
+
+			return true, nil
+		}
+	}
+
+	return false, failed
+}
+
+// contend acquires the package from the link, streams contend until their first bytes arrive.
+func (t Download) contend(ctx context.Context, cancel context.CancelFunc, req *http.Request, l Link, expected pdex.Package, verify bool) (pdata io.ReadCloser, err error) {
+	var (
+		n   int
+		buf = make([]byte, 32*1024)
+	)
+
+	if pdata, err = t.acquire(ctx, cancel, req, l, expected, verify); err != nil {
+		return nil, err
+	}
+
+	if _, ok := pdata.(file); ok {
+		return pdata, nil
+	}
+
+	if n, err = io.ReadAtLeast(pdata, buf, 1); err != nil {
+		pdata.Close()
+		return nil, errors.Wrapf(err, "%s failed to stream %s", l.Name, expected.Filename)
+	}
+
+	return peeked{ReadCloser: pdata, r: io.MultiReader(bytes.NewReader(buf[:n]), pdata)}, nil
+}
+
+// discard the packages of the links that lost the race.
+func discard(results chan contender, pending int, cancels []context.CancelFunc) {
+	for ; pending > 0; pending-- {
+		c := <-results
+		if c.pdata != nil {
+			c.pdata.Close()
+		}
+		cancels[c.i]()
+	}
+}
+
+// peeked a stream whose first bytes were already read.
+type peeked struct {
+	io.ReadCloser
+	r io.Reader
+}
+
+func (t peeked) Read(b []byte) (int, error) {
+	return t.r.Read(b)
+}
+
+func (t peeked) Origin() string {
+	return sourceof(t.ReadCloser)
+}
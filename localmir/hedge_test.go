@@ -0,0 +1,277 @@
+package localmir_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/james-lawrence/pacmir"
+	"github.com/james-lawrence/pacmir/internal/testingx"
+	. "github.com/james-lawrence/pacmir/localmir"
+	"github.com/justinas/alice"
+
+	"github.com/stretchr/testify/require"
+)
+
+// delayed provides the contents after the delay unless the retrieval is cancelled first.
+type delayed struct {
+	contents  string
+	delay     time.Duration
+	consulted *int64
+	cancelled chan struct{}
+}
+
+func (t delayed) Package(ctx context.Context, repo, arch, name string) (io.ReadCloser, error) {
+	atomic.AddInt64(t.consulted, 1)
+
+	select {
+	case <-time.After(t.delay):
+		return ioutil.NopCloser(strings.NewReader(t.contents)), nil
+	case <-ctx.Done():
+		close(t.cancelled)
+		return nil, ctx.Err()
+	}
+}
+
+func newdelayed(contents string, delay time.Duration) delayed {
+	return delayed{contents: contents, delay: delay, consulted: new(int64), cancelled: make(chan struct{})}
+}
+
+// stalled provides a stream that never delivers any bytes until the retrieval is cancelled.
+type stalled struct{}
+
+func (stalled) Package(ctx context.Context, repo, arch, name string) (io.ReadCloser, error) {
+	return ioutil.NopCloser(stalledreader{ctx: ctx}), nil
+}
+
+type stalledreader struct {
+	ctx context.Context
+}
+
+func (t stalledreader) Read(b []byte) (int, error) {
+	<-t.ctx.Done()
+	return 0, t.ctx.Err()
+}
+
+// failing never provides the package.
+type failing struct{}
+
+func (failing) Package(ctx context.Context, repo, arch, name string) (io.ReadCloser, error) {
+	return nil, errors.New("upstream failed")
+}
+
+func TestHedge(t *testing.T) {
+	g := testingx.Init(t)
+
+	const pkgname = "example-1.0-1-x86_64.pkg.tar.zst"
+
+	fallback := http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		resp.Write([]byte("fallback contents"))
+	})
+
+	serve := func(d Download) *httptest.Server {
+		router := mux.NewRouter()
+		d.Bind(alice.New(), router.PathPrefix("/{repo}/os/{arch}").Subrouter())
+		return httptest.NewServer(router)
+	}
+
+	get := func(url string) (*http.Response, string) {
+		resp, err := http.Get(url)
+		require.Nil(t, err)
+		defer resp.Body.Close()
+
+		body, err := ioutil.ReadAll(resp.Body)
+		require.Nil(t, err)
+
+		return resp, string(body)
+	}
+
+	g.Describe("race", func() {
+		g.It("should serve the local sources without consulting the remote sources", func() {
+			dir, err := ioutil.TempDir("", "pacmir.hedge.*")
+			require.Nil(t, err)
+			defer os.RemoveAll(dir)
+			require.Nil(t, ioutil.WriteFile(filepath.Join(dir, pkgname), []byte("local contents"), 0600))
+
+			mirror := newdelayed("mirror contents", 0)
+			local := serve(Download{
+				Sources: Chain{
+					{Name: "mirror", Source: mirror, Trusted: true},
+					{Name: "local", Source: dirpackages(dir), Local: true},
+				},
+				Hedge:    time.Millisecond,
+				Fallback: fallback,
+			})
+			defer local.Close()
+
+			resp, body := get(local.URL + "/core/os/x86_64/" + pkgname)
+			require.Equal(t, "local contents", body)
+			require.Equal(t, "local", resp.Header.Get(SourceHeader))
+			require.Zero(t, atomic.LoadInt64(mirror.consulted))
+		})
+
+		g.It("should only consult the first remote source when it answers within the hedge delay", func() {
+			peers := newdelayed("peer contents", 0)
+			mirror := newdelayed("mirror contents", 0)
+			local := serve(Download{
+				Sources: Chain{
+					{Name: "peers", Source: peers},
+					{Name: "mirror", Source: mirror, Trusted: true},
+				},
+				Hedge:    time.Second,
+				Fallback: fallback,
+			})
+			defer local.Close()
+
+			resp, body := get(local.URL + "/core/os/x86_64/" + pkgname)
+			require.Equal(t, "peer contents", body)
+			require.Equal(t, "peers", resp.Header.Get(SourceHeader))
+			require.Zero(t, atomic.LoadInt64(mirror.consulted))
+		})
+
+		g.It("should serve the fastest source and cancel the others", func() {
+			swarm := newdelayed("swarm contents", 30*time.Second)
+			local := serve(Download{
+				Sources: Chain{
+					{Name: "swarm", Source: swarm},
+					{Name: "mirror", Source: newdelayed("mirror contents", 0), Trusted: true},
+				},
+				Hedge:    50 * time.Millisecond,
+				Fallback: fallback,
+			})
+			defer local.Close()
+
+			started := time.Now()
+			resp, body := get(local.URL + "/core/os/x86_64/" + pkgname)
+			require.Equal(t, "mirror contents", body)
+			require.Equal(t, "mirror", resp.Header.Get(SourceHeader))
+			require.True(t, time.Since(started) < time.Second)
+
+			select {
+			case <-swarm.cancelled:
+			case <-time.After(time.Second):
+				require.FailNow(t, "the losing source wasn't cancelled")
+			}
+		})
+
+		g.It("should not wait for the hedge delay once the started sources failed", func() {
+			local := serve(Download{
+				Sources: Chain{
+					{Name: "peers", Source: failing{}},
+					{Name: "mirror", Source: newdelayed("mirror contents", 0), Trusted: true},
+				},
+				Hedge:    30 * time.Second,
+				Fallback: fallback,
+			})
+			defer local.Close()
+
+			_, body := get(local.URL + "/core/os/x86_64/" + pkgname)
+			require.Equal(t, "mirror contents", body)
+		})
+
+		g.It("should prefer streams delivering bytes over stalled streams", func() {
+			local := serve(Download{
+				Sources: Chain{
+					{Name: "peers", Source: stalled{}},
+					{Name: "mirror", Source: newdelayed("mirror contents", 0), Trusted: true},
+				},
+				Hedge:    50 * time.Millisecond,
+				Fallback: fallback,
+			})
+			defer local.Close()
+
+			resp, body := get(local.URL + "/core/os/x86_64/" + pkgname)
+			require.Equal(t, "mirror contents", body)
+			require.Equal(t, "mirror", resp.Header.Get(SourceHeader))
+		})
+
+		g.It("should cancel the upstream transfer of a losing mirror", func() {
+			cancelled := make(chan struct{})
+			upstream := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+				resp.WriteHeader(http.StatusOK)
+				resp.(http.Flusher).Flush()
+				<-req.Context().Done()
+				close(cancelled)
+			}))
+			defer upstream.Close()
+
+			dir, err := ioutil.TempDir("", "pacmir.hedge.*")
+			require.Nil(t, err)
+			defer os.RemoveAll(dir)
+
+			conf := fmt.Sprintf("[options]\nArchitecture = x86_64\n\n[core]\nServer = %s/$repo/os/$arch\n", upstream.URL)
+			require.Nil(t, ioutil.WriteFile(filepath.Join(dir, "pacman.conf"), []byte(conf), 0600))
+			cconfig := pacmir.NewCachedConfig(filepath.Join(dir, "pacman.conf"))
+			defer cconfig.Close()
+
+			mirror := Proxied{
+				HTTPAddress: "localhost:4000",
+				Pacman:      cconfig,
+				Packages:    NewPackageCache(filepath.Join(dir, "packages"), nil, nil),
+			}
+
+			local := serve(Download{
+				Sources: Chain{
+					{Name: "mirror", Source: mirror, Trusted: true},
+					{Name: "peers", Source: newdelayed("peer contents", 0)},
+				},
+				Hedge:    50 * time.Millisecond,
+				Fallback: fallback,
+			})
+			defer local.Close()
+
+			resp, body := get(local.URL + "/core/os/x86_64/" + pkgname)
+			require.Equal(t, "peer contents", body)
+			require.Equal(t, "peers", resp.Header.Get(SourceHeader))
+
+			select {
+			case <-cancelled:
+			case <-time.After(time.Second):
+				require.FailNow(t, "the losing upstream transfer wasn't cancelled")
+			}
+		})
+
+		g.It("should report the failure of trusted sources when every source failed", func() {
+			local := serve(Download{
+				Sources: Chain{
+					{Name: "peers", Source: failing{}},
+					{Name: "mirror", Source: failing{}, Trusted: true},
+				},
+				Hedge:    50 * time.Millisecond,
+				Fallback: fallback,
+			})
+			defer local.Close()
+
+			resp, body := get(local.URL + "/core/os/x86_64/" + pkgname)
+			require.Equal(t, http.StatusBadGateway, resp.StatusCode)
+			require.NotEqual(t, "fallback contents", body)
+		})
+
+		g.It("should fallback when the untrusted sources failed", func() {
+			local := serve(Download{
+				Sources: Chain{
+					{Name: "peers", Source: failing{}},
+					{Name: "swarm", Source: failing{}},
+				},
+				Hedge:    50 * time.Millisecond,
+				Fallback: fallback,
+			})
+			defer local.Close()
+
+			resp, body := get(local.URL + "/core/os/x86_64/" + pkgname)
+			require.Equal(t, "fallback contents", body)
+			require.Equal(t, "fallback", resp.Header.Get(SourceHeader))
+		})
+	})
+}
@@ -0,0 +1,227 @@
+package localmir
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/james-lawrence/pacmir/pdex"
+	"github.com/pkg/errors"
+	"golang.org/x/time/rate"
+)
+
+// checksums resolves the expected size and checksum of packages from the sync database.
+type checksums interface {
+	Expected(repo, arch, name string) (pdex.Package, error)
+}
+
+// origin identifies where a package's bytes came from, used to quarantine bad sources.
+type origin interface {
+	Origin() string
+}
+
+// mismatch the package doesn't match the sync database.
+type mismatch struct {
+	reason string
+}
+
+func (t mismatch) Error() string {
+	return t.reason
+}
+
+func mismatched(format string, args ...interface{}) error {
+	return errors.WithStack(mismatch{reason: fmt.Sprintf(format, args...)})
+}
+
+// NewIntegrity verifies packages against the sync database, sources providing
+// packages that don't match are quarantined for the duration.
+func NewIntegrity(sums checksums, quarantine time.Duration) *Integrity {
+	return &Integrity{
+		sums:        sums,
+		duration:    quarantine,
+		m:           &sync.Mutex{},
+		quarantined: map[string]time.Time{},
+		verified:    map[string]fingerprint{},
+	}
+}
+
+// Integrity ensures packages served from sources other than the mirrors match the sync database.
+type Integrity struct {
+	// packages served without verification, first for 64 bit alignment.
+	bypassed    uint64
+	sums        checksums
+	duration    time.Duration
+	m           *sync.Mutex
+	quarantined map[string]time.Time
+	// verified files, files are only rehashed when modified.
+	verified map[string]fingerprint
+}
+
+type fingerprint struct {
+	size     int64
+	modified time.Time
+}
+
+// Expected size and checksum of the package.
+func (t *Integrity) Expected(repo, arch, name string) (pdex.Package, error) {
+	return t.sums.Expected(repo, arch, name)
+}
+
+// Unverified returns the number of packages served without verification because the
+// sync database couldn't resolve them.
+func (t *Integrity) Unverified() uint64 {
+	return atomic.LoadUint64(&t.bypassed)
+}
+
+func (t *Integrity) unverified() {
+	atomic.AddUint64(&t.bypassed, 1)
+}
+
+// Quarantine the source, it isn't used until the quarantine elapses.
+func (t *Integrity) Quarantine(source string) {
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	t.quarantined[source] = time.Now().Add(t.duration)
+}
+
+// Quarantined returns true if the source is quarantined.
+func (t *Integrity) Quarantined(source string) bool {
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	until, ok := t.quarantined[source]
+	if ok && time.Now().After(until) {
+		delete(t.quarantined, source)
+		return false
+	}
+
+	return ok
+}
+
+// file verifies the file against the package before any of it is served.
+func (t *Integrity) file(f file, expected pdex.Package) (err error) {
+	var (
+		fi os.FileInfo
+	)
+
+	if fi, err = f.Stat(); err != nil {
+		return errors.WithStack(err)
+	}
+
+	if fi.Size() != expected.Size {
+		return mismatched("%s size mismatch: expected %d, found %d", expected.Filename, expected.Size, fi.Size())
+	}
+
+	id := fingerprint{size: fi.Size(), modified: fi.ModTime()}
+	source := sourceof(f)
+
+	t.m.Lock()
+	ok := t.verified[source] == id
+	t.m.Unlock()
+
+	if ok {
+		return nil
+	}
+
+	if err = verify(io.LimitReader(f, expected.Size+1), expected); err != nil {
+		return err
+	}
+
+	if _, err = f.Seek(0, io.SeekStart); err != nil {
+		return errors.WithStack(err)
+	}
+
+	t.m.Lock()
+	t.verified[source] = id
+	t.m.Unlock()
+
+	return nil
+}
+
+// stream the package to the client verifying it as it's written. the final byte is
+// withheld until the package is verified, clients never receive a complete corrupt package.
+func (t *Integrity) stream(ctx context.Context, l *rate.Limiter, resp http.ResponseWriter, src io.Reader, expected pdex.Package) (err error) {
+	var (
+		n    int64
+		tail []byte
+		held = expected.Size
+	)
+
+	if held > 1 {
+		held = 1
+	}
+
+	digest := sha256.New()
+	r := io.TeeReader(src, digest)
+
+	resp.Header().Set("Content-Length", strconv.FormatInt(expected.Size, 10))
+	resp.WriteHeader(http.StatusOK)
+
+	if n, err = limited(ctx, l, resp, io.LimitReader(r, expected.Size-held)); err != nil {
+		return errors.WithStack(err)
+	}
+
+	if n != expected.Size-held {
+		return mismatched("%s size mismatch: expected %d, received %d", expected.Filename, expected.Size, n)
+	}
+
+	// read past the expected size to detect oversized packages.
+	if tail, err = ioutil.ReadAll(io.LimitReader(r, held+1)); err != nil {
+		return errors.WithStack(err)
+	}
+
+	if int64(len(tail)) != held {
+		return mismatched("%s size mismatch: expected %d, received %d", expected.Filename, expected.Size, n+int64(len(tail)))
+	}
+
+	if sum := digest.Sum(nil); !bytes.Equal(sum, expected.SHA256) {
+		return mismatched("%s sha256 mismatch: expected %x, received %x", expected.Filename, expected.SHA256, sum)
+	}
+
+	_, err = resp.Write(tail)
+	return errors.WithStack(err)
+}
+
+// verify the size and checksum of the contents.
+func verify(r io.Reader, expected pdex.Package) (err error) {
+	var (
+		n int64
+	)
+
+	digest := sha256.New()
+	if n, err = io.Copy(digest, r); err != nil {
+		return errors.WithStack(err)
+	}
+
+	if n != expected.Size {
+		return mismatched("%s size mismatch: expected %d, received %d", expected.Filename, expected.Size, n)
+	}
+
+	if sum := digest.Sum(nil); !bytes.Equal(sum, expected.SHA256) {
+		return mismatched("%s sha256 mismatch: expected %x, received %x", expected.Filename, expected.SHA256, sum)
+	}
+
+	return nil
+}
+
+// sourceof identifies where the package's bytes came from.
+func sourceof(pdata interface{}) string {
+	switch src := pdata.(type) {
+	case origin:
+		return src.Origin()
+	case interface{ Name() string }:
+		return src.Name()
+	default:
+		return fmt.Sprintf("%T", pdata)
+	}
+}
@@ -0,0 +1,266 @@
+package localmir
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	paconf "github.com/Morganamilo/go-pacmanconf"
+	"github.com/fsnotify/fsnotify"
+	"github.com/james-lawrence/pacmir"
+	"github.com/james-lawrence/pacmir/pdex"
+	"github.com/pkg/errors"
+)
+
+// Cached a package within one of the inventoried directories.
+type Cached struct {
+	pdex.Filename
+	Path     string
+	Size     int64
+	Modified time.Time
+}
+
+// NewInventory inventories the packages within pacman's cache directories followed by the
+// directories, earlier directories are preferred. the inventory is kept current as packages
+// are added and removed, and rescanned when pacman's cache directories change. pacman is optional.
+func NewInventory(pacman *pacmir.CachedConfig, dirs ...string) *Inventory {
+	t := &Inventory{
+		pacman:   pacman,
+		extra:    dirs,
+		m:        &sync.RWMutex{},
+		packages: map[string]Cached{},
+		done:     make(chan struct{}),
+	}
+
+	if err := t.watch(); err != nil {
+		log.Println(errors.Wrap(err, "unable to watch the package caches, changes will be ignored"))
+	}
+
+	return t
+}
+
+// Inventory of the cached packages, indexed by filename.
+type Inventory struct {
+	pacman   *pacmir.CachedConfig
+	extra    []string
+	m        *sync.RWMutex
+	dirs     []string
+	packages map[string]Cached
+	watcher  *fsnotify.Watcher
+	done     chan struct{}
+	closed   sync.Once
+}
+
+// Lookup the cached package by its filename.
+func (t *Inventory) Lookup(filename string) (Cached, bool) {
+	t.m.RLock()
+	defer t.m.RUnlock()
+
+	c, ok := t.packages[filename]
+	return c, ok
+}
+
+// Packages returns every cached package ordered by filename.
+func (t *Inventory) Packages() []Cached {
+	t.m.RLock()
+	cached := make([]Cached, 0, len(t.packages))
+	for _, c := range t.packages {
+		cached = append(cached, c)
+	}
+	t.m.RUnlock()
+
+	sort.Slice(cached, func(i, j int) bool {
+		return filepath.Base(cached[i].Path) < filepath.Base(cached[j].Path)
+	})
+
+	return cached
+}
+
+// Close stops watching the directories.
+func (t *Inventory) Close() (err error) {
+	t.closed.Do(func() {
+		close(t.done)
+		if t.watcher != nil {
+			err = t.watcher.Close()
+		}
+	})
+
+	return err
+}
+
+// directories inventoried in order of preference.
+func (t *Inventory) directories() (dirs []string) {
+	var (
+		candidates []string
+		seen       = map[string]bool{}
+	)
+
+	if t.pacman != nil {
+		if c := t.pacman.Current(); c != nil {
+			candidates = append(candidates, c.CacheDir...)
+		}
+	}
+
+	for _, d := range append(candidates, t.extra...) {
+		if d = filepath.Clean(d); !seen[d] {
+			seen[d] = true
+			dirs = append(dirs, d)
+		}
+	}
+
+	return dirs
+}
+
+// scan every directory, replacing the inventory.
+func (t *Inventory) scan() {
+	var (
+		dirs     = t.directories()
+		packages = map[string]Cached{}
+	)
+
+	for _, d := range dirs {
+		if t.watcher != nil {
+			if err := t.watcher.Add(d); err != nil {
+				log.Println(errors.Wrapf(err, "unable to watch %s", d))
+			}
+		}
+
+		entries, err := ioutil.ReadDir(d)
+		if err != nil {
+			log.Println(errors.Wrapf(err, "unable to inventory %s", d))
+			continue
+		}
+
+		for _, fi := range entries {
+			if _, ok := packages[fi.Name()]; ok {
+				continue
+			}
+
+			if c, ok := cached(d, fi); ok {
+				packages[fi.Name()] = c
+			}
+		}
+	}
+
+	t.m.Lock()
+	previous := t.dirs
+	t.dirs, t.packages = dirs, packages
+	t.m.Unlock()
+
+	if t.watcher == nil {
+		return
+	}
+
+	for _, d := range previous {
+		if !contains(dirs, d) {
+			t.watcher.Remove(d)
+		}
+	}
+}
+
+// refresh the package, it's inventoried from the preferred directory containing it.
+func (t *Inventory) refresh(filename string) {
+	t.m.RLock()
+	dirs := t.dirs
+	t.m.RUnlock()
+
+	for _, d := range dirs {
+		fi, err := os.Stat(filepath.Join(d, filename))
+		if err != nil {
+			continue
+		}
+
+		if c, ok := cached(d, fi); ok {
+			t.m.Lock()
+			t.packages[filename] = c
+			t.m.Unlock()
+			return
+		}
+	}
+
+	t.m.Lock()
+	delete(t.packages, filename)
+	t.m.Unlock()
+}
+
+func (t *Inventory) watch() (err error) {
+	if t.watcher, err = fsnotify.NewWatcher(); err != nil {
+		t.scan()
+		return errors.WithStack(err)
+	}
+
+	// the initial scan completes before any event is processed.
+	t.scan()
+
+	go t.background()
+
+	return nil
+}
+
+func (t *Inventory) background() {
+	var (
+		changes     <-chan *paconf.Config
+		unsubscribe = func() {}
+	)
+
+	if t.pacman != nil {
+		changes, unsubscribe = t.pacman.Subscribe()
+	}
+	defer unsubscribe()
+
+	for {
+		select {
+		case <-t.done:
+			return
+		case _, ok := <-changes:
+			if !ok {
+				changes = nil
+				continue
+			}
+
+			t.scan()
+		case evt, ok := <-t.watcher.Events:
+			if !ok {
+				return
+			}
+
+			if evt.Op == fsnotify.Chmod {
+				continue
+			}
+
+			if _, err := pdex.ParseFilename(filepath.Base(evt.Name)); err != nil {
+				continue
+			}
+
+			t.refresh(filepath.Base(evt.Name))
+		case err, ok := <-t.watcher.Errors:
+			if !ok {
+				return
+			}
+			log.Println(errors.Wrap(err, "package cache watch failed"))
+		}
+	}
+}
+
+// cached returns the package described by the file, false if the file isn't a package.
+func cached(dir string, fi os.FileInfo) (Cached, bool) {
+	if !fi.Mode().IsRegular() {
+		return Cached{}, false
+	}
+
+	f, err := pdex.ParseFilename(fi.Name())
+	if err != nil {
+		return Cached{}, false
+	}
+
+	return Cached{
+		Filename: f,
+		Path:     filepath.Join(dir, fi.Name()),
+		Size:     fi.Size(),
+		Modified: fi.ModTime(),
+	}, true
+}
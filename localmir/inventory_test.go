@@ -0,0 +1,112 @@
+package localmir_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/james-lawrence/pacmir/internal/testingx"
+	. "github.com/james-lawrence/pacmir/localmir"
+	"github.com/james-lawrence/pacmir/pdex"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestInventory(t *testing.T) {
+	g := testingx.Init(t)
+
+	const pkgname = "example-1.0-1-x86_64.pkg.tar.zst"
+
+	dirs := func(n int) (dirs []string, cleanup func()) {
+		for i := 0; i < n; i++ {
+			dir, err := ioutil.TempDir("", "pacmir.inventory.*")
+			require.Nil(t, err)
+			dirs = append(dirs, dir)
+		}
+
+		return dirs, func() {
+			for _, d := range dirs {
+				os.RemoveAll(d)
+			}
+		}
+	}
+
+	// eventually waits for the inventory to observe the filesystem changes.
+	eventually := func(condition func() bool) {
+		deadline := time.Now().Add(2 * time.Second)
+		for !condition() {
+			require.True(t, time.Now().Before(deadline), "the inventory wasn't updated")
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	g.Describe("Inventory", func() {
+		g.It("should inventory the packages present at startup", func() {
+			d, cleanup := dirs(1)
+			defer cleanup()
+
+			require.Nil(t, ioutil.WriteFile(filepath.Join(d[0], pkgname), []byte("package contents"), 0600))
+			require.Nil(t, ioutil.WriteFile(filepath.Join(d[0], pkgname+".sig"), []byte("signature"), 0600))
+			require.Nil(t, ioutil.WriteFile(filepath.Join(d[0], "core.db"), []byte("database"), 0600))
+
+			inventory := NewInventory(nil, d...)
+			defer inventory.Close()
+
+			c, ok := inventory.Lookup(pkgname)
+			require.True(t, ok)
+			require.Equal(t, pdex.Filename{Name: "example", Version: "1.0", Release: "1", Arch: "x86_64"}, c.Filename)
+			require.Equal(t, filepath.Join(d[0], pkgname), c.Path)
+			require.Equal(t, int64(16), c.Size)
+			require.Len(t, inventory.Packages(), 1)
+		})
+
+		g.It("should track packages as they're added and removed", func() {
+			d, cleanup := dirs(1)
+			defer cleanup()
+
+			inventory := NewInventory(nil, d...)
+			defer inventory.Close()
+
+			_, ok := inventory.Lookup(pkgname)
+			require.False(t, ok)
+
+			// packages are moved into place by pacman and pacmir.
+			tmp := filepath.Join(d[0], ".download")
+			require.Nil(t, ioutil.WriteFile(tmp, []byte("package contents"), 0600))
+			require.Nil(t, os.Rename(tmp, filepath.Join(d[0], pkgname)))
+			eventually(func() bool {
+				_, ok := inventory.Lookup(pkgname)
+				return ok
+			})
+
+			require.Nil(t, os.Remove(filepath.Join(d[0], pkgname)))
+			eventually(func() bool {
+				_, ok := inventory.Lookup(pkgname)
+				return !ok
+			})
+		})
+
+		g.It("should prefer packages from earlier directories", func() {
+			d, cleanup := dirs(2)
+			defer cleanup()
+
+			require.Nil(t, ioutil.WriteFile(filepath.Join(d[0], pkgname), []byte("preferred"), 0600))
+			require.Nil(t, ioutil.WriteFile(filepath.Join(d[1], pkgname), []byte("package contents"), 0600))
+
+			inventory := NewInventory(nil, d...)
+			defer inventory.Close()
+
+			c, ok := inventory.Lookup(pkgname)
+			require.True(t, ok)
+			require.Equal(t, filepath.Join(d[0], pkgname), c.Path)
+
+			require.Nil(t, os.Remove(filepath.Join(d[0], pkgname)))
+			eventually(func() bool {
+				c, ok := inventory.Lookup(pkgname)
+				return ok && c.Path == filepath.Join(d[1], pkgname)
+			})
+		})
+	})
+}
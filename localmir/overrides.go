@@ -0,0 +1,24 @@
+package localmir
+
+import (
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/james-lawrence/pacmir/config"
+	"github.com/justinas/alice"
+)
+
+// Enabled rejects requests for repositories disabled by the configuration.
+func Enabled(c config.Config) alice.Constructor {
+	return func(original http.Handler) http.Handler {
+		return http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+			rname := mux.Vars(req)["repo"]
+			if c.Repository(rname).Disabled {
+				http.Error(resp, "repository disabled: "+rname, http.StatusNotFound)
+				return
+			}
+
+			original.ServeHTTP(resp, req)
+		})
+	}
+}
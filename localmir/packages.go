@@ -0,0 +1,195 @@
+package localmir
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"hash"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/james-lawrence/pacmir/pdex"
+	"github.com/pkg/errors"
+)
+
+// Sharer a sharing backend seeding packages to other machines. i.e.) the swarm.
+type Sharer interface {
+	Upload(ctx context.Context, src io.Reader) (string, error)
+}
+
+// NewPackageCache stores packages retrieved from upstream within the directory.
+func NewPackageCache(dir string, index *pdex.DB, sharing map[string]Sharer) *PackageCache {
+	return &PackageCache{
+		Directory: dir,
+		Index:     index,
+		Sharing:   sharing,
+		Syncs:     pdex.NewSyncs(),
+		transfers: &transfers{m: &sync.Mutex{}, inflight: map[string]*transfer{}},
+	}
+}
+
+// PackageCache pacmir's own package cache. packages are only stored once verified
+// against the sync database, then registered with the index and every sharing backend.
+type PackageCache struct {
+	Directory string
+	// Index records the cached packages, optional.
+	Index *pdex.DB
+	// Sharing backends by name, optional.
+	Sharing map[string]Sharer
+	// Syncs parsed sync databases used to verify packages.
+	Syncs     *pdex.Syncs
+	transfers *transfers
+}
+
+// Path of the named package within the cache.
+func (t *PackageCache) Path(name string) string {
+	return filepath.Join(t.Directory, filepath.Base(name))
+}
+
+// Tee begins caching the named package, the bytes written are stored in a temporary
+// file until committed.
+func (t *PackageCache) Tee(name string) (_ *tee, err error) {
+	var (
+		dst *os.File
+	)
+
+	if err = os.MkdirAll(t.Directory, 0755); err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	if dst, err = ioutil.TempFile(t.Directory, "."+filepath.Base(name)+".*"); err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	return &tee{cache: t, name: filepath.Base(name), dst: dst, digest: sha256.New()}, nil
+}
+
+// tee a package being cached.
+type tee struct {
+	cache  *PackageCache
+	name   string
+	dst    *os.File
+	digest hash.Hash
+	n      int64
+	// sum of contents assembled out of order.
+	sum []byte
+}
+
+func (t *tee) Write(b []byte) (n int, err error) {
+	n, err = t.dst.Write(b)
+	t.digest.Write(b[:n])
+	t.n += int64(n)
+
+	return n, errors.Wrapf(err, "failed to cache %s", t.name)
+}
+
+// assembled records contents written out of order that were verified while assembling.
+func (t *tee) assembled(expected pdex.Package) {
+	t.n, t.sum = expected.Size, expected.SHA256
+}
+
+// Abort discards the temporary file, has no effect once committed.
+func (t *tee) Abort() {
+	t.dst.Close()
+	os.Remove(t.dst.Name())
+}
+
+// Commit verifies the package against its sync database entry and moves it into place.
+// the modification time of the package is set to the upstream's when known.
+func (t *tee) Commit(expected pdex.Package, modified time.Time) (err error) {
+	defer t.Abort()
+
+	if t.n != expected.Size {
+		return mismatched("%s size mismatch: expected %d, received %d", t.name, expected.Size, t.n)
+	}
+
+	sum := t.sum
+	if sum == nil {
+		sum = t.digest.Sum(nil)
+	}
+
+	if !bytes.Equal(sum, expected.SHA256) {
+		return mismatched("%s sha256 mismatch: expected %x, received %x", t.name, expected.SHA256, sum)
+	}
+
+	if err = t.dst.Close(); err != nil {
+		return errors.WithStack(err)
+	}
+
+	if modified.IsZero() {
+		modified = time.Now()
+	}
+
+	if err = os.Chtimes(t.dst.Name(), modified, modified); err != nil {
+		return errors.WithStack(err)
+	}
+
+	if err = os.Rename(t.dst.Name(), t.cache.Path(t.name)); err != nil {
+		return errors.WithStack(err)
+	}
+
+	record := pdex.Record{
+		SHA256:   expected.SHA256,
+		Name:     t.name,
+		Size:     t.n,
+		Path:     t.cache.Path(t.name),
+		Modified: modified.UTC(),
+	}
+
+	if t.cache.Index != nil {
+		if err = t.cache.Index.Insert(record); err != nil {
+			return errors.Wrapf(err, "unable to index %s", t.name)
+		}
+	}
+
+	go t.cache.share(record)
+
+	return nil
+}
+
+// share the package with every sharing backend, seeding it for the other machines.
+func (t *PackageCache) share(record pdex.Record) {
+	if len(t.Sharing) == 0 {
+		return
+	}
+
+	ctx, done := context.WithTimeout(context.Background(), 10*time.Minute)
+	defer done()
+
+	record.Shared = map[string]string{}
+	for name, s := range t.Sharing {
+		id, err := t.upload(ctx, s, record.Path)
+		if err != nil {
+			log.Println(errors.Wrapf(err, "unable to share %s with %s", record.Name, name))
+			continue
+		}
+
+		record.Shared[name] = id
+	}
+
+	if t.Index == nil {
+		return
+	}
+
+	if err := t.Index.Insert(record); err != nil {
+		log.Println(errors.Wrapf(err, "unable to index %s", record.Name))
+	}
+}
+
+func (t *PackageCache) upload(ctx context.Context, s Sharer, path string) (_ string, err error) {
+	var (
+		src *os.File
+	)
+
+	if src, err = os.Open(path); err != nil {
+		return "", errors.WithStack(err)
+	}
+	defer src.Close()
+
+	return s.Upload(ctx, src)
+}
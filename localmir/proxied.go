@@ -1,71 +1,120 @@
 package localmir
 
 import (
-	"fmt"
+	"context"
 	"io"
 	"log"
 	"net/http"
+	"path"
+	"path/filepath"
+	"strconv"
 	"strings"
 	"syscall"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/james-lawrence/pacmir"
+	"github.com/james-lawrence/pacmir/config"
+	"github.com/james-lawrence/pacmir/mirrors"
+	"github.com/james-lawrence/pacmir/pdex"
 	"github.com/justinas/alice"
 	"github.com/pkg/errors"
+	"golang.org/x/time/rate"
 )
 
 // Proxied acts as a proxy for a pacman mirror
 type Proxied struct {
 	HTTPAddress string
 	Pacman      *pacmir.CachedConfig
+	// Overrides per repository configuration.
+	Overrides map[string]config.Repository
+	// Bandwidth limits downloads from upstream mirrors.
+	Bandwidth *rate.Limiter
+	// CacheServer pacmir is configured as a pacman CacheServer, pacman never requests
+	// databases from cache servers.
+	CacheServer bool
+	// Ranking orders upstream mirrors by their observed performance, optional.
+	Ranking *mirrors.Ranker
+	// Staleness policy, databases are not proxied from stale mirrors. requires Ranking.
+	Staleness mirrors.Staleness
+	// Databases caches databases and their signatures, optional.
+	Databases *DBCache
+	// Breaker skips mirrors that repeatedly fail, optional.
+	Breaker *mirrors.Breaker
+	// Packages caches packages proxied from upstream, optional.
+	Packages *PackageCache
+	// Segmented downloads large packages from several mirrors at once, requires Packages. optional.
+	Segmented *Segmented
 }
 
 // Bind to a router
 func (t Proxied) Bind(c alice.Chain, r *mux.Router) {
-	r.Handle("/{package}.db", c.ThenFunc(t.Proxy))
+	metadatas := func(req *http.Request, m *mux.RouteMatch) bool {
+		return metadata(path.Base(req.URL.Path))
+	}
+
+	if t.CacheServer {
+		// pacman never requests repository metadata from cache servers.
+		r.Handle("/{package}", c.ThenFunc(http.NotFound)).MatcherFunc(metadatas)
+	} else {
+		r.Handle("/{package}", c.ThenFunc(t.Proxy)).MatcherFunc(metadatas)
+	}
+
 	r.Handle("/{package}.sig", c.ThenFunc(t.Proxy))
 }
 
 // Proxy handler
 func (t Proxied) Proxy(resp http.ResponseWriter, req *http.Request) {
 	var (
-		err     error
-		proxied *http.Response
-		params  = mux.Vars(req)
-		rname   = params["repo"]
-		arch    = params["arch"]
+		err      error
+		proxied  *http.Response
+		upstream string
+		latency  time.Duration
+		params   = mux.Vars(req)
+		rname    = params["repo"]
+		arch     = params["arch"]
+		name     = path.Base(req.URL.Path)
 	)
 
-	mirrors := t.Pacman.Mirrors(rname)
-
-	if len(mirrors) == 0 {
+	mirrors, ok := t.mirrors(rname, arch, name)
+	if !ok {
 		resp.WriteHeader(http.StatusNotFound)
 		return
 	}
 
-	for _, s := range mirrors {
-		if proxied != nil {
-			// reset previous proxied request because it was rejected.
-			proxied.Body.Close()
-			proxied = nil
-		}
+	if t.Databases != nil && metadata(name) {
+		t.database(resp, req, mirrors, path.Join(rname, arch, strings.TrimSuffix(name, ".sig")), strings.HasSuffix(name, ".sig"))
+		return
+	}
 
-		proxieduri := strings.ReplaceAll(s, fmt.Sprintf("/%s/os/%s", rname, arch), req.RequestURI)
-		if strings.Contains(s, t.HTTPAddress) {
-			continue
-		}
+	// complete packages are cached, concurrent requests share a single transfer.
+	if t.Packages != nil && pkg(name) && req.Method == http.MethodGet && req.Header.Get("Range") == "" {
+		x, r, leader, err := t.Packages.transfers.join(path.Join(rname, arch, name), t.Packages, name)
+		if err == nil {
+			if leader {
+				go t.transfer(x, mirrors, rname, arch, name)
+			}
 
-		if proxied, err = http.Get(proxieduri); err != nil {
-			log.Println("skipping", proxieduri, err)
-			continue
+			t.follow(resp, req, x, r)
+			return
 		}
 
-		if proxied.StatusCode != http.StatusOK {
-			log.Println("skipping", proxieduri, proxied.StatusCode, proxied.Status)
-			continue
+		log.Println(errors.Wrapf(err, "unable to cache %s", name))
+	}
+
+	// pass range requests through, allowing pacman to resume interrupted downloads.
+	header := http.Header{}
+	for _, k := range []string{"Range", "If-Range"} {
+		if v := req.Header.Get(k); v != "" {
+			header.Set(k, v)
 		}
+	}
 
-		break
+	started := time.Now()
+	if proxied, upstream, latency, err = t.upstream(req.Context(), req.Method, mirrors, name, header); err != nil {
+		log.Println(errors.Wrapf(err, "unable to proxy %s", name))
+		fail(resp, err)
+		return
 	}
 	defer proxied.Body.Close()
 
@@ -74,14 +123,448 @@ func (t Proxied) Proxy(resp http.ResponseWriter, req *http.Request) {
 	}
 	resp.WriteHeader(proxied.StatusCode)
 
-	if n, err := io.CopyN(resp, proxied.Body, proxied.ContentLength); err != nil {
-		// silence broken pipe errors. pacman is evil and just nukes the connection if it doesn't need
-		// to request all the data.
-		if cause := new(syscall.Errno); errors.As(err, cause) && cause.Error() == "broken pipe" {
-			return
-		}
+	if req.Method == http.MethodHead {
+		t.record(upstream, latency, 0, 0, false)
+		return
+	}
+
+	n, err := limited(req.Context(), t.Bandwidth, resp, proxied.Body)
+	if err == nil {
+		t.record(upstream, latency, n, time.Since(started), false)
+	}
 
+	if err != nil && !disconnected(err) {
 		log.Println("proxy failed", n, proxied.ContentLength, err)
 		log.Printf("%T\n", err)
 	}
 }
+
+// Package retrieves the package from the upstream mirrors, allowing the mirrors to be
+// used as a Source. packages are cached and transfers shared when Packages is set.
+func (t Proxied) Package(ctx context.Context, rname, arch, name string) (_ io.ReadCloser, err error) {
+	mirrors, ok := t.mirrors(rname, arch, name)
+	if !ok {
+		return nil, errors.Errorf("no mirrors serve %s/%s", rname, arch)
+	}
+
+	if t.Packages != nil {
+		x, r, leader, err := t.Packages.transfers.join(path.Join(rname, arch, name), t.Packages, name)
+		if err == nil {
+			if leader {
+				go t.transfer(x, mirrors, rname, arch, name)
+			}
+
+			select {
+			case <-x.ready:
+			case <-ctx.Done():
+				r.Close()
+				return nil, errors.WithStack(ctx.Err())
+			}
+
+			if x.err != nil {
+				r.Close()
+				return nil, x.err
+			}
+
+			// losing a race detaches the follower, the transfer is cancelled if nobody else follows.
+			r.until(ctx)
+
+			return r, nil
+		}
+
+		log.Println(errors.Wrapf(err, "unable to cache %s", name))
+	}
+
+	proxied, _, _, err := t.upstream(ctx, http.MethodGet, mirrors, name, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return proxied.Body, nil
+}
+
+// transfer the package from upstream into the cache. a client disconnecting doesn't
+// interrupt the others, the transfer is only cancelled once every client detached.
+func (t Proxied) transfer(x *transfer, mirrors []string, rname, arch, name string) {
+	var (
+		key = path.Join(rname, arch, name)
+	)
+
+	defer x.tee.Abort()
+
+	ctx, done := context.WithTimeout(x.ctx, time.Hour)
+	defer done()
+
+	if t.Segmented != nil && len(mirrors) > 1 {
+		if expected, err := t.Expected(rname, arch, name); err == nil && expected.Size >= t.Segmented.Threshold {
+			t.segmented(ctx, x, mirrors, rname, arch, expected)
+			return
+		}
+	}
+
+	started := time.Now()
+	proxied, upstream, latency, err := t.upstream(ctx, http.MethodGet, mirrors, name, nil)
+	if err != nil {
+		t.Packages.transfers.release(key, x)
+		log.Println(errors.Wrapf(err, "unable to proxy %s", name))
+		x.start(0, nil, err)
+		return
+	}
+	defer proxied.Body.Close()
+
+	x.start(proxied.StatusCode, proxied.Header, nil)
+
+	n, err := limited(ctx, t.Bandwidth, x, proxied.Body)
+	t.Packages.transfers.release(key, x)
+	x.finish(err)
+
+	if err != nil {
+		log.Println("transfer failed", name, n, proxied.ContentLength, err)
+		return
+	}
+
+	t.record(upstream, latency, n, time.Since(started), false)
+
+	modified, _ := http.ParseTime(proxied.Header.Get("Last-Modified"))
+	t.commit(x.tee, rname, arch, name, modified)
+}
+
+// segmented downloads the package from several mirrors at once. the bytes are streamed
+// to the clients as they are assembled, except the final byte which is only served once
+// the package is verified.
+func (t Proxied) segmented(ctx context.Context, x *transfer, mirrors []string, rname, arch string, expected pdex.Package) {
+	var (
+		key    = path.Join(rname, arch, expected.Filename)
+		header = http.Header{}
+	)
+
+	header.Set("Content-Type", contenttype(expected.Filename))
+	header.Set("Content-Length", strconv.FormatInt(expected.Size, 10))
+
+	err := t.Segmented.Download(ctx, t.get, mirrors, expected, x.tee.dst, func(n int64) {
+		x.start(http.StatusOK, header, nil)
+		if n >= expected.Size {
+			n = expected.Size - 1
+		}
+		x.progress(n)
+	})
+	t.Packages.transfers.release(key, x)
+
+	if err != nil {
+		log.Println(errors.Wrapf(err, "unable to proxy %s", expected.Filename))
+		x.start(0, nil, err)
+		x.finish(err)
+		return
+	}
+
+	x.start(http.StatusOK, header, nil)
+	x.progress(expected.Size)
+	x.finish(nil)
+
+	x.tee.assembled(expected)
+	t.commit(x.tee, rname, arch, expected.Filename, time.Time{})
+}
+
+// follow the transfer, streaming the package to the client as it arrives.
+func (t Proxied) follow(resp http.ResponseWriter, req *http.Request, x *transfer, r *follower) {
+	defer r.Close()
+	r.until(req.Context())
+
+	select {
+	case <-x.ready:
+	case <-req.Context().Done():
+		return
+	}
+
+	if x.err != nil {
+		fail(resp, x.err)
+		return
+	}
+
+	for k, v := range x.header {
+		resp.Header()[k] = v
+	}
+	resp.WriteHeader(x.status)
+
+	if n, err := io.Copy(resp, r); err != nil && !disconnected(err) {
+		log.Println("proxy failed", n, err)
+	}
+}
+
+// disconnected returns true if the client closed the connection. pacman is evil and just
+// nukes the connection if it doesn't need to request all the data.
+func disconnected(err error) bool {
+	cause := new(syscall.Errno)
+	return errors.As(err, cause) && cause.Error() == "broken pipe"
+}
+
+// database serves the database, or its signature, from the cache revalidating it upstream.
+func (t Proxied) database(resp http.ResponseWriter, req *http.Request, mirrors []string, key string, signature bool) {
+	cached, err := t.Databases.Get(key, mirrors, t.get)
+	if err != nil {
+		log.Println(errors.Wrapf(err, "unable to proxy %s", key))
+		fail(resp, err)
+		return
+	}
+
+	cached.Serve(resp, req, signature)
+}
+
+// commit the cached package once verified against the sync database.
+func (t Proxied) commit(cached *tee, rname, arch, name string, modified time.Time) {
+	expected, err := t.Expected(rname, arch, name)
+	if err != nil {
+		log.Println(errors.Wrapf(err, "unable to verify %s, discarding", name))
+		return
+	}
+
+	if err = cached.Commit(expected, modified); err != nil {
+		log.Println(errors.Wrapf(err, "unable to cache %s", name))
+		return
+	}
+
+	log.Println("cached", name)
+}
+
+// Expected resolves the package from the repository's sync database, preferring
+// pacmir's cached copy over pacman's. requires Packages.
+func (t Proxied) Expected(rname, arch, name string) (p pdex.Package, err error) {
+	var (
+		candidates []string
+	)
+
+	if t.Databases != nil {
+		if c, ok := t.Databases.load(path.Join(rname, arch, rname+".db")); ok {
+			candidates = append(candidates, c.database())
+		}
+	}
+
+	if config := t.Pacman.Current(); config != nil {
+		candidates = append(candidates, filepath.Join(config.DBPath, "sync", rname+".db"))
+	}
+
+	for _, c := range candidates {
+		if p, err = t.Packages.Syncs.Lookup(c, name); err == nil {
+			return p, nil
+		}
+	}
+
+	return p, errors.Errorf("%s not found in the %s sync database", name, rname)
+}
+
+// get the file from the upstream, the body is limited by the bandwidth.
+func (t Proxied) get(ctx context.Context, upstream, name string, header http.Header) (*http.Response, error) {
+	proxied, latency, err := t.fetch(ctx, http.MethodGet, upstream, name, header)
+	if err != nil {
+		return nil, err
+	}
+
+	if proxied.StatusCode < http.StatusInternalServerError {
+		t.record(upstream, latency, 0, 0, false)
+	}
+
+	if t.Bandwidth != nil && t.Bandwidth.Limit() != rate.Inf {
+		proxied.Body = throttledbody{
+			throttled: throttled{ctx: ctx, l: t.Bandwidth, r: proxied.Body},
+			Closer:    proxied.Body,
+		}
+	}
+
+	return proxied, nil
+}
+
+// mirrors resolves the upstream mirrors for the repository and architecture,
+// ordered by preference.
+func (t Proxied) mirrors(rname, arch, name string) (mirrors []string, ok bool) {
+	repo, ok := t.Pacman.Repository(rname)
+	if !ok {
+		return nil, false
+	}
+
+	// resolve the servers for the requested architecture.
+	if repo, ok = repo.Arch(arch); !ok {
+		return nil, false
+	}
+
+	mirrors = repo.Sources()
+	if o := t.Overrides[rname]; len(o.Servers) > 0 {
+		mirrors = make([]string, 0, len(o.Servers))
+		for _, s := range o.Servers {
+			mirrors = append(mirrors, strings.NewReplacer("$repo", rname, "$arch", arch).Replace(s))
+		}
+	}
+
+	// never proxy to ourselves.
+	remote := mirrors[:0:0]
+	for _, s := range mirrors {
+		if !strings.Contains(s, t.HTTPAddress) {
+			remote = append(remote, s)
+		}
+	}
+	mirrors = remote
+
+	if len(mirrors) == 0 {
+		return nil, false
+	}
+
+	if t.Ranking != nil {
+		mirrors = t.Ranking.Order(mirrors)
+	}
+
+	// stale databases reference packages that fresher mirrors and peers have already replaced.
+	if t.Ranking != nil && metadata(name) {
+		fresh, stale := t.Ranking.Fresh(mirrors, t.Staleness)
+		for _, f := range stale {
+			log.Println("skipping stale mirror", f.Root, f.Reason)
+		}
+
+		if len(fresh) > 0 {
+			mirrors = fresh
+		} else {
+			log.Println("every mirror is stale, ignoring staleness", rname, arch)
+		}
+	}
+
+	return mirrors, true
+}
+
+// upstream requests the file from the first mirror to answer successfully. responses
+// to conditional requests are successful when the file wasn't modified, responses to
+// range requests when the range was served or can't be satisfied.
+func (t Proxied) upstream(ctx context.Context, method string, mirrors []string, name string, header http.Header) (proxied *http.Response, upstream string, latency time.Duration, err error) {
+	var (
+		attempts []attempt
+	)
+
+	for _, s := range mirrors {
+		if proxied, latency, err = t.fetch(ctx, method, s, name, header); err != nil {
+			log.Println("skipping", s, name, err)
+			attempts = append(attempts, attempt{upstream: s, err: err})
+			continue
+		}
+
+		switch {
+		case proxied.StatusCode == http.StatusOK:
+		case proxied.StatusCode == http.StatusNotModified && len(header) > 0:
+		case proxied.StatusCode == http.StatusPartialContent && header.Get("Range") != "":
+		case proxied.StatusCode == http.StatusRequestedRangeNotSatisfiable && header.Get("Range") != "":
+		default:
+			cause := unexpected(proxied)
+			proxied.Body.Close()
+			log.Println("skipping", s, name, cause)
+			attempts = append(attempts, attempt{upstream: s, err: cause})
+			continue
+		}
+
+		return proxied, s, latency, nil
+	}
+
+	return nil, "", 0, failure{name: name, attempts: attempts}
+}
+
+// fetch the file from the upstream mirror recording failures. missing files are not
+// the mirror's fault, server errors are. mirrors with an open circuit are skipped.
+func (t Proxied) fetch(ctx context.Context, method, upstream, name string, header http.Header) (proxied *http.Response, latency time.Duration, err error) {
+	var (
+		req *http.Request
+	)
+
+	if t.Breaker != nil {
+		if ok, retry := t.Breaker.Allow(upstream); !ok {
+			return nil, 0, openerror{retry: retry}
+		}
+	}
+
+	if req, err = http.NewRequestWithContext(ctx, method, strings.TrimSuffix(upstream, "/")+"/"+name, nil); err != nil {
+		return nil, 0, errors.WithStack(err)
+	}
+
+	for k, v := range header {
+		req.Header[k] = v
+	}
+
+	started := time.Now()
+	if proxied, err = http.DefaultClient.Do(req); err != nil {
+		// cancelled requests, i.e.) a client disconnecting or a source losing a race,
+		// aren't the mirror's fault.
+		if req.Context().Err() != nil {
+			t.abandoned(upstream)
+		} else {
+			t.failed(upstream, 0)
+		}
+		return nil, 0, errors.WithStack(err)
+	}
+	latency = time.Since(started)
+
+	if proxied.StatusCode >= http.StatusInternalServerError {
+		t.failed(upstream, latency)
+	} else if t.Breaker != nil {
+		t.Breaker.Success(upstream)
+	}
+
+	return proxied, latency, nil
+}
+
+func (t Proxied) failed(upstream string, latency time.Duration) {
+	t.record(upstream, latency, 0, 0, true)
+
+	if t.Breaker != nil {
+		t.Breaker.Failure(upstream)
+	}
+}
+
+func (t Proxied) abandoned(upstream string) {
+	if t.Breaker != nil {
+		t.Breaker.Abandoned(upstream)
+	}
+}
+
+type throttledbody struct {
+	throttled
+	io.Closer
+}
+
+// pkg returns true if the file is a package.
+func pkg(name string) bool {
+	_, err := pdex.ParseFilename(name)
+	return err == nil
+}
+
+// contenttype of the file.
+func contenttype(name string) string {
+	if strings.HasSuffix(name, ".sig") {
+		return "application/pgp-signature"
+	}
+
+	return "application/octet-stream"
+}
+
+// metadata returns true if the file is repository metadata or its signature: the sync
+// database, file and link lists, i.e.) core.db, core.files, core.db.tar.gz, core.files.sig
+func metadata(name string) bool {
+	if pkg(name) {
+		return false
+	}
+
+	name = strings.TrimSuffix(name, ".sig")
+	// compressed archives, i.e.) core.files.tar.gz
+	if ext := path.Ext(name); ext != ".tar" && strings.HasSuffix(strings.TrimSuffix(name, ext), ".tar") {
+		name = strings.TrimSuffix(name, ext)
+	}
+	name = strings.TrimSuffix(name, ".tar")
+
+	switch path.Ext(name) {
+	case ".db", ".files", ".links":
+		return true
+	default:
+		return false
+	}
+}
+
+func (t Proxied) record(server string, latency time.Duration, n int64, d time.Duration, failed bool) {
+	if t.Ranking == nil {
+		return
+	}
+
+	t.Ranking.Record(server, latency, n, d, failed)
+}
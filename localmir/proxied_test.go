@@ -0,0 +1,624 @@
+package localmir_test
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/james-lawrence/pacmir"
+	"github.com/james-lawrence/pacmir/internal/testingx"
+	. "github.com/james-lawrence/pacmir/localmir"
+	"github.com/james-lawrence/pacmir/mirrors"
+	"github.com/james-lawrence/pacmir/pdex"
+	"github.com/justinas/alice"
+
+	"github.com/stretchr/testify/require"
+)
+
+// upstream simulates a mirror serving core.db, its signature and packages, answering conditional requests.
+type upstream struct {
+	requests    int64
+	conditional int64
+	down        int32
+	modified    time.Time
+	db          []byte
+	sig         []byte
+	packages    map[string][]byte
+	heads       int64
+	// slow delays package responses.
+	slow time.Duration
+}
+
+func (t *upstream) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	atomic.AddInt64(&t.requests, 1)
+	if req.Method == http.MethodHead {
+		atomic.AddInt64(&t.heads, 1)
+	}
+
+	if atomic.LoadInt32(&t.down) == 1 {
+		resp.WriteHeader(http.StatusServiceUnavailable)
+		resp.Write([]byte("down for maintenance"))
+		return
+	}
+
+	switch req.URL.Path {
+	case "/core/os/x86_64/core.db":
+	case "/core/os/x86_64/core.db.sig":
+		if t.sig == nil {
+			resp.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		http.ServeContent(resp, req, "core.db.sig", t.modified, bytes.NewReader(t.sig))
+		return
+	default:
+		if pkg, ok := t.packages[path.Base(req.URL.Path)]; ok {
+			time.Sleep(t.slow)
+			http.ServeContent(resp, req, path.Base(req.URL.Path), t.modified, bytes.NewReader(pkg))
+			return
+		}
+
+		resp.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	if req.Header.Get("If-None-Match") != "" || req.Header.Get("If-Modified-Since") != "" {
+		atomic.AddInt64(&t.conditional, 1)
+	}
+
+	// slow enough for concurrent requests to overlap.
+	time.Sleep(50 * time.Millisecond)
+	resp.Header().Set("ETag", `"v1"`)
+	http.ServeContent(resp, req, "core.db", t.modified, bytes.NewReader(t.db))
+}
+
+// sharer records the packages uploaded to it.
+type sharer struct {
+	uploaded chan []byte
+}
+
+func (t sharer) Upload(ctx context.Context, src io.Reader) (string, error) {
+	raw, err := ioutil.ReadAll(src)
+	if err != nil {
+		return "", err
+	}
+
+	t.uploaded <- raw
+	return "shared", nil
+}
+
+func fixture(name string) []byte {
+	raw, err := ioutil.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		panic(err)
+	}
+
+	return raw
+}
+
+func TestProxied(t *testing.T) {
+	g := testingx.Init(t)
+
+	modified := time.Now().Add(-time.Hour).UTC().Truncate(time.Second)
+
+	pacman := func(dir string, upstreams ...*upstream) (servers []*httptest.Server) {
+		conf := "[options]\nArchitecture = x86_64\n\n[core]\n"
+		for _, u := range upstreams {
+			srv := httptest.NewServer(u)
+			servers = append(servers, srv)
+			conf += fmt.Sprintf("Server = %s/$repo/os/$arch\n", srv.URL)
+		}
+
+		require.Nil(t, ioutil.WriteFile(filepath.Join(dir, "pacman.conf"), []byte(conf), 0600))
+		return servers
+	}
+
+	serve := func(proxy func(dir string) Proxied, upstreams ...*upstream) (local *httptest.Server, done func()) {
+		dir, err := ioutil.TempDir("", "pacmir.proxied.*")
+		require.Nil(t, err)
+
+		remotes := pacman(dir, upstreams...)
+		conf := filepath.Join(dir, "pacman.conf")
+
+		cconfig := pacmir.NewCachedConfig(conf)
+		router := mux.NewRouter()
+		p := proxy(dir)
+		p.HTTPAddress = "localhost:4000"
+		p.Pacman = cconfig
+		prouter := router.PathPrefix("/{repo}/os/{arch}").Subrouter()
+		p.Bind(alice.New(), prouter)
+		Download{Fallback: http.HandlerFunc(p.Proxy)}.Bind(alice.New(), prouter)
+		local = httptest.NewServer(router)
+
+		return local, func() {
+			local.Close()
+			for _, r := range remotes {
+				r.Close()
+			}
+			cconfig.Close()
+			os.RemoveAll(dir)
+		}
+	}
+
+	setup := func(maxage time.Duration, upstreams ...*upstream) (local *httptest.Server, done func()) {
+		return serve(func(dir string) Proxied {
+			return Proxied{Databases: NewDBCache(filepath.Join(dir, "databases"), maxage)}
+		}, upstreams...)
+	}
+
+	get := func(url string, header http.Header) (*http.Response, string) {
+		req, err := http.NewRequest(http.MethodGet, url, nil)
+		require.Nil(t, err)
+		for k, v := range header {
+			req.Header[k] = v
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		require.Nil(t, err)
+		defer resp.Body.Close()
+
+		body, err := ioutil.ReadAll(resp.Body)
+		require.Nil(t, err)
+
+		return resp, string(body)
+	}
+
+	g.Describe("databases", func() {
+		g.It("should revalidate upstream and answer pacman with not modified", func() {
+			u := &upstream{modified: modified, db: []byte("database")}
+			local, done := setup(0, u)
+			defer done()
+
+			resp, body := get(local.URL+"/core/os/x86_64/core.db", nil)
+			require.Equal(t, http.StatusOK, resp.StatusCode)
+			require.Equal(t, "database", body)
+			require.Equal(t, u.modified.Format(http.TimeFormat), resp.Header.Get("Last-Modified"))
+
+			resp, body = get(local.URL+"/core/os/x86_64/core.db", http.Header{
+				"If-Modified-Since": []string{resp.Header.Get("Last-Modified")},
+			})
+			require.Equal(t, http.StatusNotModified, resp.StatusCode)
+			require.Equal(t, "", body)
+			// database, missing signature and revalidation.
+			require.Equal(t, int64(3), atomic.LoadInt64(&u.requests))
+			require.Equal(t, int64(1), atomic.LoadInt64(&u.conditional))
+		})
+
+		g.It("should share a single upstream transfer between clients", func() {
+			u := &upstream{modified: modified, db: []byte("database")}
+			local, done := setup(time.Hour, u)
+			defer done()
+
+			var wg sync.WaitGroup
+			for i := 0; i < 10; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					resp, err := http.Get(local.URL + "/core/os/x86_64/core.db")
+					if err == nil {
+						resp.Body.Close()
+					}
+				}()
+			}
+			wg.Wait()
+
+			resp, body := get(local.URL+"/core/os/x86_64/core.db", nil)
+			require.Equal(t, http.StatusOK, resp.StatusCode)
+			require.Equal(t, "database", body)
+			// database and missing signature.
+			require.Equal(t, int64(2), atomic.LoadInt64(&u.requests))
+		})
+
+		g.It("should serve the stale copy when upstream is down", func() {
+			u := &upstream{modified: modified, db: []byte("database")}
+			local, done := setup(0, u)
+			defer done()
+
+			resp, _ := get(local.URL+"/core/os/x86_64/core.db", nil)
+			require.Equal(t, http.StatusOK, resp.StatusCode)
+
+			atomic.StoreInt32(&u.down, 1)
+			resp, body := get(local.URL+"/core/os/x86_64/core.db", nil)
+			require.Equal(t, http.StatusOK, resp.StatusCode)
+			require.Equal(t, "database", body)
+			require.NotEqual(t, "", resp.Header.Get("Warning"))
+		})
+
+		g.It("should fail when upstream is down without a cached copy", func() {
+			u := &upstream{modified: modified, db: []byte("database")}
+			local, done := setup(0, u)
+			defer done()
+
+			atomic.StoreInt32(&u.down, 1)
+			resp, _ := get(local.URL+"/core/os/x86_64/core.db", nil)
+			require.Equal(t, http.StatusBadGateway, resp.StatusCode)
+		})
+	})
+
+	g.Describe("signatures", func() {
+		g.It("should serve the database and signature from the same upstream", func() {
+			// a mirror that synced the database but not the signature.
+			inconsistent := &upstream{modified: modified, db: fixture("core.db.updated"), sig: fixture("core.db.sig")}
+			consistent := &upstream{modified: modified, db: fixture("core.db"), sig: fixture("core.db.sig")}
+			local, done := setup(time.Hour, inconsistent, consistent)
+			defer done()
+
+			resp, body := get(local.URL+"/core/os/x86_64/core.db", nil)
+			require.Equal(t, http.StatusOK, resp.StatusCode)
+			require.Equal(t, string(fixture("core.db")), body)
+
+			resp, body = get(local.URL+"/core/os/x86_64/core.db.sig", nil)
+			require.Equal(t, http.StatusOK, resp.StatusCode)
+			require.Equal(t, string(fixture("core.db.sig")), body)
+
+			// the signature was served from the cache.
+			require.Equal(t, int64(2), atomic.LoadInt64(&consistent.requests))
+		})
+
+		g.It("should not serve a signature the upstream doesn't provide", func() {
+			u := &upstream{modified: modified, db: []byte("database")}
+			local, done := setup(time.Hour, u)
+			defer done()
+
+			resp, _ := get(local.URL+"/core/os/x86_64/core.db.sig", nil)
+			require.Equal(t, http.StatusNotFound, resp.StatusCode)
+		})
+	})
+
+	g.Describe("metadata", func() {
+		g.It("should cache the file lists and their signatures", func() {
+			u := &upstream{modified: modified, packages: map[string][]byte{
+				"core.files":     fixture("core.db"),
+				"core.files.sig": fixture("core.db.sig"),
+			}}
+			local, done := setup(time.Hour, u)
+			defer done()
+
+			for i := 0; i < 2; i++ {
+				resp, body := get(local.URL+"/core/os/x86_64/core.files", nil)
+				require.Equal(t, http.StatusOK, resp.StatusCode)
+				require.Equal(t, string(fixture("core.db")), body)
+
+				resp, body = get(local.URL+"/core/os/x86_64/core.files.sig", nil)
+				require.Equal(t, http.StatusOK, resp.StatusCode)
+				require.Equal(t, string(fixture("core.db.sig")), body)
+			}
+
+			// file list and signature.
+			require.Equal(t, int64(2), atomic.LoadInt64(&u.requests))
+		})
+
+		g.It("should revalidate the compressed archives", func() {
+			u := &upstream{modified: modified, packages: map[string][]byte{
+				"core.db.tar.gz":    []byte("database"),
+				"core.links.tar.gz": []byte("links"),
+			}}
+			local, done := setup(0, u)
+			defer done()
+
+			for name, expected := range map[string]string{"core.db.tar.gz": "database", "core.links.tar.gz": "links"} {
+				resp, body := get(local.URL+"/core/os/x86_64/"+name, nil)
+				require.Equal(t, http.StatusOK, resp.StatusCode)
+				require.Equal(t, expected, body)
+
+				resp, _ = get(local.URL+"/core/os/x86_64/"+name, http.Header{
+					"If-Modified-Since": []string{resp.Header.Get("Last-Modified")},
+				})
+				require.Equal(t, http.StatusNotModified, resp.StatusCode)
+			}
+		})
+
+		g.It("should not serve metadata as a cache server", func() {
+			u := &upstream{modified: modified, packages: map[string][]byte{"core.files": []byte("files")}}
+			local, done := serve(func(dir string) Proxied {
+				return Proxied{CacheServer: true, Databases: NewDBCache(filepath.Join(dir, "databases"), time.Hour)}
+			}, u)
+			defer done()
+
+			for _, name := range []string{"core.db", "core.files", "core.files.sig", "core.files.tar.gz"} {
+				resp, _ := get(local.URL+"/core/os/x86_64/"+name, nil)
+				require.Equal(t, http.StatusNotFound, resp.StatusCode)
+			}
+			require.Zero(t, atomic.LoadInt64(&u.requests))
+		})
+	})
+
+	g.Describe("packages", func() {
+		const pkgname = "example-1.0-1-x86_64.pkg.tar.zst"
+
+		cache := func(u *upstream) (local *httptest.Server, cached string, index *pdex.DB, shared chan []byte, done func()) {
+			shared = make(chan []byte, 1)
+			local, done = serve(func(dir string) Proxied {
+				cached = filepath.Join(dir, "packages")
+				index = pdex.New(filepath.Join(dir, "index"))
+				return Proxied{
+					Databases: NewDBCache(filepath.Join(dir, "databases"), time.Hour),
+					Packages:  NewPackageCache(cached, index, map[string]Sharer{"test": sharer{uploaded: shared}}),
+				}
+			}, u)
+
+			return local, cached, index, shared, done
+		}
+
+		g.It("should cache verified packages while serving them", func() {
+			contents := []byte("package contents")
+			u := &upstream{
+				modified: modified,
+				db:       testingx.SyncDB(map[string][]byte{pkgname: contents}),
+				packages: map[string][]byte{pkgname: contents},
+			}
+			local, cached, index, shared, done := cache(u)
+			defer done()
+
+			resp, _ := get(local.URL+"/core/os/x86_64/core.db", nil)
+			require.Equal(t, http.StatusOK, resp.StatusCode)
+
+			resp, body := get(local.URL+"/core/os/x86_64/"+pkgname, nil)
+			require.Equal(t, http.StatusOK, resp.StatusCode)
+			require.Equal(t, string(contents), body)
+
+			require.Equal(t, contents, <-shared)
+			raw, err := ioutil.ReadFile(filepath.Join(cached, pkgname))
+			require.Nil(t, err)
+			require.Equal(t, contents, raw)
+
+			// the cached package retains the upstream modification time.
+			info, err := os.Stat(filepath.Join(cached, pkgname))
+			require.Nil(t, err)
+			require.True(t, modified.Equal(info.ModTime()))
+
+			require.Eventually(t, func() bool {
+				r, err := index.Get(pkgname)
+				return err == nil && r.Shared["test"] == "shared"
+			}, time.Second, 10*time.Millisecond)
+
+			// only the package remains within the cache.
+			infos, err := ioutil.ReadDir(cached)
+			require.Nil(t, err)
+			require.Equal(t, 1, len(infos))
+		})
+
+		g.It("should discard packages that don't match the sync database", func() {
+			u := &upstream{
+				modified: modified,
+				db:       testingx.SyncDB(map[string][]byte{pkgname: []byte("package contents")}),
+				packages: map[string][]byte{pkgname: []byte("corrupted contents")},
+			}
+			local, cached, index, _, done := cache(u)
+			defer done()
+
+			resp, _ := get(local.URL+"/core/os/x86_64/core.db", nil)
+			require.Equal(t, http.StatusOK, resp.StatusCode)
+
+			resp, body := get(local.URL+"/core/os/x86_64/"+pkgname, nil)
+			require.Equal(t, http.StatusOK, resp.StatusCode)
+			require.Equal(t, "corrupted contents", body)
+
+			require.Never(t, func() bool {
+				_, err := os.Stat(filepath.Join(cached, pkgname))
+				return err == nil
+			}, 100*time.Millisecond, 10*time.Millisecond)
+
+			_, err := index.Get(pkgname)
+			require.NotNil(t, err)
+		})
+
+		g.It("should share a single upstream transfer between clients", func() {
+			contents := bytes.Repeat([]byte("package contents"), 64*1024)
+			u := &upstream{
+				modified: modified,
+				db:       testingx.SyncDB(map[string][]byte{pkgname: contents}),
+				packages: map[string][]byte{pkgname: contents},
+				slow:     100 * time.Millisecond,
+			}
+			local, cached, _, shared, done := cache(u)
+			defer done()
+
+			resp, _ := get(local.URL+"/core/os/x86_64/core.db", nil)
+			require.Equal(t, http.StatusOK, resp.StatusCode)
+			requests := atomic.LoadInt64(&u.requests)
+
+			var wg sync.WaitGroup
+			bodies := make(chan string, 10)
+			for i := 0; i < 10; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					_, body := get(local.URL+"/core/os/x86_64/"+pkgname, nil)
+					bodies <- body
+				}()
+			}
+			wg.Wait()
+			close(bodies)
+
+			for body := range bodies {
+				require.Equal(t, string(contents), body)
+			}
+
+			require.Equal(t, requests+1, atomic.LoadInt64(&u.requests))
+			require.Equal(t, contents, <-shared)
+			_, err := os.Stat(filepath.Join(cached, pkgname))
+			require.Nil(t, err)
+		})
+
+		g.It("should download large packages from several mirrors", func() {
+			contents := bytes.Repeat([]byte("package contents"), 64*1024)
+			upstreams := []*upstream{
+				{modified: modified, db: testingx.SyncDB(map[string][]byte{pkgname: contents}), packages: map[string][]byte{pkgname: contents}},
+				{modified: modified, db: testingx.SyncDB(map[string][]byte{pkgname: contents}), packages: map[string][]byte{pkgname: contents}},
+			}
+
+			var cached string
+			local, done := serve(func(dir string) Proxied {
+				cached = filepath.Join(dir, "packages")
+				return Proxied{
+					Databases: NewDBCache(filepath.Join(dir, "databases"), time.Hour),
+					Packages:  NewPackageCache(cached, nil, nil),
+					Segmented: &Segmented{Mirrors: 2, Segment: 64 * 1024},
+				}
+			}, upstreams...)
+			defer done()
+
+			resp, _ := get(local.URL+"/core/os/x86_64/core.db", nil)
+			require.Equal(t, http.StatusOK, resp.StatusCode)
+			requests := atomic.LoadInt64(&upstreams[1].requests)
+
+			resp, body := get(local.URL+"/core/os/x86_64/"+pkgname, nil)
+			require.Equal(t, http.StatusOK, resp.StatusCode)
+			require.Equal(t, int64(len(contents)), resp.ContentLength)
+			require.Equal(t, string(contents), body)
+			require.True(t, atomic.LoadInt64(&upstreams[1].requests) > requests)
+
+			require.Eventually(t, func() bool {
+				_, err := os.Stat(filepath.Join(cached, pkgname))
+				return err == nil
+			}, time.Second, 10*time.Millisecond)
+		})
+
+		g.It("should report the upstream failure to every client", func() {
+			u := &upstream{modified: modified, down: 1}
+			local, _, _, _, done := cache(u)
+			defer done()
+
+			resp, body := get(local.URL+"/core/os/x86_64/"+pkgname, nil)
+			require.Equal(t, http.StatusBadGateway, resp.StatusCode)
+			require.Equal(t, "30", resp.Header.Get("Retry-After"))
+			require.Contains(t, body, "down for maintenance")
+		})
+
+		g.It("should answer head requests without downloading the package", func() {
+			contents := []byte("package contents")
+			u := &upstream{
+				modified: modified,
+				db:       testingx.SyncDB(map[string][]byte{pkgname: contents}),
+				packages: map[string][]byte{pkgname: contents},
+			}
+			local, cached, _, _, done := cache(u)
+			defer done()
+
+			resp, err := http.Head(local.URL + "/core/os/x86_64/core.db")
+			require.Nil(t, err)
+			resp.Body.Close()
+			require.Equal(t, http.StatusOK, resp.StatusCode)
+			require.Equal(t, int64(len(u.db)), resp.ContentLength)
+			require.Equal(t, "application/octet-stream", resp.Header.Get("Content-Type"))
+
+			resp, err = http.Head(local.URL + "/core/os/x86_64/" + pkgname)
+			require.Nil(t, err)
+			resp.Body.Close()
+			require.Equal(t, http.StatusOK, resp.StatusCode)
+			require.Equal(t, int64(len(contents)), resp.ContentLength)
+			require.Equal(t, modified.Format(http.TimeFormat), resp.Header.Get("Last-Modified"))
+			require.Equal(t, int64(1), atomic.LoadInt64(&u.heads))
+
+			_, err = os.Stat(filepath.Join(cached, pkgname))
+			require.True(t, os.IsNotExist(err))
+		})
+
+		g.It("should pass range requests upstream without caching the partial package", func() {
+			contents := []byte("package contents")
+			u := &upstream{
+				modified: modified,
+				db:       testingx.SyncDB(map[string][]byte{pkgname: contents}),
+				packages: map[string][]byte{pkgname: contents},
+			}
+			local, cached, _, _, done := cache(u)
+			defer done()
+
+			resp, _ := get(local.URL+"/core/os/x86_64/core.db", nil)
+			require.Equal(t, http.StatusOK, resp.StatusCode)
+
+			resp, body := get(local.URL+"/core/os/x86_64/"+pkgname, http.Header{"Range": []string{"bytes=8-"}})
+			require.Equal(t, http.StatusPartialContent, resp.StatusCode)
+			require.Equal(t, "contents", body)
+			require.Equal(t, "bytes 8-15/16", resp.Header.Get("Content-Range"))
+
+			resp, _ = get(local.URL+"/core/os/x86_64/"+pkgname, http.Header{"Range": []string{"bytes=100-"}})
+			require.Equal(t, http.StatusRequestedRangeNotSatisfiable, resp.StatusCode)
+
+			_, err := os.Stat(filepath.Join(cached, pkgname))
+			require.True(t, os.IsNotExist(err))
+		})
+	})
+
+	g.Describe("failures", func() {
+		const pkgsig = "/core/os/x86_64/example-1.0-1-x86_64.pkg.tar.zst.sig"
+
+		g.It("should list every attempted upstream", func() {
+			first := &upstream{down: 1}
+			second := &upstream{down: 1}
+			local, done := setup(0, first, second)
+			defer done()
+
+			resp, body := get(local.URL+pkgsig, nil)
+			require.Equal(t, http.StatusBadGateway, resp.StatusCode)
+			require.Equal(t, "30", resp.Header.Get("Retry-After"))
+			require.Equal(t, 3, strings.Count(body, "\n"))
+			require.Contains(t, body, "503 Service Unavailable: down for maintenance")
+
+			resp, body = get(local.URL+"/core/os/x86_64/core.db", nil)
+			require.Equal(t, http.StatusBadGateway, resp.StatusCode)
+			require.Contains(t, body, "unable to retrieve core.db")
+		})
+
+		g.It("should report missing files as not found", func() {
+			local, done := setup(0, &upstream{}, &upstream{})
+			defer done()
+
+			resp, _ := get(local.URL+pkgsig, nil)
+			require.Equal(t, http.StatusNotFound, resp.StatusCode)
+			require.Equal(t, "", resp.Header.Get("Retry-After"))
+		})
+
+		g.It("should skip mirrors with an open circuit", func() {
+			u := &upstream{down: 1}
+			local, done := serve(func(dir string) Proxied {
+				return Proxied{Breaker: mirrors.NewBreaker(1, time.Hour)}
+			}, u)
+			defer done()
+
+			resp, _ := get(local.URL+pkgsig, nil)
+			require.Equal(t, http.StatusBadGateway, resp.StatusCode)
+
+			resp, body := get(local.URL+pkgsig, nil)
+			require.Equal(t, http.StatusBadGateway, resp.StatusCode)
+			require.Contains(t, body, "circuit open")
+			require.Equal(t, "3600", resp.Header.Get("Retry-After"))
+			require.Equal(t, int64(1), atomic.LoadInt64(&u.requests))
+		})
+
+		g.It("should not penalize mirrors for cancelled requests", func() {
+			u := &upstream{modified: modified, slow: 200 * time.Millisecond, packages: map[string][]byte{
+				path.Base(pkgsig): []byte("signature"),
+			}}
+			local, done := serve(func(dir string) Proxied {
+				return Proxied{Breaker: mirrors.NewBreaker(1, time.Hour)}
+			}, u)
+			defer done()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+			defer cancel()
+			req, err := http.NewRequestWithContext(ctx, http.MethodGet, local.URL+pkgsig, nil)
+			require.Nil(t, err)
+			_, err = http.DefaultClient.Do(req)
+			require.NotNil(t, err)
+
+			resp, body := get(local.URL+pkgsig, nil)
+			require.Equal(t, http.StatusOK, resp.StatusCode)
+			require.Equal(t, "signature", body)
+		})
+	})
+}
@@ -0,0 +1,313 @@
+package localmir
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/james-lawrence/pacmir/pdex"
+	"github.com/pkg/errors"
+)
+
+// remaining ranges smaller than twice the minimum are not worth splitting.
+const minsegment = 256 * 1024
+
+// Segmented downloads a file in ranges from several mirrors in parallel. a mirror that
+// runs out of ranges takes over half of the largest range still in progress, ranges too
+// small to split remain with their mirror unless it stalls. the ranges of stalled mirrors
+// are retried by the remaining mirrors.
+type Segmented struct {
+	// Mirrors maximum number of mirrors used concurrently.
+	Mirrors int
+	// Segment size of the ranges initially assigned to the mirrors.
+	Segment int64
+	// Threshold packages smaller than the threshold are downloaded from a single mirror.
+	Threshold int64
+	// Stall abandons a range once its mirror delivers no bytes for the duration, zero disables.
+	Stall time.Duration
+}
+
+// Download the package from the mirrors into the file, verifying the assembled file
+// against the sync database. mirrors are used in order of preference. progress, optional,
+// is invoked with the number of contiguous bytes written from the start of the file.
+func (t Segmented) Download(ctx context.Context, fetch fetcher, mirrors []string, expected pdex.Package, dst *os.File, progress func(int64)) (err error) {
+	var (
+		healthy  = mirrors
+		attempts []attempt
+	)
+
+	if t.Mirrors > 0 && len(healthy) > t.Mirrors {
+		healthy = healthy[:t.Mirrors]
+	}
+
+	if err = dst.Truncate(expected.Size); err != nil {
+		return errors.WithStack(err)
+	}
+
+	if progress == nil {
+		progress = func(int64) {}
+	}
+
+	p := newplan(expected.Size, t.Segment)
+	for !p.finished() {
+		if len(healthy) == 0 {
+			return failure{name: expected.Filename, attempts: attempts}
+		}
+
+		var (
+			wg     sync.WaitGroup
+			failed = make([]error, len(healthy))
+		)
+
+		for i, m := range healthy {
+			wg.Add(1)
+			go func(i int, upstream string) {
+				defer wg.Done()
+				failed[i] = t.worker(ctx, fetch, upstream, expected.Filename, p, dst, progress)
+			}(i, m)
+		}
+		wg.Wait()
+
+		// ranges abandoned by failed mirrors are retried by the remaining mirrors.
+		remaining := healthy[:0:0]
+		for i, m := range healthy {
+			if failed[i] != nil {
+				log.Println(errors.Wrapf(failed[i], "segmented download of %s skipping %s", expected.Filename, m))
+				attempts = append(attempts, attempt{upstream: m, err: failed[i]})
+				continue
+			}
+			remaining = append(remaining, m)
+		}
+		healthy = remaining
+	}
+
+	return verify(io.NewSectionReader(dst, 0, expected.Size+1), expected)
+}
+
+// worker downloads ranges from the upstream until none remain.
+func (t Segmented) worker(ctx context.Context, fetch fetcher, upstream, name string, p *plan, dst io.WriterAt, progress func(int64)) (err error) {
+	for {
+		s, ok := p.next()
+		if !ok {
+			return nil
+		}
+
+		if err = t.segment(ctx, fetch, upstream, name, p, s, dst, progress); err != nil {
+			p.abandon(s)
+			return err
+		}
+
+		p.complete(s)
+	}
+}
+
+// segment downloads the range, stopping early when part of it was taken over.
+func (t Segmented) segment(ctx context.Context, fetch fetcher, upstream, name string, p *plan, s *segment, dst io.WriterAt, progress func(int64)) (err error) {
+	var (
+		resp *http.Response
+		n    int
+		buf  = make([]byte, 32*1024)
+	)
+
+	sctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// the segment is cancelled once the mirror stops delivering bytes.
+	progressed := func() {}
+	if t.Stall > 0 {
+		timer := time.AfterFunc(t.Stall, cancel)
+		defer timer.Stop()
+		progressed = func() { timer.Reset(t.Stall) }
+	}
+
+	defer func() {
+		if err != nil && sctx.Err() != nil && ctx.Err() == nil {
+			err = errors.Errorf("%s stalled for %s", upstream, t.Stall)
+		}
+	}()
+
+	start, end := p.bounds(s)
+	header := http.Header{}
+	header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, end-1))
+
+	if resp, err = fetch(sctx, upstream, name, header); err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusPartialContent {
+		if resp.StatusCode == http.StatusOK {
+			return errors.New("range requests are not supported")
+		}
+
+		return unexpected(resp)
+	}
+
+	if cr := resp.Header.Get("Content-Range"); cr != fmt.Sprintf("bytes %d-%d/%d", start, end-1, p.size) {
+		return errors.Errorf("unexpected content range: %s", cr)
+	}
+
+	for {
+		n, err = resp.Body.Read(buf)
+		if n > 0 {
+			progressed()
+			done, contiguous, werr := p.write(s, buf[:n], dst)
+			if werr != nil {
+				return werr
+			}
+			progress(contiguous)
+
+			if done {
+				return nil
+			}
+		}
+
+		if err == io.EOF {
+			if start, end = p.bounds(s); start < end {
+				return io.ErrUnexpectedEOF
+			}
+
+			return nil
+		}
+
+		if err != nil {
+			return errors.WithStack(err)
+		}
+	}
+}
+
+// segment a range of the file, cursor is the next byte to be written.
+type segment struct {
+	cursor int64
+	end    int64
+}
+
+func newplan(size, segsize int64) *plan {
+	p := &plan{m: &sync.Mutex{}, size: size, active: map[*segment]struct{}{}}
+	if segsize <= 0 {
+		segsize = size
+	}
+
+	for offset := int64(0); offset < size; offset += segsize {
+		end := offset + segsize
+		if end > size {
+			end = size
+		}
+		p.pending = append(p.pending, &segment{cursor: offset, end: end})
+	}
+
+	return p
+}
+
+// plan tracks the ranges of the file that remain to be downloaded.
+type plan struct {
+	m       *sync.Mutex
+	size    int64
+	pending []*segment
+	active  map[*segment]struct{}
+}
+
+// next range to download, splitting the largest active range when none are pending.
+func (t *plan) next() (*segment, bool) {
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	if len(t.pending) > 0 {
+		s := t.pending[0]
+		t.pending = t.pending[1:]
+		t.active[s] = struct{}{}
+		return s, true
+	}
+
+	var largest *segment
+	for s := range t.active {
+		if largest == nil || s.end-s.cursor > largest.end-largest.cursor {
+			largest = s
+		}
+	}
+
+	if largest == nil || largest.end-largest.cursor < 2*minsegment {
+		return nil, false
+	}
+
+	mid := largest.cursor + (largest.end-largest.cursor)/2
+	s := &segment{cursor: mid, end: largest.end}
+	largest.end = mid
+	t.active[s] = struct{}{}
+
+	return s, true
+}
+
+func (t *plan) bounds(s *segment) (int64, int64) {
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	return s.cursor, s.end
+}
+
+// write the bytes at the segment's cursor, discarding anything past its end.
+// returns true once the segment is complete and the contiguous bytes written.
+func (t *plan) write(s *segment, b []byte, dst io.WriterAt) (_ bool, _ int64, err error) {
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	if remaining := s.end - s.cursor; int64(len(b)) > remaining {
+		b = b[:remaining]
+	}
+
+	if _, err = dst.WriteAt(b, s.cursor); err != nil {
+		return false, 0, errors.WithStack(err)
+	}
+	s.cursor += int64(len(b))
+
+	return s.cursor >= s.end, t.contiguous(), nil
+}
+
+// contiguous bytes written from the start of the file, every byte before the
+// earliest incomplete range.
+func (t *plan) contiguous() int64 {
+	n := t.size
+	for _, s := range t.pending {
+		if s.cursor < n {
+			n = s.cursor
+		}
+	}
+
+	for s := range t.active {
+		if s.cursor < s.end && s.cursor < n {
+			n = s.cursor
+		}
+	}
+
+	return n
+}
+
+func (t *plan) complete(s *segment) {
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	delete(t.active, s)
+}
+
+// abandon the segment, its remaining range is returned to the pending ranges.
+func (t *plan) abandon(s *segment) {
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	delete(t.active, s)
+	if s.cursor < s.end {
+		t.pending = append(t.pending, s)
+	}
+}
+
+func (t *plan) finished() bool {
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	return len(t.pending) == 0 && len(t.active) == 0
+}
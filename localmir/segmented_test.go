@@ -0,0 +1,210 @@
+package localmir_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/james-lawrence/pacmir/internal/testingx"
+	. "github.com/james-lawrence/pacmir/localmir"
+	"github.com/james-lawrence/pacmir/pdex"
+
+	"github.com/stretchr/testify/require"
+)
+
+// mirror serves the contents answering range requests, the bytes served are recorded.
+type mirror struct {
+	contents []byte
+	// bps limits the bytes written per second, zero is unlimited.
+	bps    int
+	served int64
+	// ranges false ignores range requests.
+	ranges bool
+	down   bool
+	// stall stops writing once the bytes were served, until the request is cancelled.
+	stall int64
+}
+
+func (t *mirror) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	if t.down {
+		resp.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+
+	if !t.ranges {
+		req.Header.Del("Range")
+	}
+
+	http.ServeContent(throttledwriter{ResponseWriter: resp, m: t, ctx: req.Context()}, req, "package", time.Time{}, bytes.NewReader(t.contents))
+}
+
+type throttledwriter struct {
+	http.ResponseWriter
+	m   *mirror
+	ctx context.Context
+}
+
+func (t throttledwriter) Write(b []byte) (n int, err error) {
+	for len(b) > 0 {
+		chunk := b
+		if (t.m.bps > 0 || t.m.stall > 0) && len(chunk) > 4096 {
+			chunk = chunk[:4096]
+		}
+
+		if t.m.stall > 0 && atomic.LoadInt64(&t.m.served) >= t.m.stall {
+			t.ResponseWriter.(http.Flusher).Flush()
+			<-t.ctx.Done()
+			return n, t.ctx.Err()
+		}
+
+		written, err := t.ResponseWriter.Write(chunk)
+		n += written
+		atomic.AddInt64(&t.m.served, int64(written))
+		if err != nil {
+			return n, err
+		}
+
+		if t.m.bps > 0 {
+			time.Sleep(time.Duration(written) * time.Second / time.Duration(t.m.bps))
+		}
+		b = b[written:]
+	}
+
+	return n, nil
+}
+
+func TestSegmented(t *testing.T) {
+	g := testingx.Init(t)
+
+	fetch := func(ctx context.Context, upstream, name string, header http.Header) (*http.Response, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(upstream, "/")+"/"+name, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header = header
+
+		return http.DefaultClient.Do(req)
+	}
+
+	download := func(s Segmented, contents []byte, mirrors ...*mirror) ([]byte, error) {
+		var servers []string
+		for _, m := range mirrors {
+			srv := httptest.NewServer(m)
+			defer srv.Close()
+			servers = append(servers, srv.URL)
+		}
+
+		dst, err := ioutil.TempFile("", "pacmir.segmented.*")
+		require.Nil(t, err)
+		defer os.Remove(dst.Name())
+		defer dst.Close()
+
+		sum := sha256.Sum256(contents)
+		expected := pdex.Package{Filename: "example-1.0-1-x86_64.pkg.tar.zst", Size: int64(len(contents)), SHA256: sum[:]}
+		if err = s.Download(context.Background(), fetch, servers, expected, dst, nil); err != nil {
+			return nil, err
+		}
+
+		return ioutil.ReadFile(dst.Name())
+	}
+
+	contents := make([]byte, 2*1024*1024)
+	rand.New(rand.NewSource(1)).Read(contents)
+
+	g.Describe("Download", func() {
+		g.It("should assemble the package from every mirror", func() {
+			mirrors := []*mirror{
+				{contents: contents, ranges: true, bps: 4 * 1024 * 1024},
+				{contents: contents, ranges: true, bps: 4 * 1024 * 1024},
+				{contents: contents, ranges: true, bps: 4 * 1024 * 1024},
+			}
+
+			assembled, err := download(Segmented{Mirrors: 3, Segment: 256 * 1024}, contents, mirrors...)
+			require.Nil(t, err)
+			require.Equal(t, contents, assembled)
+			for _, m := range mirrors {
+				require.NotZero(t, atomic.LoadInt64(&m.served))
+			}
+		})
+
+		g.It("should only use the preferred mirrors", func() {
+			mirrors := []*mirror{
+				{contents: contents, ranges: true},
+				{contents: contents, ranges: true},
+				{contents: contents, ranges: true},
+			}
+
+			assembled, err := download(Segmented{Mirrors: 2, Segment: 256 * 1024}, contents, mirrors...)
+			require.Nil(t, err)
+			require.Equal(t, contents, assembled)
+			require.Zero(t, atomic.LoadInt64(&mirrors[2].served))
+		})
+
+		g.It("should rebalance ranges away from slow mirrors", func() {
+			slow := &mirror{contents: contents, ranges: true, bps: 256 * 1024}
+			fast := &mirror{contents: contents, ranges: true}
+
+			started := time.Now()
+			// the slow mirror alone would take 8 seconds.
+			assembled, err := download(Segmented{Mirrors: 2, Segment: 1024 * 1024}, contents, slow, fast)
+			require.Nil(t, err)
+			require.Equal(t, contents, assembled)
+			require.True(t, time.Since(started) < 4*time.Second)
+			require.True(t, atomic.LoadInt64(&fast.served) > atomic.LoadInt64(&slow.served))
+		})
+
+		g.It("should retry the ranges of stalled mirrors", func() {
+			stalled := &mirror{contents: contents, ranges: true, stall: 64 * 1024}
+			fast := &mirror{contents: contents, ranges: true}
+
+			started := time.Now()
+			// the stalled mirror keeps a range too small to split, without the stall
+			// deadline the download never completes.
+			assembled, err := download(Segmented{Mirrors: 2, Segment: 1024 * 1024, Stall: 200 * time.Millisecond}, contents, stalled, fast)
+			require.Nil(t, err)
+			require.Equal(t, contents, assembled)
+			require.True(t, time.Since(started) < 2*time.Second)
+		})
+
+		g.It("should retry the ranges of failing mirrors", func() {
+			assembled, err := download(
+				Segmented{Mirrors: 2, Segment: 256 * 1024},
+				contents,
+				&mirror{down: true},
+				&mirror{contents: contents, ranges: true},
+			)
+			require.Nil(t, err)
+			require.Equal(t, contents, assembled)
+		})
+
+		g.It("should fail when every mirror fails", func() {
+			_, err := download(
+				Segmented{Mirrors: 2, Segment: 256 * 1024},
+				contents,
+				&mirror{down: true},
+				&mirror{contents: contents},
+			)
+			require.NotNil(t, err)
+			require.Contains(t, err.Error(), "503 Service Unavailable")
+			require.Contains(t, err.Error(), "range requests are not supported")
+		})
+
+		g.It("should reject packages that don't match the sync database", func() {
+			corrupted := append([]byte(nil), contents...)
+			corrupted[len(corrupted)-1]++
+
+			_, err := download(Segmented{Mirrors: 2, Segment: 256 * 1024}, contents, &mirror{contents: corrupted, ranges: true})
+			require.NotNil(t, err)
+			require.Contains(t, err.Error(), "sha256 mismatch")
+		})
+	})
+}
@@ -0,0 +1,151 @@
+package localmir
+
+import (
+	"crypto"
+	_ "crypto/sha1" // register hash algorithms used by signatures.
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+
+	"github.com/pkg/errors"
+)
+
+// openpgp hash algorithm identifiers.
+var hashes = map[byte]crypto.Hash{
+	2:  crypto.SHA1,
+	8:  crypto.SHA256,
+	9:  crypto.SHA384,
+	10: crypto.SHA512,
+	11: crypto.SHA224,
+}
+
+// signed ensures the detached openpgp signature was made over the data by comparing the
+// hash prefix stored within the signature. the signature itself is verified by pacman
+// against its keyring, this only guarantees the database and signature belong together.
+func signed(data io.Reader, sig io.Reader) (err error) {
+	var (
+		raw    []byte
+		body   []byte
+		hashed []byte
+		suffix []byte
+		tag    []byte
+		algo   byte
+	)
+
+	if raw, err = ioutil.ReadAll(io.LimitReader(sig, 64*1024)); err != nil {
+		return errors.WithStack(err)
+	}
+
+	if body, err = signaturepacket(raw); err != nil {
+		return err
+	}
+
+	switch body[0] {
+	case 3:
+		// version, hashed length (5), type, creation time, key id, public key algorithm, hash algorithm, hash prefix.
+		if len(body) < 19 || body[1] != 5 {
+			return errors.New("malformed v3 signature")
+		}
+		hashed, algo, tag = body[2:7], body[16], body[17:19]
+		suffix = hashed
+	case 4:
+		// version, type, public key algorithm, hash algorithm, hashed subpackets, unhashed subpackets, hash prefix.
+		if len(body) < 6 {
+			return errors.New("malformed v4 signature")
+		}
+		algo = body[3]
+		n := 6 + int(binary.BigEndian.Uint16(body[4:6]))
+		if len(body) < n+2 {
+			return errors.New("malformed v4 signature")
+		}
+		hashed = body[:n]
+		u := n + 2 + int(binary.BigEndian.Uint16(body[n:n+2]))
+		if len(body) < u+2 {
+			return errors.New("malformed v4 signature")
+		}
+		tag = body[u : u+2]
+
+		trailer := make([]byte, 6)
+		trailer[0], trailer[1] = 4, 0xff
+		binary.BigEndian.PutUint32(trailer[2:], uint32(len(hashed)))
+		suffix = append(append([]byte(nil), hashed...), trailer...)
+	default:
+		return errors.Errorf("unsupported signature version %d", body[0])
+	}
+
+	h, ok := hashes[algo]
+	if !ok || !h.Available() {
+		return errors.Errorf("unsupported signature hash algorithm %d", algo)
+	}
+
+	digest := h.New()
+	if _, err = io.Copy(digest, data); err != nil {
+		return errors.WithStack(err)
+	}
+	digest.Write(suffix)
+
+	if sum := digest.Sum(nil); sum[0] != tag[0] || sum[1] != tag[1] {
+		return errors.New("signature does not match the database")
+	}
+
+	return nil
+}
+
+// signaturepacket returns the body of the first openpgp packet, which must be a signature.
+func signaturepacket(raw []byte) (body []byte, err error) {
+	var (
+		tag    byte
+		length int
+		offset int
+	)
+
+	if len(raw) < 2 || raw[0]&0x80 == 0 {
+		return nil, errors.New("malformed signature packet")
+	}
+
+	if raw[0]&0x40 != 0 {
+		// new format packet.
+		tag = raw[0] & 0x3f
+		switch o := raw[1]; {
+		case o < 192:
+			length, offset = int(o), 2
+		case o < 224 && len(raw) > 2:
+			length, offset = (int(o)-192)<<8+int(raw[2])+192, 3
+		case o == 255 && len(raw) > 5:
+			length, offset = int(binary.BigEndian.Uint32(raw[2:6])), 6
+		default:
+			return nil, errors.New("unsupported signature packet length")
+		}
+	} else {
+		// old format packet.
+		tag = (raw[0] >> 2) & 0x0f
+		switch raw[0] & 0x03 {
+		case 0:
+			length, offset = int(raw[1]), 2
+		case 1:
+			if len(raw) < 3 {
+				return nil, errors.New("malformed signature packet")
+			}
+			length, offset = int(binary.BigEndian.Uint16(raw[1:3])), 3
+		case 2:
+			if len(raw) < 5 {
+				return nil, errors.New("malformed signature packet")
+			}
+			length, offset = int(binary.BigEndian.Uint32(raw[1:5])), 5
+		default:
+			length, offset = len(raw)-1, 1
+		}
+	}
+
+	if tag != 2 {
+		return nil, errors.Errorf("expected a signature packet, found %d", tag)
+	}
+
+	if length < 1 || offset+length > len(raw) {
+		return nil, errors.New("truncated signature packet")
+	}
+
+	return raw[offset : offset+length], nil
+}
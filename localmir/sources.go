@@ -0,0 +1,199 @@
+package localmir
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/james-lawrence/pacmir/config"
+	"github.com/pkg/errors"
+)
+
+// PeerHeader identifies requests from LAN peers, peers are only served from local sources.
+const PeerHeader = "X-Pacmir-Peer"
+
+// SourceHeader reports the source that served the package.
+const SourceHeader = "X-Pacmir-Source"
+
+// UnverifiedHeader marks packages served without verifying them against the sync database.
+const UnverifiedHeader = "X-Pacmir-Unverified"
+
+// Source of packages, i.e.) the local cache, LAN peers or the upstream mirrors.
+type Source interface {
+	// Package retrieves the package, the context bounds the retrieval.
+	Package(ctx context.Context, repo, arch, name string) (io.ReadCloser, error)
+}
+
+// Link a source within a chain and the limits of its use.
+type Link struct {
+	Name   string
+	Source Source
+	// Disabled links are never consulted.
+	Disabled bool
+	// Timeout how long the source has to provide the package, zero is unlimited.
+	Timeout time.Duration
+	// MinSize packages smaller than the minimum are never retrieved from the source.
+	MinSize int64
+	// MaxSize packages larger than the maximum are never retrieved from the source, zero is unlimited.
+	MaxSize int64
+	// Local sources are cheap to consult, they answer requests from peers as well as
+	// head and range requests.
+	Local bool
+	// Trusted sources verify packages themselves, i.e.) the mirrors.
+	Trusted bool
+}
+
+// accepts returns true if the link is consulted for packages of the size, negative sizes are unknown.
+func (t Link) accepts(size int64) bool {
+	if t.Disabled {
+		return false
+	}
+
+	if size < 0 {
+		return true
+	}
+
+	return size >= t.MinSize && (t.MaxSize == 0 || size <= t.MaxSize)
+}
+
+// Chain of sources consulted in order, the first source to provide the package serves it.
+type Chain []Link
+
+// NewChain builds the chain from the configured sources, the registry provides the
+// sources by name. links without a source are skipped, unknown sources are an error.
+func NewChain(configured []config.Source, registry map[string]Link) (chain Chain, err error) {
+	for _, s := range configured {
+		l, ok := registry[s.Name]
+		if !ok {
+			return nil, errors.Errorf("unknown source: %s", s.Name)
+		}
+
+		if l.Source == nil {
+			continue
+		}
+
+		l.Name = s.Name
+		l.Disabled = s.Disabled
+		l.Timeout = s.Timeout
+		l.MinSize = int64(s.MinSize)
+		l.MaxSize = int64(s.MaxSize)
+		chain = append(chain, l)
+	}
+
+	return chain, nil
+}
+
+// ordered returns the links in the order of the names, every link when no names are provided.
+func (t Chain) ordered(names []string) Chain {
+	if len(names) == 0 {
+		return t
+	}
+
+	ordered := make(Chain, 0, len(names))
+	for _, n := range names {
+		for _, l := range t {
+			if l.Name == n {
+				ordered = append(ordered, l)
+			}
+		}
+	}
+
+	return ordered
+}
+
+// partition the chain into its local and remote links.
+func (t Chain) partition() (local, remote Chain) {
+	for _, l := range t {
+		if l.Local {
+			local = append(local, l)
+		} else {
+			remote = append(remote, l)
+		}
+	}
+
+	return local, remote
+}
+
+// Local serves packages from the inventoried caches, i.e.) pacman's cache directories and
+// pacmir's package cache.
+type Local struct {
+	Inventory *Inventory
+}
+
+// Package opens the cached package.
+func (t Local) Package(ctx context.Context, repo, arch, name string) (io.ReadCloser, error) {
+	c, ok := t.Inventory.Lookup(name)
+	if !ok {
+		return nil, errors.New("package not found")
+	}
+
+	return os.Open(c.Path)
+}
+
+// Peers retrieves packages from the pacmir daemons of LAN peers.
+type Peers struct {
+	Addresses []string
+	// Client used to request packages, defaults to http.DefaultClient.
+	Client *http.Client
+}
+
+// Package retrieves the package from the first peer that has it.
+func (t Peers) Package(ctx context.Context, repo, arch, name string) (_ io.ReadCloser, err error) {
+	var (
+		attempts []attempt
+		resp     *http.Response
+		client   = t.Client
+	)
+
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	for _, addr := range t.Addresses {
+		if resp, err = t.request(ctx, client, addr, repo, arch, name); err != nil {
+			attempts = append(attempts, attempt{upstream: addr, err: err})
+			continue
+		}
+
+		if resp.StatusCode != http.StatusOK {
+			attempts = append(attempts, attempt{upstream: addr, err: unexpected(resp)})
+			resp.Body.Close()
+			continue
+		}
+
+		return peerbody{ReadCloser: resp.Body, peer: addr}, nil
+	}
+
+	return nil, failure{name: name, attempts: attempts}
+}
+
+func (t Peers) request(ctx context.Context, client *http.Client, addr, repo, arch, name string) (_ *http.Response, err error) {
+	var (
+		req *http.Request
+	)
+
+	if !strings.Contains(addr, "://") {
+		addr = "http://" + addr
+	}
+
+	if req, err = http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(addr, "/")+"/"+repo+"/os/"+arch+"/"+name, nil); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	req.Header.Set(PeerHeader, "true")
+
+	resp, err := client.Do(req)
+	return resp, errors.WithStack(err)
+}
+
+// peerbody the package as served by a peer.
+type peerbody struct {
+	io.ReadCloser
+	peer string
+}
+
+func (t peerbody) Origin() string {
+	return "peer " + t.peer
+}
@@ -0,0 +1,217 @@
+package localmir_test
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/james-lawrence/pacmir/config"
+	"github.com/james-lawrence/pacmir/internal/testingx"
+	. "github.com/james-lawrence/pacmir/localmir"
+	"github.com/justinas/alice"
+
+	"github.com/stretchr/testify/require"
+)
+
+// contents serves the same contents for every package.
+type contents string
+
+func (t contents) Package(ctx context.Context, repo, arch, name string) (io.ReadCloser, error) {
+	return ioutil.NopCloser(strings.NewReader(string(t))), nil
+}
+
+// blocked never provides the package, it waits until the retrieval is cancelled.
+type blocked struct{}
+
+func (blocked) Package(ctx context.Context, repo, arch, name string) (io.ReadCloser, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestSources(t *testing.T) {
+	g := testingx.Init(t)
+
+	const pkgname = "example-1.0-1-x86_64.pkg.tar.zst"
+
+	fallback := http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		resp.Write([]byte("fallback contents"))
+	})
+
+	serve := func(d Download) *httptest.Server {
+		router := mux.NewRouter()
+		d.Bind(alice.New(), router.PathPrefix("/{repo}/os/{arch}").Subrouter())
+		return httptest.NewServer(router)
+	}
+
+	get := func(url string, header http.Header) (*http.Response, string) {
+		req, err := http.NewRequest(http.MethodGet, url, nil)
+		require.Nil(t, err)
+		for k, v := range header {
+			req.Header[k] = v
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		require.Nil(t, err)
+		defer resp.Body.Close()
+
+		body, err := ioutil.ReadAll(resp.Body)
+		require.Nil(t, err)
+
+		return resp, string(body)
+	}
+
+	g.Describe("Chain", func() {
+		g.It("should serve the package from the first source providing it", func() {
+			dir, err := ioutil.TempDir("", "pacmir.sources.*")
+			require.Nil(t, err)
+			defer os.RemoveAll(dir)
+
+			local := serve(Download{
+				Sources: Chain{
+					{Name: "local", Source: dirpackages(dir), Local: true},
+					{Name: "peers", Source: contents("peer contents")},
+					{Name: "swarm", Source: contents("swarm contents")},
+				},
+				Fallback: fallback,
+			})
+			defer local.Close()
+
+			resp, body := get(local.URL+"/core/os/x86_64/"+pkgname, nil)
+			require.Equal(t, "peer contents", body)
+			require.Equal(t, "peers", resp.Header.Get(SourceHeader))
+
+			require.Nil(t, ioutil.WriteFile(filepath.Join(dir, pkgname), []byte("local contents"), 0600))
+			resp, body = get(local.URL+"/core/os/x86_64/"+pkgname, nil)
+			require.Equal(t, "local contents", body)
+			require.Equal(t, "local", resp.Header.Get(SourceHeader))
+		})
+
+		g.It("should skip disabled sources and packages outside the size limits", func() {
+			local := serve(Download{
+				Sources: Chain{
+					{Name: "disabled", Source: contents("package contents"), Disabled: true},
+					{Name: "small", Source: contents("package contents"), MaxSize: 8},
+					{Name: "large", Source: contents("package contents"), MinSize: 8},
+				},
+				Fallback:  fallback,
+				Integrity: NewIntegrity(checksums("package contents"), time.Hour),
+			})
+			defer local.Close()
+
+			resp, body := get(local.URL+"/core/os/x86_64/"+pkgname, nil)
+			require.Equal(t, "package contents", body)
+			require.Equal(t, "large", resp.Header.Get(SourceHeader))
+		})
+
+		g.It("should skip sources that exceed their timeout", func() {
+			local := serve(Download{
+				Sources: Chain{
+					{Name: "swarm", Source: blocked{}, Timeout: 100 * time.Millisecond},
+					{Name: "mirror", Source: contents("mirror contents")},
+				},
+				Fallback: fallback,
+			})
+			defer local.Close()
+
+			resp, body := get(local.URL+"/core/os/x86_64/"+pkgname, nil)
+			require.Equal(t, "mirror contents", body)
+			require.Equal(t, "mirror", resp.Header.Get(SourceHeader))
+		})
+
+		g.It("should follow the repository's source order", func() {
+			local := serve(Download{
+				Sources: Chain{
+					{Name: "peers", Source: contents("peer contents")},
+					{Name: "mirror", Source: contents("mirror contents")},
+				},
+				Overrides: map[string]config.Repository{
+					"testing": {Sources: []string{"mirror"}},
+				},
+				Fallback: fallback,
+			})
+			defer local.Close()
+
+			_, body := get(local.URL+"/core/os/x86_64/"+pkgname, nil)
+			require.Equal(t, "peer contents", body)
+			_, body = get(local.URL+"/testing/os/x86_64/"+pkgname, nil)
+			require.Equal(t, "mirror contents", body)
+		})
+
+		g.It("should report the fallback when no source provides the package", func() {
+			local := serve(Download{Fallback: fallback})
+			defer local.Close()
+
+			resp, body := get(local.URL+"/core/os/x86_64/"+pkgname, nil)
+			require.Equal(t, "fallback contents", body)
+			require.Equal(t, "fallback", resp.Header.Get(SourceHeader))
+		})
+	})
+
+	g.Describe("Peers", func() {
+		g.It("should retrieve packages from the local sources of peers", func() {
+			dir, err := ioutil.TempDir("", "pacmir.sources.*")
+			require.Nil(t, err)
+			defer os.RemoveAll(dir)
+			require.Nil(t, ioutil.WriteFile(filepath.Join(dir, pkgname), []byte("package contents"), 0600))
+
+			peer := serve(Download{
+				Sources: Chain{
+					{Name: "local", Source: dirpackages(dir), Local: true},
+					{Name: "mirror", Source: contents("mirror contents")},
+				},
+				Fallback: fallback,
+			})
+			defer peer.Close()
+
+			local := serve(Download{
+				Sources:  Chain{{Name: "peers", Source: Peers{Addresses: []string{strings.TrimPrefix(peer.URL, "http://")}}}},
+				Fallback: fallback,
+			})
+			defer local.Close()
+
+			resp, body := get(local.URL+"/core/os/x86_64/"+pkgname, nil)
+			require.Equal(t, "package contents", body)
+			require.Equal(t, "peers", resp.Header.Get(SourceHeader))
+
+			// peers only consult their local sources on behalf of another peer.
+			resp, _ = get(local.URL+"/core/os/x86_64/missing-1.0-1-x86_64.pkg.tar.zst", nil)
+			require.Equal(t, "fallback", resp.Header.Get(SourceHeader))
+			resp, _ = get(peer.URL+"/core/os/x86_64/missing-1.0-1-x86_64.pkg.tar.zst", http.Header{PeerHeader: []string{"true"}})
+			require.Equal(t, http.StatusNotFound, resp.StatusCode)
+		})
+	})
+
+	g.Describe("NewChain", func() {
+		registry := map[string]Link{
+			"local":  {Source: contents("local contents"), Local: true},
+			"mirror": {Source: contents("mirror contents"), Trusted: true},
+			"swarm":  {},
+		}
+
+		g.It("should apply the configured options in order", func() {
+			chain, err := NewChain([]config.Source{
+				{Name: "mirror", Timeout: time.Second, MaxSize: 1024},
+				{Name: "swarm"},
+				{Name: "local", Disabled: true},
+			}, registry)
+			require.Nil(t, err)
+			require.Len(t, chain, 2)
+			require.Equal(t, Link{Name: "mirror", Source: contents("mirror contents"), Timeout: time.Second, MaxSize: 1024, Trusted: true}, chain[0])
+			require.Equal(t, Link{Name: "local", Source: contents("local contents"), Disabled: true, Local: true}, chain[1])
+		})
+
+		g.It("should reject unknown sources", func() {
+			_, err := NewChain([]config.Source{{Name: "torrent"}}, registry)
+			require.NotNil(t, err)
+			require.Contains(t, err.Error(), "unknown source: torrent")
+		})
+	})
+}
@@ -0,0 +1,97 @@
+package localmir
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/james-lawrence/pacmir/mirrors"
+	"github.com/justinas/alice"
+	"github.com/pkg/errors"
+)
+
+// Status reports the state of the daemon.
+type Status struct {
+	Ranking   *mirrors.Ranker
+	Staleness mirrors.Staleness
+	Breaker   *mirrors.Breaker
+	// Inventory of the locally cached packages, optional.
+	Inventory *Inventory
+	// Integrity of each pacman configuration, optional.
+	Integrity []*Integrity
+}
+
+// StatusMirror the status of a single upstream mirror.
+type StatusMirror struct {
+	mirrors.Freshness
+	Score mirrors.Score `json:"score"`
+	// Open the mirror's circuit is open, it is skipped until the retry elapses.
+	Open  bool          `json:"open"`
+	Retry time.Duration `json:"retry,omitempty"`
+}
+
+// StatusCache the packages available from the local caches.
+type StatusCache struct {
+	Packages int   `json:"packages"`
+	Size     int64 `json:"size"`
+}
+
+// StatusIntegrity the verification of packages against the sync databases.
+type StatusIntegrity struct {
+	// Unverified packages served without verification, their sync database couldn't be resolved.
+	Unverified uint64 `json:"unverified"`
+}
+
+// StatusResponse the daemon status.
+type StatusResponse struct {
+	Mirrors   []StatusMirror   `json:"mirrors"`
+	Cache     *StatusCache     `json:"cache,omitempty"`
+	Integrity *StatusIntegrity `json:"integrity,omitempty"`
+}
+
+// Bind to a router
+func (t Status) Bind(c alice.Chain, r *mux.Router) {
+	r.Handle("/_pacmir/status", c.ThenFunc(t.Status)).Methods(http.MethodGet)
+}
+
+// Status handler
+func (t Status) Status(resp http.ResponseWriter, req *http.Request) {
+	status := StatusResponse{
+		Mirrors: []StatusMirror{},
+	}
+
+	open := map[string]time.Duration{}
+	if t.Breaker != nil {
+		open = t.Breaker.Open()
+	}
+
+	if t.Ranking != nil {
+		for _, f := range t.Ranking.Freshnesses(t.Staleness) {
+			score, _ := t.Ranking.Score(f.Root)
+			retry, isopen := open[f.Root]
+			status.Mirrors = append(status.Mirrors, StatusMirror{Freshness: f, Score: score, Open: isopen, Retry: retry})
+		}
+	}
+
+	if t.Inventory != nil {
+		status.Cache = &StatusCache{}
+		for _, c := range t.Inventory.Packages() {
+			status.Cache.Packages++
+			status.Cache.Size += c.Size
+		}
+	}
+
+	if len(t.Integrity) > 0 {
+		status.Integrity = &StatusIntegrity{}
+		for _, i := range t.Integrity {
+			status.Integrity.Unverified += i.Unverified()
+		}
+	}
+
+	resp.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(resp).Encode(status); err != nil {
+		log.Println(errors.Wrap(err, "failed to write status"))
+	}
+}
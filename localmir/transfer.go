@@ -0,0 +1,216 @@
+package localmir
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// transfers coalesces concurrent downloads of the same package. a single upstream
+// transfer is written to the cache and every client streams from the partially
+// written file as the bytes arrive. the transfer is cancelled once every client detached.
+type transfers struct {
+	m        *sync.Mutex
+	inflight map[string]*transfer
+}
+
+// join the transfer of the key, creating it when none is in flight. returns a
+// reader over the transfer and true if the caller must perform the transfer.
+func (t *transfers) join(key string, cache *PackageCache, name string) (x *transfer, r *follower, leader bool, err error) {
+	var (
+		f *os.File
+	)
+
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	x, ok := t.inflight[key]
+	if !ok {
+		var cached *tee
+		if cached, err = cache.Tee(name); err != nil {
+			return nil, nil, false, err
+		}
+
+		x = &transfer{
+			tee:   cached,
+			ready: make(chan struct{}),
+			cond:  sync.NewCond(&sync.Mutex{}),
+		}
+		x.ctx, x.cancel = context.WithCancel(context.Background())
+	}
+
+	// the file is opened while holding the lock, the transfer is released before
+	// the file is moved into place.
+	if f, err = os.Open(x.tee.dst.Name()); err != nil {
+		if !ok {
+			x.cancel()
+			x.tee.Abort()
+		}
+		return nil, nil, false, errors.WithStack(err)
+	}
+
+	if !ok {
+		t.inflight[key] = x
+	}
+	x.followers++
+
+	return x, &follower{x: x, f: f, detach: func() { t.detach(key, x) }}, !ok, nil
+}
+
+// release the key of the transfer, later requests start a new transfer.
+func (t *transfers) release(key string, x *transfer) {
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	if t.inflight[key] == x {
+		delete(t.inflight, key)
+	}
+}
+
+// detach a follower from the transfer, the last follower to detach cancels the transfer.
+// once released cancelling has no effect on the completed transfer.
+func (t *transfers) detach(key string, x *transfer) {
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	if x.followers--; x.followers > 0 {
+		return
+	}
+
+	// nobody is waiting for the package, later requests start a new transfer.
+	if t.inflight[key] == x {
+		delete(t.inflight, key)
+	}
+
+	x.cancel()
+}
+
+// transfer of a package from upstream into the cache.
+type transfer struct {
+	tee     *tee
+	ready   chan struct{}
+	started sync.Once
+	// cancelled once every client detached, followers guarded by the transfers lock.
+	ctx       context.Context
+	cancel    context.CancelFunc
+	followers int
+	// upstream response, or the reason it failed, available once ready.
+	status int
+	header http.Header
+	err    error
+
+	cond    *sync.Cond
+	written int64
+	done    bool
+	failed  error
+}
+
+// start publishes the upstream response, or the failure to retrieve it, to the clients.
+// only the first response is published.
+func (t *transfer) start(status int, header http.Header, err error) {
+	t.started.Do(func() {
+		t.status, t.header, t.err = status, header, err
+		close(t.ready)
+	})
+}
+
+func (t *transfer) Write(b []byte) (n int, err error) {
+	n, err = t.tee.Write(b)
+
+	t.cond.L.Lock()
+	t.written += int64(n)
+	t.cond.L.Unlock()
+	t.cond.Broadcast()
+
+	return n, err
+}
+
+// progress publishes bytes written to the file out of order, clients read up to n.
+func (t *transfer) progress(n int64) {
+	t.cond.L.Lock()
+	if n > t.written {
+		t.written = n
+	}
+	t.cond.L.Unlock()
+	t.cond.Broadcast()
+}
+
+// finish the transfer, clients read the remaining bytes and then observe the error.
+func (t *transfer) finish(err error) {
+	t.cond.L.Lock()
+	t.done, t.failed = true, err
+	t.cond.L.Unlock()
+	t.cond.Broadcast()
+}
+
+// follower reads the partially written file, blocking until more bytes are written
+// or the transfer finishes.
+type follower struct {
+	x      *transfer
+	f      *os.File
+	offset int64
+	detach func()
+	once   sync.Once
+	// closed guarded by the transfer's lock, wakes blocked reads.
+	closed bool
+}
+
+func (t *follower) Read(b []byte) (n int, err error) {
+	t.x.cond.L.Lock()
+	for t.offset >= t.x.written && !t.x.done && !t.closed {
+		t.x.cond.Wait()
+	}
+	written, failed, closed := t.x.written, t.x.failed, t.closed
+	t.x.cond.L.Unlock()
+
+	if closed {
+		return 0, os.ErrClosed
+	}
+
+	if t.offset >= written {
+		if failed != nil {
+			return 0, failed
+		}
+
+		return 0, io.EOF
+	}
+
+	if remaining := written - t.offset; int64(len(b)) > remaining {
+		b = b[:remaining]
+	}
+
+	n, err = t.f.ReadAt(b, t.offset)
+	t.offset += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+
+	return n, err
+}
+
+// until closes the follower once the context is done, interrupting blocked reads.
+func (t *follower) until(ctx context.Context) {
+	go func() {
+		<-ctx.Done()
+		t.Close()
+	}()
+}
+
+// Close detaches the follower from the transfer.
+func (t *follower) Close() (err error) {
+	t.once.Do(func() {
+		t.x.cond.L.Lock()
+		t.closed = true
+		t.x.cond.L.Unlock()
+		t.x.cond.Broadcast()
+
+		t.detach()
+		err = t.f.Close()
+	})
+
+	return err
+}
@@ -0,0 +1,118 @@
+package mirrors
+
+import (
+	"sync"
+	"time"
+)
+
+// NewBreaker opens a mirror's circuit after the given number of consecutive failures,
+// skipping the mirror for the cooldown.
+func NewBreaker(failures int, cooldown time.Duration) *Breaker {
+	return &Breaker{
+		m:        &sync.Mutex{},
+		failures: failures,
+		cooldown: cooldown,
+		circuits: map[string]*circuit{},
+	}
+}
+
+// Breaker per mirror circuit breaker. once the cooldown of an open circuit elapses
+// a single request is allowed through, closing the circuit on success and reopening
+// it on failure.
+type Breaker struct {
+	m        *sync.Mutex
+	failures int
+	cooldown time.Duration
+	circuits map[string]*circuit
+}
+
+type circuit struct {
+	failures int
+	until    time.Time
+	// trial request is in flight for a circuit whose cooldown elapsed.
+	trial bool
+}
+
+// Allow returns true if requests to the server are allowed, otherwise returns
+// the duration until the circuit will allow a trial request.
+func (t *Breaker) Allow(server string) (bool, time.Duration) {
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	c, ok := t.circuits[Root(server)]
+	if !ok || c.until.IsZero() {
+		return true, 0
+	}
+
+	if remaining := time.Until(c.until); remaining > 0 {
+		return false, remaining
+	}
+
+	if c.trial {
+		return false, t.cooldown
+	}
+
+	c.trial = true
+
+	return true, 0
+}
+
+// Success closes the circuit of the server.
+func (t *Breaker) Success(server string) {
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	delete(t.circuits, Root(server))
+}
+
+// Abandoned records a request to the server that was cancelled before it completed,
+// the request is neither a success nor a failure. an abandoned trial request allows another.
+func (t *Breaker) Abandoned(server string) {
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	if c, ok := t.circuits[Root(server)]; ok {
+		c.trial = false
+	}
+}
+
+// Failure records a failed request to the server, opening its circuit when
+// the consecutive failures reach the threshold.
+func (t *Breaker) Failure(server string) {
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	c, ok := t.circuits[Root(server)]
+	if !ok {
+		c = &circuit{}
+		t.circuits[Root(server)] = c
+	}
+
+	c.failures++
+	c.trial = false
+	if c.failures >= t.failures {
+		c.until = time.Now().Add(t.cooldown)
+	}
+}
+
+// Open returns the mirrors with an open circuit and the time until they allow a trial request.
+func (t *Breaker) Open() map[string]time.Duration {
+	open := map[string]time.Duration{}
+
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	for root, c := range t.circuits {
+		if c.until.IsZero() {
+			continue
+		}
+
+		remaining := time.Until(c.until)
+		if remaining < 0 {
+			remaining = 0
+		}
+		open[root] = remaining
+	}
+
+	return open
+}
@@ -0,0 +1,77 @@
+package mirrors_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/james-lawrence/pacmir/internal/testingx"
+	. "github.com/james-lawrence/pacmir/mirrors"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBreaker(t *testing.T) {
+	g := testingx.Init(t)
+
+	const server = "https://example.com/archlinux/core/os/x86_64"
+
+	g.Describe("Allow", func() {
+		g.It("should open after consecutive failures", func() {
+			b := NewBreaker(2, time.Hour)
+			b.Failure(server)
+			ok, _ := b.Allow(server)
+			require.True(t, ok)
+
+			b.Failure(server)
+			ok, retry := b.Allow(server)
+			require.False(t, ok)
+			require.True(t, retry > 59*time.Minute)
+
+			// circuits are shared between repositories of the same mirror.
+			ok, _ = b.Allow("https://example.com/archlinux/extra/os/x86_64")
+			require.False(t, ok)
+			require.Contains(t, b.Open(), "https://example.com/archlinux")
+		})
+
+		g.It("should reset on success", func() {
+			b := NewBreaker(2, time.Hour)
+			b.Failure(server)
+			b.Success(server)
+			b.Failure(server)
+			ok, _ := b.Allow(server)
+			require.True(t, ok)
+		})
+
+		g.It("should allow a single trial request after the cooldown", func() {
+			b := NewBreaker(1, 10*time.Millisecond)
+			b.Failure(server)
+			ok, _ := b.Allow(server)
+			require.False(t, ok)
+
+			time.Sleep(20 * time.Millisecond)
+			ok, _ = b.Allow(server)
+			require.True(t, ok)
+			ok, _ = b.Allow(server)
+			require.False(t, ok)
+
+			b.Success(server)
+			ok, _ = b.Allow(server)
+			require.True(t, ok)
+			require.Equal(t, 0, len(b.Open()))
+		})
+
+		g.It("should allow another trial request when the trial was abandoned", func() {
+			b := NewBreaker(1, 10*time.Millisecond)
+			b.Failure(server)
+
+			time.Sleep(20 * time.Millisecond)
+			ok, _ := b.Allow(server)
+			require.True(t, ok)
+
+			b.Abandoned(server)
+			ok, _ = b.Allow(server)
+			require.True(t, ok)
+			require.Equal(t, 1, len(b.Open()))
+		})
+	})
+}
@@ -0,0 +1,337 @@
+package mirrors
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// DefaultStatePath location of the installation state.
+const DefaultStatePath = "/var/lib/pacmir/install.json"
+
+// Installed records the modification made to a single mirrorlist.
+type Installed struct {
+	Path string `json:"path"`
+	// Original contents of the mirrorlist before pacmir modified it.
+	Original []byte `json:"original"`
+	// Digest sha256 of the mirrorlist as written by pacmir.
+	Digest string `json:"digest"`
+	// Created the mirrorlist did not exist before pacmir wrote it.
+	Created bool `json:"created,omitempty"`
+	// Backup created by a previous version of pacmir, the source of the original contents.
+	Backup string `json:"backup,omitempty"`
+}
+
+// State records the changes made to mirrorlists by Install.
+type State struct {
+	Mirrorlists []Installed `json:"mirrorlists"`
+}
+
+func (t *State) lookup(path string) (Installed, bool) {
+	for _, i := range t.Mirrorlists {
+		if i.Path == path {
+			return i, true
+		}
+	}
+
+	return Installed{}, false
+}
+
+func (t *State) record(i Installed) {
+	for idx, existing := range t.Mirrorlists {
+		if existing.Path == i.Path {
+			t.Mirrorlists[idx] = i
+			return
+		}
+	}
+
+	t.Mirrorlists = append(t.Mirrorlists, i)
+}
+
+// LoadState loads the installation state, a missing file is an empty state.
+func LoadState(path string) (s State, err error) {
+	var (
+		raw []byte
+	)
+
+	if raw, err = ioutil.ReadFile(path); os.IsNotExist(err) {
+		return s, nil
+	} else if err != nil {
+		return s, errors.WithStack(err)
+	}
+
+	if err = json.Unmarshal(raw, &s); err != nil {
+		return s, errors.Wrapf(err, "unable to decode state %s", path)
+	}
+
+	return s, nil
+}
+
+// SaveState atomically writes the installation state.
+func SaveState(path string, s State) (err error) {
+	var (
+		encoded []byte
+	)
+
+	if encoded, err = json.MarshalIndent(s, "", "  "); err != nil {
+		return errors.WithStack(err)
+	}
+
+	if err = os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return errors.WithStack(err)
+	}
+
+	return atomicwrite(path, encoded, 0600)
+}
+
+// IsMirrorlist returns true if the list only contains server directives,
+// files with repository sections or options are not mirrorlists.
+func IsMirrorlist(l *List) bool {
+	servers := 0
+	for _, line := range l.Lines {
+		if line.Kind != KindDirective {
+			continue
+		}
+
+		switch {
+		case strings.HasPrefix(line.Directive, "["):
+			return false
+		case line.Directive == "Server" || line.Directive == "CacheServer":
+			servers++
+		}
+	}
+
+	return servers > 0
+}
+
+// Install pacmir's entry into each of the mirrorlists, recording the changes
+// in the state. files which are not mirrorlists are skipped.
+func Install(s *State, e Entry, paths ...string) (err error) {
+	for _, path := range paths {
+		if err = install(s, e, path); err != nil {
+			return errors.Wrapf(err, "unable to install %s", path)
+		}
+	}
+
+	return nil
+}
+
+func install(s *State, e Entry, path string) (err error) {
+	var (
+		raw       []byte
+		list      *List
+		fi        os.FileInfo
+		installed Installed
+	)
+
+	if fi, err = os.Stat(path); err != nil {
+		return err
+	}
+
+	if raw, err = ioutil.ReadFile(path); err != nil {
+		return err
+	}
+
+	if list, err = Parse(bytes.NewReader(raw)); err != nil {
+		return err
+	}
+
+	if !IsMirrorlist(list) {
+		log.Println("skipping", path, "not a mirrorlist")
+		return nil
+	}
+
+	if installed, err = original(s, e, path, raw, list); err != nil {
+		return err
+	}
+
+	list.Insert(e, 0)
+	updated := list.Bytes()
+
+	if !bytes.Equal(raw, updated) {
+		if err = atomicwrite(path, updated, fi.Mode()); err != nil {
+			return err
+		}
+	}
+
+	installed.Digest = digest(updated)
+	s.record(installed)
+
+	return nil
+}
+
+// original determines the contents to restore for the mirrorlist. the original contents
+// are the file without pacmir's entry, which handles files that were modified by a previous
+// version of pacmir. removes pacmir's entry, and entries added by previous versions, from the list.
+func original(s *State, e Entry, path string, raw []byte, list *List) (i Installed, err error) {
+	i = Installed{Path: path, Original: raw}
+	if removed, legacy := list.Remove(), list.RemoveLegacy(e); removed || legacy {
+		i.Original = list.Bytes()
+	}
+
+	prev, ok := s.lookup(path)
+
+	// unchanged since a previous installation, keep the recorded original.
+	if ok && digest(raw) == prev.Digest {
+		i.Original = prev.Original
+		i.Created = prev.Created
+		i.Backup = prev.Backup
+		return i, nil
+	}
+
+	// previous versions of pacmir backed up the mirrorlist before rewriting it,
+	// the backup is the only unmodified copy.
+	backup := path + ".pacmir.backup"
+	if ok {
+		i.Backup = prev.Backup
+	} else if legacy, err := ioutil.ReadFile(backup); err == nil {
+		i.Original = legacy
+		i.Backup = backup
+	} else if !os.IsNotExist(err) {
+		return i, errors.WithStack(err)
+	}
+
+	return i, nil
+}
+
+// Replace the mirrorlist at path with the list including pacmir's entry, recording the
+// previous contents in the state so Uninstall can restore them. the file is created if missing.
+func Replace(s *State, e Entry, path string, l *List) (err error) {
+	var (
+		raw       []byte
+		existing  *List
+		installed = Installed{Path: path, Created: true}
+		mode      = os.FileMode(0644)
+	)
+
+	if fi, err := os.Stat(path); err == nil {
+		mode = fi.Mode()
+
+		if raw, err = ioutil.ReadFile(path); err != nil {
+			return errors.WithStack(err)
+		}
+
+		if existing, err = Parse(bytes.NewReader(raw)); err != nil {
+			return errors.Wrapf(err, "unable to parse %s", path)
+		}
+
+		if installed, err = original(s, e, path, raw, existing); err != nil {
+			return err
+		}
+	} else if !os.IsNotExist(err) {
+		return errors.WithStack(err)
+	}
+
+	l.Insert(e, 0)
+	updated := l.Bytes()
+
+	if err = os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return errors.WithStack(err)
+	}
+
+	if err = atomicwrite(path, updated, mode); err != nil {
+		return errors.Wrapf(err, "unable to write %s", path)
+	}
+
+	installed.Digest = digest(updated)
+	s.record(installed)
+
+	return nil
+}
+
+// Uninstall restores every mirrorlist recorded in the state. mirrorlists that have not
+// changed since installation are restored exactly. mirrorlists that changed since
+// installation (i.e. merging a .pacnew) only have pacmir's entry removed.
+func Uninstall(s *State) (err error) {
+	var (
+		remaining []Installed
+	)
+
+	for _, i := range s.Mirrorlists {
+		if err = uninstall(i); err != nil {
+			remaining = append(remaining, i)
+			log.Println(errors.Wrapf(err, "unable to uninstall %s", i.Path))
+		}
+	}
+
+	s.Mirrorlists = remaining
+
+	if len(remaining) > 0 {
+		return errors.Errorf("unable to uninstall %d mirrorlists", len(remaining))
+	}
+
+	return nil
+}
+
+func uninstall(i Installed) (err error) {
+	var (
+		raw  []byte
+		list *List
+		fi   os.FileInfo
+	)
+
+	if fi, err = os.Stat(i.Path); os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	if raw, err = ioutil.ReadFile(i.Path); err != nil {
+		return err
+	}
+
+	if digest(raw) == i.Digest {
+		if i.Created {
+			return os.Remove(i.Path)
+		}
+
+		if err = atomicwrite(i.Path, i.Original, fi.Mode()); err != nil {
+			return err
+		}
+
+		// the backup of a previous version of pacmir was restored.
+		if i.Backup != "" {
+			if err = os.Remove(i.Backup); err != nil && !os.IsNotExist(err) {
+				return errors.WithStack(err)
+			}
+		}
+
+		return nil
+	}
+
+	if i.Backup != "" {
+		log.Println("mirrorlist changed since installation, leaving the backup of a previous version in place", i.Backup)
+	}
+
+	if list, err = Parse(bytes.NewReader(raw)); err != nil {
+		return err
+	}
+
+	if !list.Remove() {
+		return nil
+	}
+
+	return atomicwrite(i.Path, list.Bytes(), fi.Mode())
+}
+
+func digest(b []byte) string {
+	d := sha256.Sum256(b)
+	return hex.EncodeToString(d[:])
+}
+
+// Paths of the installed mirrorlists.
+func (t State) Paths() (paths []string) {
+	for _, i := range t.Mirrorlists {
+		paths = append(paths, i.Path)
+	}
+
+	return paths
+}
@@ -0,0 +1,303 @@
+package mirrors
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"strings"
+)
+
+// Sentinel comment marking the line immediately after it as managed by pacmir.
+const Sentinel = "# managed by pacmir, do not edit"
+
+// Kind of line within a mirrorlist.
+type Kind int
+
+// line kinds.
+const (
+	KindBlank Kind = iota
+	KindComment
+	KindDirective
+)
+
+// Line within a mirrorlist.
+type Line struct {
+	// Raw text of the line, excluding the line ending. written back verbatim.
+	Raw string
+	// EOL line ending read with the line, written back verbatim. empty uses the
+	// line ending of the file, i.e.) lines added by pacmir.
+	EOL  string
+	Kind Kind
+	// Directive name and value for directive lines. i.e.) Server
+	Directive string
+	Value     string
+}
+
+// Entry a directive within a mirrorlist.
+type Entry struct {
+	Directive string
+	Value     string
+}
+
+// Server entry for the given url.
+func Server(url string) Entry {
+	return Entry{Directive: "Server", Value: url}
+}
+
+func (t Entry) String() string {
+	return t.Directive + " = " + t.Value
+}
+
+func (t Entry) line() Line {
+	return Line{
+		Raw:       t.String(),
+		Kind:      KindDirective,
+		Directive: t.Directive,
+		Value:     t.Value,
+	}
+}
+
+// List a parsed mirrorlist. comments, blank lines and ordering are preserved.
+type List struct {
+	Lines []Line
+	// line ending of the file, the ending of its first line.
+	eol string
+	// whether or not the file ends with a line ending.
+	terminated bool
+}
+
+// Parse a mirrorlist.
+func Parse(r io.Reader) (_ *List, err error) {
+	var (
+		raw []byte
+	)
+
+	if raw, err = ioutil.ReadAll(r); err != nil {
+		return nil, err
+	}
+
+	l := &List{eol: "\n", terminated: true}
+	if len(raw) == 0 {
+		return l, nil
+	}
+
+	if idx := bytes.IndexByte(raw, '\n'); idx > 0 && raw[idx-1] == '\r' {
+		l.eol = "\r\n"
+	}
+
+	text := string(raw)
+	l.terminated = strings.HasSuffix(text, "\n")
+
+	// mixed line endings are preserved, each line retains its own ending.
+	for text != "" {
+		var (
+			line = text
+			eol  string
+		)
+
+		if idx := strings.IndexByte(text, '\n'); idx >= 0 {
+			line, text, eol = text[:idx], text[idx+1:], "\n"
+			if strings.HasSuffix(line, "\r") {
+				line, eol = strings.TrimSuffix(line, "\r"), "\r\n"
+			}
+		} else {
+			text = ""
+		}
+
+		parsed := parseLine(line)
+		parsed.EOL = eol
+		l.Lines = append(l.Lines, parsed)
+	}
+
+	return l, nil
+}
+
+func parseLine(raw string) Line {
+	trimmed := strings.TrimSpace(raw)
+
+	switch {
+	case trimmed == "":
+		return Line{Raw: raw, Kind: KindBlank}
+	case strings.HasPrefix(trimmed, "#"):
+		return Line{Raw: raw, Kind: KindComment}
+	}
+
+	parts := strings.SplitN(trimmed, "=", 2)
+	l := Line{Raw: raw, Kind: KindDirective, Directive: strings.TrimSpace(parts[0])}
+	if len(parts) == 2 {
+		l.Value = strings.TrimSpace(parts[1])
+	}
+
+	return l
+}
+
+// WriteTo writes the mirrorlist to the writer.
+func (t *List) WriteTo(w io.Writer) (int64, error) {
+	var (
+		buf bytes.Buffer
+	)
+
+	for i, l := range t.Lines {
+		eol := l.EOL
+		if eol == "" {
+			eol = t.eol
+		}
+
+		if i == len(t.Lines)-1 && !t.terminated {
+			eol = ""
+		}
+
+		buf.WriteString(l.Raw)
+		buf.WriteString(eol)
+	}
+
+	return buf.WriteTo(w)
+}
+
+// Bytes returns the encoded mirrorlist.
+func (t *List) Bytes() []byte {
+	var (
+		buf bytes.Buffer
+	)
+
+	t.WriteTo(&buf)
+
+	return buf.Bytes()
+}
+
+// Managed returns the index of pacmir's entry.
+func (t *List) Managed() (int, bool) {
+	for i := 1; i < len(t.Lines); i++ {
+		if t.managed(i) {
+			return i, true
+		}
+	}
+
+	return -1, false
+}
+
+func (t *List) managed(i int) bool {
+	return i > 0 &&
+		t.Lines[i].Kind == KindDirective &&
+		strings.TrimSpace(t.Lines[i-1].Raw) == Sentinel
+}
+
+// Entries returns the active directives not managed by pacmir.
+func (t *List) Entries() (entries []Entry) {
+	for i, l := range t.Lines {
+		if l.Kind == KindDirective && !t.managed(i) {
+			entries = append(entries, Entry{Directive: l.Directive, Value: l.Value})
+		}
+	}
+
+	return entries
+}
+
+// Insert pacmir's entry before the directive at the given position, counting only
+// directives not managed by pacmir. positions past the last directive append the
+// entry after the last directive. if the entry already exists it is moved.
+// returns true if the list changed.
+func (t *List) Insert(e Entry, position int) bool {
+	target := t.index(position)
+
+	if i, ok := t.Managed(); ok {
+		existing := t.Lines[i]
+		// already in place.
+		if existing.Directive == e.Directive && existing.Value == e.Value && t.position(i) == t.position(target) {
+			return false
+		}
+
+		t.Remove()
+		target = t.index(position)
+	}
+
+	lines := make([]Line, 0, len(t.Lines)+2)
+	lines = append(lines, t.Lines[:target]...)
+	lines = append(lines, Line{Raw: Sentinel, Kind: KindComment}, e.line())
+	lines = append(lines, t.Lines[target:]...)
+	t.Lines = lines
+
+	return true
+}
+
+// Move pacmir's entry to the given position, see Insert.
+// returns true if the list changed.
+func (t *List) Move(position int) bool {
+	i, ok := t.Managed()
+	if !ok {
+		return false
+	}
+
+	l := t.Lines[i]
+
+	return t.Insert(Entry{Directive: l.Directive, Value: l.Value}, position)
+}
+
+// Remove pacmir's entry. returns true if the list changed.
+func (t *List) Remove() bool {
+	i, ok := t.Managed()
+	if !ok {
+		return false
+	}
+
+	t.Lines = append(t.Lines[:i-1], t.Lines[i+1:]...)
+
+	return true
+}
+
+// RemoveLegacy removes unmanaged directives pointing at the entry's url, i.e.) added by
+// previous versions of pacmir without the sentinel. returns true if the list changed.
+func (t *List) RemoveLegacy(e Entry) bool {
+	lines := make([]Line, 0, len(t.Lines))
+	for i, l := range t.Lines {
+		if l.Kind == KindDirective && !t.managed(i) && l.Value == e.Value {
+			continue
+		}
+
+		lines = append(lines, l)
+	}
+
+	changed := len(lines) != len(t.Lines)
+	t.Lines = lines
+
+	return changed
+}
+
+// index of the line to insert before for the given directive position.
+func (t *List) index(position int) int {
+	var (
+		n    int
+		last = -1
+	)
+
+	for i, l := range t.Lines {
+		if l.Kind != KindDirective || t.managed(i) {
+			continue
+		}
+
+		if n == position {
+			return i
+		}
+
+		n++
+		last = i
+	}
+
+	if last == -1 {
+		return len(t.Lines)
+	}
+
+	return last + 1
+}
+
+// position of the directive at the line index, counting only directives
+// not managed by pacmir that occur before it.
+func (t *List) position(idx int) (n int) {
+	for i := 0; i < idx && i < len(t.Lines); i++ {
+		if t.Lines[i].Kind == KindDirective && !t.managed(i) {
+			n++
+		}
+	}
+
+	return n
+}
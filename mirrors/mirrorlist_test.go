@@ -0,0 +1,293 @@
+package mirrors_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/james-lawrence/pacmir/internal/testingx"
+	. "github.com/james-lawrence/pacmir/mirrors"
+
+	"github.com/stretchr/testify/require"
+)
+
+const example = `##
+## Arch Linux repository mirrorlist
+##
+
+## Worldwide
+#Server = https://geo.mirror.pkgbuild.com/$repo/os/$arch
+Server = https://mirror.rackspace.com/$repo/os/$arch
+
+## Germany
+Server = https://mirror.example.de/$repo/os/$arch
+`
+
+func TestMirrorlist(t *testing.T) {
+	g := testingx.Init(t)
+
+	parse := func(s string) *List {
+		l, err := Parse(strings.NewReader(s))
+		require.Nil(t, err)
+		return l
+	}
+
+	g.Describe("Parse", func() {
+		g.It("should round trip unmodified", func() {
+			require.Equal(t, example, string(parse(example).Bytes()))
+		})
+
+		g.It("should preserve line endings and missing trailing newlines", func() {
+			crlf := strings.ReplaceAll(strings.TrimSuffix(example, "\n"), "\n", "\r\n")
+			require.Equal(t, crlf, string(parse(crlf).Bytes()))
+		})
+
+		g.It("should preserve mixed line endings", func() {
+			mixed := "## Worldwide\r\nServer = https://mirror.rackspace.com/$repo/os/$arch\n\r\nServer = https://mirror.example.de/$repo/os/$arch\n"
+			l := parse(mixed)
+			require.Equal(t, mixed, string(l.Bytes()))
+
+			require.True(t, l.Insert(Server(LocalURL("localhost:4000")), 1))
+			require.Equal(t, strings.Replace(
+				mixed,
+				"\r\nServer = https://mirror.example.de",
+				"\r\n"+Sentinel+"\r\nServer = http://localhost:4000/$repo/os/$arch\r\nServer = https://mirror.example.de",
+				1,
+			), string(l.Bytes()))
+		})
+
+		g.It("should only report active entries", func() {
+			require.Equal(t, []Entry{
+				Server("https://mirror.rackspace.com/$repo/os/$arch"),
+				Server("https://mirror.example.de/$repo/os/$arch"),
+			}, parse(example).Entries())
+		})
+	})
+
+	g.Describe("Insert", func() {
+		g.It("should insert before the first server without touching commented servers", func() {
+			l := parse(example)
+			require.True(t, l.Insert(Server(LocalURL("localhost:4000")), 0))
+
+			expected := strings.Replace(
+				example,
+				"Server = https://mirror.rackspace.com",
+				Sentinel+"\nServer = http://localhost:4000/$repo/os/$arch\nServer = https://mirror.rackspace.com",
+				1,
+			)
+			require.Equal(t, expected, string(l.Bytes()))
+		})
+
+		g.It("should be idempotent", func() {
+			l := parse(example)
+			require.True(t, l.Insert(Server(LocalURL("localhost:4000")), 0))
+			once := string(l.Bytes())
+
+			l = parse(once)
+			require.False(t, l.Insert(Server(LocalURL("localhost:4000")), 0))
+			require.Equal(t, once, string(l.Bytes()))
+		})
+
+		g.It("should replace an outdated entry", func() {
+			l := parse(example)
+			l.Insert(Server(LocalURL("localhost:4000")), 0)
+			require.True(t, l.Insert(Server(LocalURL("localhost:5000")), 0))
+			require.Equal(t, 1, strings.Count(string(l.Bytes()), Sentinel))
+			require.Contains(t, string(l.Bytes()), "localhost:5000")
+			require.NotContains(t, string(l.Bytes()), "localhost:4000")
+		})
+
+		g.It("should append when there are no servers", func() {
+			l := parse("## empty\n")
+			require.True(t, l.Insert(Server(LocalURL("localhost:4000")), 0))
+			require.Equal(t, "## empty\n"+Sentinel+"\nServer = http://localhost:4000/$repo/os/$arch\n", string(l.Bytes()))
+		})
+	})
+
+	g.Describe("Move", func() {
+		g.It("should move the entry before a later server", func() {
+			l := parse(example)
+			l.Insert(Server(LocalURL("localhost:4000")), 0)
+			require.True(t, l.Move(1))
+			require.False(t, l.Move(1))
+
+			i, ok := l.Managed()
+			require.True(t, ok)
+			require.Equal(t, "https://mirror.example.de/$repo/os/$arch", l.Lines[i+1].Value)
+		})
+	})
+
+	g.Describe("Remove", func() {
+		g.It("should restore the original contents", func() {
+			l := parse(example)
+			l.Insert(Server(LocalURL("localhost:4000")), 0)
+			require.True(t, l.Remove())
+			require.False(t, l.Remove())
+			require.Equal(t, example, string(l.Bytes()))
+		})
+	})
+
+	g.Describe("Rewrite", func() {
+		g.It("should only modify the file once", func() {
+			dir, err := ioutil.TempDir("", "pacmir.mirrors.*")
+			require.Nil(t, err)
+			defer os.RemoveAll(dir)
+
+			path := filepath.Join(dir, "mirrorlist")
+			require.Nil(t, ioutil.WriteFile(path, []byte(example), 0644))
+
+			require.Nil(t, Rewrite("localhost:4000", path))
+			once, err := ioutil.ReadFile(path)
+			require.Nil(t, err)
+			require.Contains(t, string(once), LocalURL("localhost:4000"))
+
+			info, err := os.Stat(path)
+			require.Nil(t, err)
+
+			require.Nil(t, Rewrite("localhost:4000", path))
+			twice, err := ioutil.ReadFile(path)
+			require.Nil(t, err)
+			require.True(t, bytes.Equal(once, twice))
+
+			after, err := os.Stat(path)
+			require.Nil(t, err)
+			require.Equal(t, info.ModTime(), after.ModTime())
+		})
+	})
+
+	g.Describe("Install", func() {
+		setup := func() (string, string) {
+			dir, err := ioutil.TempDir("", "pacmir.install.*")
+			require.Nil(t, err)
+
+			path := filepath.Join(dir, "mirrorlist")
+			require.Nil(t, ioutil.WriteFile(path, []byte(example), 0644))
+			return dir, path
+		}
+
+		read := func(path string) string {
+			raw, err := ioutil.ReadFile(path)
+			require.Nil(t, err)
+			return string(raw)
+		}
+
+		g.It("should restore the original exactly", func() {
+			dir, path := setup()
+			defer os.RemoveAll(dir)
+
+			statepath := filepath.Join(dir, "state.json")
+			state := State{}
+			require.Nil(t, Install(&state, Server(LocalURL("localhost:4000")), path))
+			require.Nil(t, Install(&state, Server(LocalURL("localhost:4000")), path))
+			require.Nil(t, SaveState(statepath, state))
+			require.Contains(t, read(path), LocalURL("localhost:4000"))
+
+			state, err := LoadState(statepath)
+			require.Nil(t, err)
+			require.Equal(t, []string{path}, state.Paths())
+
+			require.Nil(t, Uninstall(&state))
+			require.Equal(t, example, read(path))
+			require.Equal(t, 0, len(state.Mirrorlists))
+		})
+
+		g.It("should only remove pacmir's entry when the mirrorlist changed after installation", func() {
+			dir, path := setup()
+			defer os.RemoveAll(dir)
+
+			state := State{}
+			require.Nil(t, Install(&state, Server(LocalURL("localhost:4000")), path))
+
+			// simulate merging a .pacnew
+			merged := strings.Replace(read(path), "## Germany", "## Germany\nServer = https://mirror2.example.de/$repo/os/$arch", 1)
+			require.Nil(t, ioutil.WriteFile(path, []byte(merged), 0644))
+
+			require.Nil(t, Uninstall(&state))
+			require.Equal(t, strings.Replace(example, "## Germany", "## Germany\nServer = https://mirror2.example.de/$repo/os/$arch", 1), read(path))
+		})
+
+		g.It("should restore the backup of a previous version", func() {
+			dir, path := setup()
+			defer os.RemoveAll(dir)
+
+			// previous versions inserted the entry without the sentinel and kept a backup.
+			legacy := strings.Replace(example, "Server = https://mirror.rackspace.com", "Server = "+LocalURL("localhost:4000")+"\nServer = https://mirror.rackspace.com", 1)
+			require.Nil(t, ioutil.WriteFile(path, []byte(legacy), 0644))
+			require.Nil(t, ioutil.WriteFile(path+".pacmir.backup", []byte(example), 0644))
+
+			state := State{}
+			require.Nil(t, Install(&state, Server(LocalURL("localhost:4000")), path))
+			require.Equal(t, 1, strings.Count(read(path), LocalURL("localhost:4000")))
+			require.Contains(t, read(path), Sentinel)
+
+			require.Nil(t, Uninstall(&state))
+			require.Equal(t, example, read(path))
+			_, err := os.Stat(path + ".pacmir.backup")
+			require.True(t, os.IsNotExist(err))
+		})
+
+		g.It("should leave the backup of a previous version when the mirrorlist changed after installation", func() {
+			dir, path := setup()
+			defer os.RemoveAll(dir)
+
+			legacy := strings.Replace(example, "Server = https://mirror.rackspace.com", "Server = "+LocalURL("localhost:4000")+"\nServer = https://mirror.rackspace.com", 1)
+			require.Nil(t, ioutil.WriteFile(path, []byte(legacy), 0644))
+			require.Nil(t, ioutil.WriteFile(path+".pacmir.backup", []byte(example), 0644))
+
+			state := State{}
+			require.Nil(t, Install(&state, Server(LocalURL("localhost:4000")), path))
+
+			merged := strings.Replace(read(path), "## Germany", "## Germany\nServer = https://mirror2.example.de/$repo/os/$arch", 1)
+			require.Nil(t, ioutil.WriteFile(path, []byte(merged), 0644))
+
+			require.Nil(t, Uninstall(&state))
+			require.Equal(t, strings.Replace(example, "## Germany", "## Germany\nServer = https://mirror2.example.de/$repo/os/$arch", 1), read(path))
+			require.Equal(t, example, read(path+".pacmir.backup"))
+		})
+
+		g.It("should remove the entry of a previous version without a backup", func() {
+			dir, path := setup()
+			defer os.RemoveAll(dir)
+
+			legacy := strings.Replace(example, "Server = https://mirror.rackspace.com", "Server = "+LocalURL("localhost:4000")+"\nServer = https://mirror.rackspace.com", 1)
+			require.Nil(t, ioutil.WriteFile(path, []byte(legacy), 0644))
+
+			state := State{}
+			require.Nil(t, Install(&state, Server(LocalURL("localhost:4000")), path))
+			require.Equal(t, 1, strings.Count(read(path), LocalURL("localhost:4000")))
+
+			require.Nil(t, Uninstall(&state))
+			require.Equal(t, example, read(path))
+		})
+
+		g.It("should skip files that are not mirrorlists", func() {
+			dir, path := setup()
+			defer os.RemoveAll(dir)
+
+			conf := "[custom]\nServer = file:///srv/custom\n"
+			require.Nil(t, ioutil.WriteFile(path, []byte(conf), 0644))
+
+			state := State{}
+			require.Nil(t, Install(&state, Server(LocalURL("localhost:4000")), path))
+			require.Equal(t, conf, read(path))
+			require.Equal(t, 0, len(state.Mirrorlists))
+		})
+	})
+
+	g.Describe("ModeFor", func() {
+		g.It("should use CacheServer for pacman 6.1 and later", func() {
+			require.Equal(t, ModeServer, ModeFor(" .--.                  Pacman v6.0.2 - libalpm v13.0.2"))
+			require.Equal(t, ModeCacheServer, ModeFor(" .--.                  Pacman v6.1.0 - libalpm v14.0.0"))
+			require.Equal(t, ModeCacheServer, ModeFor(" .--.                  Pacman v7.0.0 - libalpm v15.0.0"))
+			require.Equal(t, ModeServer, ModeFor("garbage"))
+		})
+
+		g.It("should write the matching entry", func() {
+			require.Equal(t, "CacheServer = http://localhost:4000/$repo/os/$arch", ModeCacheServer.Entry("localhost:4000").String())
+			require.Equal(t, "Server = http://localhost:4000/$repo/os/$arch", ModeServer.Entry("localhost:4000").String())
+		})
+	})
+}
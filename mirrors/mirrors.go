@@ -1,14 +1,12 @@
 package mirrors
 
 import (
-	"bufio"
+	"bytes"
 	"errors"
-	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
-	"strings"
 )
 
 // DetectFirst returns the first file that exists
@@ -26,105 +24,96 @@ func DetectFirst(local string, paths ...string) (_ *os.File, err error) {
 	return nil, errors.New("file does not exist")
 }
 
-// Rewrite the provided mirror file
+// Rewrite the provided mirror file, prepending pacmir's entry.
+// the file is only modified if the entry is missing or out of place.
 func Rewrite(local, path string) (err error) {
 	var (
-		backup  string
-		mirror  *os.File
-		updated *os.File
+		raw  []byte
+		list *List
+		fi   os.FileInfo
 	)
 
-	if backup, err = cloned(path, path+".pacmir.backup"); err != nil {
+	if fi, err = os.Stat(path); err != nil {
 		return err
 	}
 
-	if updated, err = ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".pacmir.*"); err != nil {
+	if raw, err = ioutil.ReadFile(path); err != nil {
 		return err
 	}
-	defer os.Remove(updated.Name())
-	defer updated.Close()
 
-	if mirror, err = os.Open(backup); err != nil {
+	if list, err = Parse(bytes.NewReader(raw)); err != nil {
 		return err
 	}
-	defer mirror.Close()
 
-	if err = Clean(local, mirror, updated); err != nil {
-		return err
-	}
-
-	if err = os.Remove(path); err != nil {
-		return err
+	if !list.Insert(Server(LocalURL(local)), 0) {
+		return nil
 	}
 
-	if _, err = cloned(backup, path); err != nil {
-		return err
-	}
+	return atomicwrite(path, list.Bytes(), fi.Mode())
+}
 
-	return nil
-	// return os.Rename(clonedp, path+".pacmir.foo")
+// LocalURL the server url for pacmir listening on the given address.
+func LocalURL(local string) string {
+	return "http://" + local + "/$repo/os/$arch"
 }
 
-// Clean a mirrorlist file.
+// Clean a mirrorlist file, inserting pacmir's entry before the first server.
+// every other line is written unmodified.
 func Clean(local string, mirror io.Reader, dst io.Writer) (err error) {
 	var (
-		inserted bool
+		list *List
 	)
 
-	scanner := bufio.NewScanner(mirror)
-	for scanner.Scan() {
-		v := scanner.Text()
-		replacement := v
-		if strings.HasPrefix(v, "#Server = ") {
-			replacement = strings.Replace(v, "#Server = ", "Server = ", 1)
-		}
-
-		if !inserted && strings.HasPrefix(v, "Server = ") {
-			inserted = true
-			replacement = "Server = http://" + local + "/$repo/os/$arch\r\n" + replacement
-		}
-
-		if _, err = fmt.Fprintln(dst, replacement); err != nil {
-			return err
-		}
+	if list, err = Parse(mirror); err != nil {
+		return err
 	}
 
-	return nil
+	list.Insert(Server(LocalURL(local)), 0)
+
+	_, err = list.WriteTo(dst)
+	return err
 }
 
-func cloned(path string, backup string) (_ string, err error) {
+// atomicwrite replaces the file at path with the data. the data is written to
+// a temporary file in the same directory, synced and then renamed over the path
+// ensuring readers observe either the old or new contents.
+func atomicwrite(path string, data []byte, mode os.FileMode) (err error) {
 	var (
-		fi     os.FileInfo
-		mirror *os.File
-		dst    *os.File
+		dst *os.File
+		dir *os.File
 	)
 
-	if _, err = os.Stat(backup); err == nil {
-		return backup, nil
+	if dst, err = ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".pacmir.*"); err != nil {
+		return err
 	}
+	defer os.Remove(dst.Name())
+	defer dst.Close()
 
-	if mirror, err = os.Open(path); err != nil {
-		return "", err
+	if err = dst.Chmod(mode); err != nil {
+		return err
 	}
-	defer mirror.Close()
 
-	if fi, err = mirror.Stat(); err != nil {
-		return "", err
+	if _, err = dst.Write(data); err != nil {
+		return err
 	}
 
-	if dst, err = ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".pacmir.clone.*"); err != nil {
-		return "", err
+	if err = dst.Sync(); err != nil {
+		return err
+	}
+
+	if err = dst.Close(); err != nil {
+		return err
 	}
-	defer os.Remove(dst.Name())
-	defer dst.Close()
 
-	if err = os.Chmod(dst.Name(), fi.Mode()); err != nil {
-		return "", err
+	if err = os.Rename(dst.Name(), path); err != nil {
+		return err
 	}
 
-	if _, err = io.Copy(dst, mirror); err != nil {
-		return "", err
+	// sync the directory to persist the rename.
+	if dir, err = os.Open(filepath.Dir(path)); err != nil {
+		return err
 	}
+	defer dir.Close()
 
-	return backup, os.Rename(dst.Name(), backup)
+	return dir.Sync()
 }
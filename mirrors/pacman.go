@@ -0,0 +1,78 @@
+package mirrors
+
+import (
+	"log"
+	"os/exec"
+	"regexp"
+	"strconv"
+
+	"github.com/pkg/errors"
+)
+
+// Mode how pacmir is integrated into the mirrorlists.
+type Mode string
+
+// integration modes.
+const (
+	// ModeAuto detects the mode from the installed pacman version.
+	ModeAuto Mode = "auto"
+	// ModeServer prepends a Server entry, supported by every pacman version.
+	ModeServer Mode = "server"
+	// ModeCacheServer adds a CacheServer entry (pacman >= 6.1). pacman does not
+	// penalize cache servers that fail and never requests databases from them.
+	ModeCacheServer Mode = "cacheserver"
+)
+
+// Entry for pacmir listening on the given address.
+func (t Mode) Entry(local string) Entry {
+	if t == ModeCacheServer {
+		return CacheServer(LocalURL(local))
+	}
+
+	return Server(LocalURL(local))
+}
+
+// Resolve the auto mode using the installed pacman version.
+func (t Mode) Resolve() Mode {
+	switch t {
+	case ModeServer, ModeCacheServer:
+		return t
+	}
+
+	version, err := PacmanVersion()
+	if err != nil {
+		log.Println(errors.Wrap(err, "unable to detect pacman version, defaulting to server mode"))
+		return ModeServer
+	}
+
+	return ModeFor(version)
+}
+
+// CacheServer entry for the given url.
+func CacheServer(url string) Entry {
+	return Entry{Directive: "CacheServer", Value: url}
+}
+
+var versionpattern = regexp.MustCompile(`Pacman v(\d+)\.(\d+)`)
+
+// PacmanVersion returns the output of pacman --version.
+func PacmanVersion() (string, error) {
+	out, err := exec.Command("pacman", "--version").Output()
+	return string(out), errors.WithStack(err)
+}
+
+// ModeFor the output of pacman --version.
+func ModeFor(version string) Mode {
+	matches := versionpattern.FindStringSubmatch(version)
+	if matches == nil {
+		return ModeServer
+	}
+
+	major, _ := strconv.Atoi(matches[1])
+	minor, _ := strconv.Atoi(matches[2])
+	if major > 6 || (major == 6 && minor >= 1) {
+		return ModeCacheServer
+	}
+
+	return ModeServer
+}
@@ -0,0 +1,481 @@
+package mirrors
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// weight of new observations in the moving averages.
+const smoothing = 0.3
+
+// maximum number of mirrors probed concurrently.
+const concurrentprobes = 8
+
+// Score of a single mirror. latency, throughput and error rate are
+// exponentially weighted moving averages of observations.
+type Score struct {
+	Root       string        `json:"root"`
+	Latency    time.Duration `json:"latency"`
+	Throughput float64       `json:"throughput"`
+	ErrorRate  float64       `json:"error_rate"`
+	// LastSync the last time the mirror synced with its upstream, from its lastsync file.
+	LastSync time.Time `json:"last_sync"`
+	// LastUpdate the last time the content of the mirror changed, from its lastupdate file.
+	LastUpdate time.Time `json:"last_update,omitempty"`
+	// Observed the last time the mirror was observed.
+	Observed time.Time `json:"observed"`
+}
+
+// Cost estimated cost of using the mirror, lower is better. the estimate is the time
+// required to download 1MiB, inflated by the error rate and how far the mirror lags
+// behind the freshest mirror.
+func (t Score) Cost(lag time.Duration) float64 {
+	throughput := t.Throughput
+	if throughput <= 0 {
+		throughput = 1
+	}
+
+	return (t.Latency.Seconds()+(1024*1024)/throughput)*(1+10*t.ErrorRate) + lag.Hours()
+}
+
+func (t *Score) observe(latency time.Duration, throughput float64, failed bool) {
+	failure := 0.0
+	if failed {
+		failure = 1.0
+	}
+
+	if t.Observed.IsZero() {
+		t.Latency = latency
+		t.Throughput = throughput
+		t.ErrorRate = failure
+	} else {
+		t.ErrorRate = ewma(t.ErrorRate, failure)
+		if !failed {
+			t.Latency = time.Duration(ewma(float64(t.Latency), float64(latency)))
+		}
+
+		// zero throughput is an observation without a transfer. i.e.) 304 Not Modified
+		if !failed && throughput > 0 {
+			t.Throughput = ewma(t.Throughput, throughput)
+		}
+	}
+
+	t.Observed = time.Now().UTC()
+}
+
+func ewma(previous, observed float64) float64 {
+	return smoothing*observed + (1-smoothing)*previous
+}
+
+// RankOption options for the ranker.
+type RankOption func(*Ranker)
+
+// RankOptionClient the http client used to probe mirrors.
+func RankOptionClient(c *http.Client) RankOption {
+	return func(r *Ranker) {
+		r.client = c
+	}
+}
+
+// RankOptionProbeSize the number of bytes downloaded when measuring throughput.
+func RankOptionProbeSize(n int64) RankOption {
+	return func(r *Ranker) {
+		r.probesize = n
+	}
+}
+
+// NewRanker loads the scores persisted at the path, an empty path disables persistence.
+func NewRanker(path string, options ...RankOption) (r *Ranker, err error) {
+	var (
+		raw    []byte
+		scores []Score
+	)
+
+	r = &Ranker{
+		m:         &sync.RWMutex{},
+		path:      path,
+		scores:    map[string]*Score{},
+		client:    &http.Client{Timeout: 30 * time.Second},
+		probesize: 256 * 1024,
+	}
+
+	for _, opt := range options {
+		opt(r)
+	}
+
+	if path == "" {
+		return r, nil
+	}
+
+	if raw, err = ioutil.ReadFile(path); os.IsNotExist(err) {
+		return r, nil
+	} else if err != nil {
+		return r, errors.WithStack(err)
+	}
+
+	if err = json.Unmarshal(raw, &scores); err != nil {
+		log.Println(errors.Wrapf(err, "discarding corrupt mirror scores %s", path))
+		return r, nil
+	}
+
+	for i := range scores {
+		r.scores[scores[i].Root] = &scores[i]
+	}
+
+	return r, nil
+}
+
+// Ranker ranks mirrors by their observed performance.
+type Ranker struct {
+	m         *sync.RWMutex
+	path      string
+	scores    map[string]*Score
+	client    *http.Client
+	probesize int64
+}
+
+// Scores returns a snapshot of every score.
+func (t *Ranker) Scores() (scores []Score) {
+	t.m.RLock()
+	defer t.m.RUnlock()
+
+	for _, s := range t.scores {
+		scores = append(scores, *s)
+	}
+
+	sort.Slice(scores, func(i, j int) bool { return scores[i].Root < scores[j].Root })
+
+	return scores
+}
+
+// Score of the mirror serving the server url.
+func (t *Ranker) Score(server string) (Score, bool) {
+	t.m.RLock()
+	defer t.m.RUnlock()
+
+	s, ok := t.scores[Root(server)]
+	if !ok {
+		return Score{}, false
+	}
+
+	return *s, true
+}
+
+// Order the servers from best to worst. servers without a score retain their position
+// in the mirrorlist, scored servers are ordered amongst the remaining positions. a newly
+// added mirror is preferred over the scored mirrors after it until it is observed.
+func (t *Ranker) Order(servers []string) []string {
+	type ranked struct {
+		server string
+		cost   float64
+	}
+
+	var (
+		slots  []int
+		scored []ranked
+	)
+
+	t.m.RLock()
+	freshest := t.freshest()
+	for i, s := range servers {
+		if score, ok := t.scores[Root(s)]; ok {
+			slots = append(slots, i)
+			scored = append(scored, ranked{server: s, cost: score.Cost(freshest.lag(*score))})
+		}
+	}
+	t.m.RUnlock()
+
+	sort.SliceStable(scored, func(i, j int) bool {
+		return scored[i].cost < scored[j].cost
+	})
+
+	ordered := append([]string(nil), servers...)
+	for i, r := range scored {
+		ordered[slots[i]] = r.server
+	}
+
+	return ordered
+}
+
+// Record an observation of a request to the server. bytes is the number of bytes
+// transferred in the duration.
+func (t *Ranker) Record(server string, latency time.Duration, bytes int64, d time.Duration, failed bool) {
+	throughput := 0.0
+	if d > 0 {
+		throughput = float64(bytes) / d.Seconds()
+	}
+
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	t.score(Root(server)).observe(latency, throughput, failed)
+}
+
+// Synced records the lastsync timestamp of the server.
+func (t *Ranker) Synced(server string, ts time.Time) {
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	t.score(Root(server)).LastSync = ts
+}
+
+// Updated records the lastupdate timestamp of the server.
+func (t *Ranker) Updated(server string, ts time.Time) {
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	t.score(Root(server)).LastUpdate = ts
+}
+
+func (t *Ranker) score(root string) *Score {
+	s, ok := t.scores[root]
+	if !ok {
+		s = &Score{Root: root}
+		t.scores[root] = s
+	}
+
+	return s
+}
+
+func (t *Ranker) freshest() (n newest) {
+	for _, s := range t.scores {
+		if s.LastSync.After(n.sync) {
+			n.sync = s.LastSync
+		}
+
+		if s.LastUpdate.After(n.update) {
+			n.update = s.LastUpdate
+		}
+	}
+
+	return n
+}
+
+// newest timestamps observed across every mirror.
+type newest struct {
+	sync   time.Time
+	update time.Time
+}
+
+// lag of the mirror behind the freshest mirror. lastupdate reflects when the content
+// changed so it is preferred, lastsync is used for mirrors that don't publish it.
+func (t newest) lag(s Score) time.Duration {
+	switch {
+	case !s.LastUpdate.IsZero():
+		if t.update.After(s.LastUpdate) {
+			return t.update.Sub(s.LastUpdate)
+		}
+	case !s.LastSync.IsZero():
+		if t.sync.After(s.LastSync) {
+			return t.sync.Sub(s.LastSync)
+		}
+	}
+
+	return 0
+}
+
+// Probe each of the servers, measuring the latency of the lastsync file and
+// the throughput of a partial database download.
+func (t *Ranker) Probe(ctx context.Context, servers ...string) {
+	var (
+		wg        sync.WaitGroup
+		seen      = map[string]bool{}
+		available = make(chan struct{}, concurrentprobes)
+	)
+
+	for _, s := range servers {
+		// skip servers we can't probe or have already probed.
+		if !strings.HasPrefix(s, "http") || seen[Root(s)] {
+			continue
+		}
+		seen[Root(s)] = true
+
+		wg.Add(1)
+		available <- struct{}{}
+		go func(server string) {
+			defer wg.Done()
+			defer func() { <-available }()
+			if err := t.probe(ctx, server); err != nil {
+				log.Println(errors.Wrapf(err, "probe failed %s", server))
+			}
+		}(s)
+	}
+
+	wg.Wait()
+}
+
+func (t *Ranker) probe(ctx context.Context, server string) (err error) {
+	var (
+		ts      time.Time
+		latency time.Duration
+		n       int64
+		d       time.Duration
+	)
+
+	if ts, latency, err = t.timestamp(ctx, server, "lastsync"); err != nil {
+		t.Record(server, 0, 0, 0, true)
+		return err
+	}
+	t.Synced(server, ts)
+
+	// not every mirror publishes lastupdate.
+	if ts, _, err = t.timestamp(ctx, server, "lastupdate"); err == nil {
+		t.Updated(server, ts)
+	}
+
+	if n, d, err = t.sample(ctx, server); err != nil {
+		t.Record(server, latency, 0, 0, true)
+		return err
+	}
+
+	t.Record(server, latency, n, d, false)
+
+	return nil
+}
+
+// timestamp retrieves the named timestamp file from the root of the mirror. i.e.) lastsync
+func (t *Ranker) timestamp(ctx context.Context, server string, name string) (ts time.Time, latency time.Duration, err error) {
+	var (
+		req  *http.Request
+		resp *http.Response
+		raw  []byte
+		unix int64
+	)
+
+	if req, err = http.NewRequestWithContext(ctx, http.MethodGet, Root(server)+"/"+name, nil); err != nil {
+		return ts, latency, errors.WithStack(err)
+	}
+
+	started := time.Now()
+	if resp, err = t.client.Do(req); err != nil {
+		return ts, latency, errors.WithStack(err)
+	}
+	defer resp.Body.Close()
+	latency = time.Since(started)
+
+	if resp.StatusCode != http.StatusOK {
+		return ts, latency, errors.Errorf("unexpected status %s", resp.Status)
+	}
+
+	if raw, err = ioutil.ReadAll(io.LimitReader(resp.Body, 64)); err != nil {
+		return ts, latency, errors.WithStack(err)
+	}
+
+	if unix, err = strconv.ParseInt(strings.TrimSpace(string(raw)), 10, 64); err != nil {
+		return ts, latency, errors.Wrapf(err, "invalid %s", name)
+	}
+
+	return time.Unix(unix, 0).UTC(), latency, nil
+}
+
+// sample downloads the start of the repository database measuring throughput.
+func (t *Ranker) sample(ctx context.Context, server string) (n int64, d time.Duration, err error) {
+	var (
+		req  *http.Request
+		resp *http.Response
+	)
+
+	repo, ok := Repository(server)
+	if !ok {
+		return 0, 0, errors.Errorf("unable to determine repository of %s", server)
+	}
+
+	if req, err = http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(server, "/")+"/"+repo+".db", nil); err != nil {
+		return 0, 0, errors.WithStack(err)
+	}
+	req.Header.Set("Range", "bytes=0-"+strconv.FormatInt(t.probesize-1, 10))
+
+	started := time.Now()
+	if resp, err = t.client.Do(req); err != nil {
+		return 0, 0, errors.WithStack(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent {
+		return 0, 0, errors.Errorf("unexpected status %s", resp.Status)
+	}
+
+	if n, err = io.Copy(ioutil.Discard, io.LimitReader(resp.Body, t.probesize)); err != nil {
+		return n, time.Since(started), errors.WithStack(err)
+	}
+
+	return n, time.Since(started), nil
+}
+
+// Save the scores to disk.
+func (t *Ranker) Save() (err error) {
+	var (
+		encoded []byte
+	)
+
+	if t.path == "" {
+		return nil
+	}
+
+	if encoded, err = json.Marshal(t.Scores()); err != nil {
+		return errors.WithStack(err)
+	}
+
+	if err = os.MkdirAll(filepath.Dir(t.path), 0755); err != nil {
+		return errors.WithStack(err)
+	}
+
+	return atomicwrite(t.path, encoded, 0600)
+}
+
+// Background periodically probes the servers until the context is cancelled.
+func (t *Ranker) Background(ctx context.Context, every time.Duration, servers func() []string) {
+	ticker := time.NewTicker(every)
+	defer ticker.Stop()
+
+	for {
+		t.Probe(ctx, servers()...)
+
+		if err := t.Save(); err != nil {
+			log.Println(errors.Wrap(err, "unable to persist mirror scores"))
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+var repopattern = regexp.MustCompile(`/([^/]+)/os/[^/]+/?$`)
+
+// Root of the mirror serving the resolved server url.
+// i.e.) https://example.com/archlinux/core/os/x86_64 -> https://example.com/archlinux
+func Root(server string) string {
+	if loc := repopattern.FindStringIndex(server); loc != nil {
+		return server[:loc[0]]
+	}
+
+	return strings.TrimSuffix(server, "/")
+}
+
+// Repository served by the resolved server url.
+// i.e.) https://example.com/archlinux/core/os/x86_64 -> core
+func Repository(server string) (string, bool) {
+	matches := repopattern.FindStringSubmatch(server)
+	if matches == nil {
+		return "", false
+	}
+
+	return matches[1], true
+}
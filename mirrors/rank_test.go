@@ -0,0 +1,259 @@
+package mirrors_test
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"testing"
+
+	"github.com/james-lawrence/pacmir/internal/testingx"
+	. "github.com/james-lawrence/pacmir/mirrors"
+
+	"github.com/stretchr/testify/require"
+)
+
+// mirror simulates an archlinux mirror with the given response delay and lastsync.
+func mirror(delay time.Duration, lastsync time.Time) *httptest.Server {
+	return updated(delay, lastsync, time.Time{})
+}
+
+// updated simulates an archlinux mirror publishing lastupdate.
+func updated(delay time.Duration, lastsync, lastupdate time.Time) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		time.Sleep(delay)
+		switch {
+		case req.URL.Path == "/archlinux/lastsync":
+			fmt.Fprintf(resp, "%d\n", lastsync.Unix())
+		case req.URL.Path == "/archlinux/lastupdate" && !lastupdate.IsZero():
+			fmt.Fprintf(resp, "%d\n", lastupdate.Unix())
+		case strings.HasSuffix(req.URL.Path, ".db"):
+			resp.Write(make([]byte, 4096))
+		default:
+			resp.WriteHeader(http.StatusNotFound)
+		}
+	}))
+}
+
+func failing() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		resp.WriteHeader(http.StatusInternalServerError)
+	}))
+}
+
+func TestRanker(t *testing.T) {
+	g := testingx.Init(t)
+
+	server := func(s *httptest.Server) string {
+		return s.URL + "/archlinux/core/os/x86_64"
+	}
+
+	g.Describe("Root", func() {
+		g.It("should strip the repository path", func() {
+			require.Equal(t, "https://example.com/archlinux", Root("https://example.com/archlinux/core/os/x86_64"))
+			require.Equal(t, "https://example.com/archlinux", Root("https://example.com/archlinux/core/os/x86_64/"))
+			require.Equal(t, "https://example.com/custom", Root("https://example.com/custom/"))
+		})
+	})
+
+	g.Describe("Order", func() {
+		g.It("should prefer fast mirrors", func() {
+			now := time.Now()
+			slow := mirror(100*time.Millisecond, now)
+			defer slow.Close()
+			fast := mirror(0, now)
+			defer fast.Close()
+
+			r, err := NewRanker("")
+			require.Nil(t, err)
+
+			r.Probe(context.Background(), server(slow), server(fast))
+			require.Equal(t, []string{server(fast), server(slow)}, r.Order([]string{server(slow), server(fast)}))
+		})
+
+		g.It("should penalize failing mirrors", func() {
+			now := time.Now()
+			broken := failing()
+			defer broken.Close()
+			healthy := mirror(10*time.Millisecond, now)
+			defer healthy.Close()
+
+			r, err := NewRanker("")
+			require.Nil(t, err)
+
+			r.Probe(context.Background(), server(broken), server(healthy))
+			score, ok := r.Score(server(broken))
+			require.True(t, ok)
+			require.Equal(t, 1.0, score.ErrorRate)
+			require.Equal(t, []string{server(healthy), server(broken)}, r.Order([]string{server(broken), server(healthy)}))
+		})
+
+		g.It("should penalize stale mirrors", func() {
+			now := time.Now()
+			stale := mirror(0, now.Add(-48*time.Hour))
+			defer stale.Close()
+			fresh := mirror(10*time.Millisecond, now)
+			defer fresh.Close()
+
+			r, err := NewRanker("")
+			require.Nil(t, err)
+
+			r.Probe(context.Background(), server(stale), server(fresh))
+			require.Equal(t, []string{server(fresh), server(stale)}, r.Order([]string{server(stale), server(fresh)}))
+		})
+
+		g.It("should keep unscored mirrors at their position", func() {
+			known := mirror(0, time.Now())
+			defer known.Close()
+
+			r, err := NewRanker("")
+			require.Nil(t, err)
+
+			r.Probe(context.Background(), server(known))
+			require.Equal(t, []string{
+				"https://b.example.com/archlinux/core/os/x86_64",
+				server(known),
+				"https://a.example.com/archlinux/core/os/x86_64",
+			}, r.Order([]string{
+				"https://b.example.com/archlinux/core/os/x86_64",
+				server(known),
+				"https://a.example.com/archlinux/core/os/x86_64",
+			}))
+		})
+
+		g.It("should prefer newly added mirrors over failing mirrors after them", func() {
+			now := time.Now()
+			broken := failing()
+			defer broken.Close()
+			healthy := mirror(10*time.Millisecond, now)
+			defer healthy.Close()
+
+			r, err := NewRanker("")
+			require.Nil(t, err)
+
+			r.Probe(context.Background(), server(broken), server(healthy))
+			added := "https://added.example.com/archlinux/core/os/x86_64"
+			require.Equal(t, []string{added, server(healthy), server(broken)}, r.Order([]string{added, server(broken), server(healthy)}))
+		})
+
+	})
+
+	g.Describe("Probe", func() {
+		g.It("should bound the number of concurrent probes", func() {
+			var (
+				inflight, peak int64
+				servers        []string
+			)
+
+			limited := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+				n := atomic.AddInt64(&inflight, 1)
+				defer atomic.AddInt64(&inflight, -1)
+				for p := atomic.LoadInt64(&peak); n > p && !atomic.CompareAndSwapInt64(&peak, p, n); p = atomic.LoadInt64(&peak) {
+				}
+				time.Sleep(10 * time.Millisecond)
+				resp.WriteHeader(http.StatusNotFound)
+			}))
+			defer limited.Close()
+
+			// every mirror is a distinct root on the same server.
+			for i := 0; i < 32; i++ {
+				servers = append(servers, fmt.Sprintf("%s/mirror%d/core/os/x86_64", limited.URL, i))
+			}
+
+			r, err := NewRanker("")
+			require.Nil(t, err)
+
+			r.Probe(context.Background(), servers...)
+			require.Equal(t, len(servers), len(r.Scores()))
+			require.True(t, atomic.LoadInt64(&peak) <= 8, "%d concurrent probes", peak)
+		})
+	})
+
+	g.Describe("Fresh", func() {
+		g.It("should reject mirrors behind the freshest mirror", func() {
+			now := time.Now()
+			current := updated(0, now, now.Add(-10*time.Minute))
+			defer current.Close()
+			// synced recently but hasn't picked up the latest update.
+			behind := updated(0, now, now.Add(-3*time.Hour))
+			defer behind.Close()
+
+			r, err := NewRanker("")
+			require.Nil(t, err)
+			r.Probe(context.Background(), server(current), server(behind))
+
+			fresh, stale := r.Fresh([]string{server(behind), server(current)}, Staleness{Tolerance: time.Hour})
+			require.Equal(t, []string{server(current)}, fresh)
+			require.Equal(t, 1, len(stale))
+			require.Equal(t, Root(server(behind)), stale[0].Root)
+			require.True(t, stale[0].Lag > 2*time.Hour)
+		})
+
+		g.It("should not compare mirrors when the tolerance is zero", func() {
+			now := time.Now()
+			current := updated(0, now, now.Add(-10*time.Minute))
+			defer current.Close()
+			behind := updated(0, now, now.Add(-3*time.Hour))
+			defer behind.Close()
+
+			r, err := NewRanker("")
+			require.Nil(t, err)
+			r.Probe(context.Background(), server(current), server(behind))
+
+			fresh, stale := r.Fresh([]string{server(behind), server(current)}, Staleness{})
+			require.Equal(t, []string{server(behind), server(current)}, fresh)
+			require.Empty(t, stale)
+		})
+
+		g.It("should reject mirrors that exceed the threshold", func() {
+			now := time.Now()
+			old := mirror(0, now.Add(-48*time.Hour))
+			defer old.Close()
+
+			r, err := NewRanker("")
+			require.Nil(t, err)
+			r.Probe(context.Background(), server(old))
+
+			fresh, stale := r.Fresh([]string{server(old)}, Staleness{Threshold: 24 * time.Hour})
+			require.Equal(t, 0, len(fresh))
+			require.Equal(t, 1, len(stale))
+
+			fresh, _ = r.Fresh([]string{server(old)}, Staleness{})
+			require.Equal(t, []string{server(old)}, fresh)
+		})
+
+		g.It("should accept mirrors that have not been probed", func() {
+			r, err := NewRanker("")
+			require.Nil(t, err)
+
+			fresh, stale := r.Fresh([]string{"https://example.com/archlinux/core/os/x86_64"}, Staleness{Threshold: time.Hour})
+			require.Equal(t, []string{"https://example.com/archlinux/core/os/x86_64"}, fresh)
+			require.Equal(t, 0, len(stale))
+		})
+	})
+
+	g.Describe("Save", func() {
+		g.It("should persist scores", func() {
+			dir, err := ioutil.TempDir("", "pacmir.rank.*")
+			require.Nil(t, err)
+			defer os.RemoveAll(dir)
+
+			path := filepath.Join(dir, "mirrors.json")
+			r, err := NewRanker(path)
+			require.Nil(t, err)
+			r.Record("https://example.com/archlinux/core/os/x86_64", time.Millisecond, 1024, time.Second, false)
+			require.Nil(t, r.Save())
+
+			loaded, err := NewRanker(path)
+			require.Nil(t, err)
+			require.Equal(t, r.Scores(), loaded.Scores())
+		})
+	})
+}
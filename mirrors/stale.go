@@ -0,0 +1,96 @@
+package mirrors
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Staleness policy for upstream mirrors.
+type Staleness struct {
+	// Threshold maximum age of a mirror's lastsync, zero disables the check.
+	Threshold time.Duration
+	// Tolerance how far a mirror's content may lag behind the freshest known mirror, zero disables the check.
+	Tolerance time.Duration
+}
+
+// Freshness of a single mirror.
+type Freshness struct {
+	Root       string    `json:"root"`
+	LastSync   time.Time `json:"last_sync"`
+	LastUpdate time.Time `json:"last_update,omitempty"`
+	// Age time since the mirror last synced.
+	Age time.Duration `json:"age"`
+	// Lag how far the mirror's content is behind the freshest known mirror.
+	Lag    time.Duration `json:"lag"`
+	Stale  bool          `json:"stale"`
+	Reason string        `json:"reason,omitempty"`
+}
+
+// Freshness of the mirror serving the server url. mirrors that have not been
+// probed are never stale.
+func (t *Ranker) Freshness(server string, p Staleness) Freshness {
+	t.m.RLock()
+	defer t.m.RUnlock()
+
+	return t.freshness(Root(server), t.freshest(), p)
+}
+
+// Freshnesses of every known mirror.
+func (t *Ranker) Freshnesses(p Staleness) (results []Freshness) {
+	t.m.RLock()
+	defer t.m.RUnlock()
+
+	freshest := t.freshest()
+	for root := range t.scores {
+		results = append(results, t.freshness(root, freshest, p))
+	}
+
+	sort.Slice(results, func(i, j int) bool { return results[i].Root < results[j].Root })
+
+	return results
+}
+
+func (t *Ranker) freshness(root string, freshest newest, p Staleness) (f Freshness) {
+	f.Root = root
+
+	s, ok := t.scores[root]
+	if !ok || s.LastSync.IsZero() {
+		return f
+	}
+
+	f.LastSync = s.LastSync
+	f.LastUpdate = s.LastUpdate
+	f.Age = time.Since(s.LastSync)
+
+	f.Lag = freshest.lag(*s)
+
+	switch {
+	case p.Threshold > 0 && f.Age > p.Threshold:
+		f.Stale = true
+		f.Reason = fmt.Sprintf("last synced %s ago, exceeds %s", f.Age.Round(time.Second), p.Threshold)
+	case p.Tolerance > 0 && f.Lag > p.Tolerance:
+		f.Stale = true
+		f.Reason = fmt.Sprintf("%s behind the freshest mirror, exceeds %s", f.Lag.Round(time.Second), p.Tolerance)
+	}
+
+	return f
+}
+
+// Fresh partitions the servers into fresh and stale servers, retaining their order.
+func (t *Ranker) Fresh(servers []string, p Staleness) (fresh []string, stale []Freshness) {
+	t.m.RLock()
+	defer t.m.RUnlock()
+
+	freshest := t.freshest()
+	for _, s := range servers {
+		if f := t.freshness(Root(s), freshest, p); f.Stale {
+			stale = append(stale, f)
+			continue
+		}
+
+		fresh = append(fresh, s)
+	}
+
+	return fresh, stale
+}
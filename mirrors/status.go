@@ -0,0 +1,190 @@
+package mirrors
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// statusclient retrieves the mirror status, an unresponsive status url fails instead of hanging.
+var statusclient = &http.Client{Timeout: 30 * time.Second}
+
+// protocols pacman is able to download from, mirrors using other protocols i.e.) rsync never match.
+var protocols = []string{"http", "https", "ftp"}
+
+// Status snapshot of the archlinux mirror status.
+type Status struct {
+	Cutoff    int         `json:"cutoff"`
+	LastCheck time.Time   `json:"last_check"`
+	URLs      []StatusURL `json:"urls"`
+}
+
+// StatusURL the status of a single mirror url.
+type StatusURL struct {
+	URL      string `json:"url"`
+	Protocol string `json:"protocol"`
+	// LastSync nil when the mirror has never synced.
+	LastSync      *time.Time `json:"last_sync"`
+	CompletionPct float64    `json:"completion_pct"`
+	// Delay in seconds, nil when unknown.
+	Delay *int64 `json:"delay"`
+	// Score lower is better, nil when unknown.
+	Score       *float64 `json:"score"`
+	Active      bool     `json:"active"`
+	Country     string   `json:"country"`
+	CountryCode string   `json:"country_code"`
+	IPv4        bool     `json:"ipv4"`
+	IPv6        bool     `json:"ipv6"`
+}
+
+// Server the mirrorlist server template for the url.
+func (t StatusURL) Server() string {
+	return strings.TrimSuffix(t.URL, "/") + "/$repo/os/$arch"
+}
+
+// DecodeStatus decodes the mirror status json.
+func DecodeStatus(r io.Reader) (s Status, err error) {
+	if err = json.NewDecoder(r).Decode(&s); err != nil {
+		return s, errors.Wrap(err, "unable to decode mirror status")
+	}
+
+	return s, nil
+}
+
+// FetchStatus loads the mirror status from a http(s) url or a local file.
+func FetchStatus(ctx context.Context, location string) (s Status, err error) {
+	var (
+		req  *http.Request
+		resp *http.Response
+		f    *os.File
+	)
+
+	if !strings.HasPrefix(location, "http://") && !strings.HasPrefix(location, "https://") {
+		if f, err = os.Open(location); err != nil {
+			return s, errors.WithStack(err)
+		}
+		defer f.Close()
+
+		return DecodeStatus(f)
+	}
+
+	if req, err = http.NewRequestWithContext(ctx, http.MethodGet, location, nil); err != nil {
+		return s, errors.WithStack(err)
+	}
+
+	if resp, err = statusclient.Do(req); err != nil {
+		return s, errors.WithStack(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return s, errors.Errorf("unable to retrieve mirror status %s: %s", location, resp.Status)
+	}
+
+	return DecodeStatus(resp.Body)
+}
+
+// Filter for mirrors, zero values match every mirror pacman is able to use.
+type Filter struct {
+	// Countries names or country codes. i.e.) Germany, DE
+	Countries []string
+	// Protocols i.e.) https
+	Protocols []string
+	// IPv6 only mirrors supporting ipv6.
+	IPv6 bool
+	// Completion minimum completion percentage, between 0 and 1.
+	Completion float64
+	// Delay maximum sync delay.
+	Delay time.Duration
+}
+
+// Match returns true if the mirror satisfies the filter. inactive, never synced and
+// mirrors using protocols pacman doesn't support never match.
+func (t Filter) Match(u StatusURL) bool {
+	if !u.Active || u.LastSync == nil || !fold(protocols, u.Protocol) {
+		return false
+	}
+
+	if len(t.Countries) > 0 && !fold(t.Countries, u.Country) && !fold(t.Countries, u.CountryCode) {
+		return false
+	}
+
+	if len(t.Protocols) > 0 && !fold(t.Protocols, u.Protocol) {
+		return false
+	}
+
+	if t.IPv6 && !u.IPv6 {
+		return false
+	}
+
+	if u.CompletionPct < t.Completion {
+		return false
+	}
+
+	if t.Delay > 0 && (u.Delay == nil || time.Duration(*u.Delay)*time.Second > t.Delay) {
+		return false
+	}
+
+	return true
+}
+
+func fold(set []string, s string) bool {
+	for _, v := range set {
+		if strings.EqualFold(v, s) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Generate a mirrorlist from the mirrors matching the filter ordered by score.
+func Generate(s Status, f Filter) *List {
+	var (
+		matched []StatusURL
+	)
+
+	for _, u := range s.URLs {
+		if f.Match(u) {
+			matched = append(matched, u)
+		}
+	}
+
+	sort.SliceStable(matched, func(i, j int) bool {
+		return score(matched[i]) < score(matched[j])
+	})
+
+	l := &List{eol: "\n", terminated: true}
+	l.Lines = append(
+		l.Lines,
+		parseLine("##"),
+		parseLine("## Arch Linux repository mirrorlist"),
+		parseLine(fmt.Sprintf("## Generated by pacmir from the mirror status checked %s", s.LastCheck.UTC().Format("2006-01-02 15:04:05"))),
+		parseLine("##"),
+		parseLine(""),
+	)
+
+	for _, u := range matched {
+		l.Lines = append(l.Lines, Server(u.Server()).line())
+	}
+
+	return l
+}
+
+// mirrors without a score are placed last.
+func score(u StatusURL) float64 {
+	if u.Score == nil {
+		return math.Inf(1)
+	}
+
+	return *u.Score
+}
@@ -0,0 +1,126 @@
+package mirrors_test
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/james-lawrence/pacmir/internal/testingx"
+	. "github.com/james-lawrence/pacmir/mirrors"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestStatus(t *testing.T) {
+	g := testingx.Init(t)
+
+	fixture := filepath.Join("testdata", "status.json")
+
+	load := func() Status {
+		s, err := FetchStatus(context.Background(), fixture)
+		require.Nil(t, err)
+		return s
+	}
+
+	servers := func(l *List) (results []string) {
+		for _, e := range l.Entries() {
+			results = append(results, e.Value)
+		}
+		return results
+	}
+
+	g.Describe("FetchStatus", func() {
+		g.It("should load from a url", func() {
+			srv := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+				http.ServeFile(resp, req, fixture)
+			}))
+			defer srv.Close()
+
+			s, err := FetchStatus(context.Background(), srv.URL)
+			require.Nil(t, err)
+			require.Equal(t, load(), s)
+			require.Equal(t, 6, len(s.URLs))
+		})
+	})
+
+	g.Describe("Generate", func() {
+		g.It("should order active synced mirrors by score", func() {
+			require.Equal(t, []string{
+				"https://fast.example.fr/arch/$repo/os/$arch",
+				"http://mirror.example.de/archlinux/$repo/os/$arch",
+				"https://mirror.example.de/archlinux/$repo/os/$arch",
+				"https://lagging.example.com/archlinux/$repo/os/$arch",
+			}, servers(Generate(load(), Filter{})))
+		})
+
+		g.It("should never match protocols pacman can't use", func() {
+			require.Empty(t, servers(Generate(load(), Filter{Protocols: []string{"rsync"}})))
+		})
+
+		g.It("should filter by country names and codes", func() {
+			require.Equal(t, []string{
+				"https://fast.example.fr/arch/$repo/os/$arch",
+				"https://mirror.example.de/archlinux/$repo/os/$arch",
+			}, servers(Generate(load(), Filter{Countries: []string{"de", "France"}, Protocols: []string{"https"}})))
+		})
+
+		g.It("should filter by ipv6, completion and delay", func() {
+			require.Equal(t, []string{
+				"https://mirror.example.de/archlinux/$repo/os/$arch",
+			}, servers(Generate(load(), Filter{Protocols: []string{"https"}, IPv6: true, Completion: 1})))
+
+			require.Equal(t, []string{
+				"https://fast.example.fr/arch/$repo/os/$arch",
+			}, servers(Generate(load(), Filter{Delay: 15 * time.Minute})))
+		})
+	})
+
+	g.Describe("Replace", func() {
+		g.It("should restore the previous mirrorlist on uninstall", func() {
+			dir, err := ioutil.TempDir("", "pacmir.generate.*")
+			require.Nil(t, err)
+			defer os.RemoveAll(dir)
+
+			path := filepath.Join(dir, "mirrorlist")
+			require.Nil(t, ioutil.WriteFile(path, []byte(example), 0644))
+
+			state := State{}
+			require.Nil(t, Replace(&state, Server(LocalURL("localhost:4000")), path, Generate(load(), Filter{Countries: []string{"FR"}})))
+
+			raw, err := ioutil.ReadFile(path)
+			require.Nil(t, err)
+			l, err := Parse(bytes.NewReader(raw))
+			require.Nil(t, err)
+			i, ok := l.Managed()
+			require.True(t, ok)
+			require.Equal(t, LocalURL("localhost:4000"), l.Lines[i].Value)
+			require.Equal(t, []string{"https://fast.example.fr/arch/$repo/os/$arch"}, servers(l))
+
+			require.Nil(t, Uninstall(&state))
+			raw, err = ioutil.ReadFile(path)
+			require.Nil(t, err)
+			require.Equal(t, example, string(raw))
+		})
+
+		g.It("should remove created mirrorlists on uninstall", func() {
+			dir, err := ioutil.TempDir("", "pacmir.generate.*")
+			require.Nil(t, err)
+			defer os.RemoveAll(dir)
+
+			path := filepath.Join(dir, "mirrorlist")
+			state := State{}
+			require.Nil(t, Replace(&state, Server(LocalURL("localhost:4000")), path, Generate(load(), Filter{})))
+			require.Nil(t, Replace(&state, Server(LocalURL("localhost:4000")), path, Generate(load(), Filter{Countries: []string{"DE"}})))
+			require.Nil(t, Uninstall(&state))
+
+			_, err = os.Stat(path)
+			require.True(t, os.IsNotExist(err))
+		})
+	})
+}
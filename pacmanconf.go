@@ -0,0 +1,241 @@
+package pacmir
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	paconf "github.com/Morganamilo/go-pacmanconf"
+	"github.com/pkg/errors"
+)
+
+// parsed pacman configuration along with the files that contributed to it.
+type parsed struct {
+	config       *paconf.Config
+	repositories []Repository
+	// every file read while parsing, including the root configuration.
+	files []string
+	// glob patterns from Include directives, new files matching these
+	// patterns change the configuration.
+	patterns []string
+}
+
+// parse the pacman configuration at the given path. Include directives are expanded
+// inline the same way pacman expands them.
+func parse(path string) (p parsed, err error) {
+	var (
+		buf  strings.Builder
+		seen = map[string]bool{}
+	)
+
+	if err = expand(path, &buf, &p, seen); err != nil {
+		return p, err
+	}
+
+	if p.config, err = paconf.Parse(buf.String()); err != nil {
+		return p, errors.Wrapf(err, "unable to parse %s", path)
+	}
+
+	normalize(p.config)
+
+	if p.repositories, err = repositories(p.config, buf.String()); err != nil {
+		return p, errors.Wrapf(err, "unable to parse repositories %s", path)
+	}
+
+	return p, nil
+}
+
+// Includes returns the files included by the pacman configuration at the given path.
+func Includes(path string) ([]string, error) {
+	p, err := parse(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return p.files[1:], nil
+}
+
+// expand writes the contents of the configuration into dst replacing
+// Include directives with the contents of the files they reference.
+func expand(path string, dst *strings.Builder, p *parsed, seen map[string]bool) (err error) {
+	var (
+		src *os.File
+	)
+
+	if seen[path] {
+		return errors.Errorf("recursive include detected: %s", path)
+	}
+	seen[path] = true
+	defer delete(seen, path)
+
+	if src, err = os.Open(path); err != nil {
+		return errors.WithStack(err)
+	}
+	defer src.Close()
+
+	p.files = append(p.files, path)
+
+	scanner := bufio.NewScanner(src)
+	for scanner.Scan() {
+		line := uncomment(scanner.Text())
+		key, value := split(line)
+
+		if key != "Include" {
+			fmt.Fprintln(dst, line)
+			continue
+		}
+
+		p.patterns = append(p.patterns, value)
+
+		matches, err := filepath.Glob(value)
+		if err != nil {
+			return errors.Wrapf(err, "invalid include %s", value)
+		}
+
+		if len(matches) == 0 {
+			log.Println("include did not match any files", value)
+			continue
+		}
+
+		for _, included := range matches {
+			if err = expand(included, dst, p, seen); err != nil {
+				return err
+			}
+		}
+	}
+
+	return errors.WithStack(scanner.Err())
+}
+
+// uncomment truncates the line at the first #, pacman treats the remainder of the line
+// as a comment. i.e.) Include = /etc/pacman.d/mirrorlist # local
+func uncomment(line string) string {
+	if i := strings.IndexByte(line, '#'); i >= 0 {
+		return line[:i]
+	}
+
+	return line
+}
+
+// split a configuration line, without comments, into its key and value.
+func split(line string) (key, value string) {
+	line = strings.TrimSpace(line)
+	if line == "" || strings.HasPrefix(line, "[") {
+		return "", ""
+	}
+
+	parts := strings.SplitN(line, "=", 2)
+	key = strings.TrimSpace(parts[0])
+	if len(parts) == 1 {
+		return key, ""
+	}
+
+	return key, strings.TrimSpace(parts[1])
+}
+
+// normalize the configuration the same way pacman-conf would.
+// applying defaults, splitting list values, and resolving server templates.
+func normalize(c *paconf.Config) {
+	c.RootDir = stringOrDefault(c.RootDir, "/")
+	c.DBPath = stringOrDefault(c.DBPath, "/var/lib/pacman/")
+	c.GPGDir = stringOrDefault(c.GPGDir, "/etc/pacman.d/gnupg/")
+	c.LogFile = stringOrDefault(c.LogFile, "/var/log/pacman.log")
+	c.Architecture = stringOrDefault(c.Architecture, "auto")
+
+	c.CacheDir = fields(c.CacheDir)
+	if len(c.CacheDir) == 0 {
+		c.CacheDir = []string{"/var/cache/pacman/pkg/"}
+	}
+
+	c.HookDir = fields(c.HookDir)
+	c.HoldPkg = fields(c.HoldPkg)
+	c.IgnorePkg = fields(c.IgnorePkg)
+	c.IgnoreGroup = fields(c.IgnoreGroup)
+	c.NoUpgrade = fields(c.NoUpgrade)
+	c.NoExtract = fields(c.NoExtract)
+	c.CleanMethod = fields(c.CleanMethod)
+	c.SigLevel = fields(c.SigLevel)
+	c.LocalFileSigLevel = fields(c.LocalFileSigLevel)
+	c.RemoteFileSigLevel = fields(c.RemoteFileSigLevel)
+
+	arches := architectures(c.Architecture)
+	c.Architecture = strings.Join(arches, " ")
+
+	arch := arches[0]
+	for i := range c.Repos {
+		repo := &c.Repos[i]
+		repo.SigLevel = fields(repo.SigLevel)
+		repo.Usage = fields(repo.Usage)
+		for j, s := range repo.Servers {
+			repo.Servers[j] = strings.NewReplacer("$repo", repo.Name, "$arch", arch).Replace(s)
+		}
+	}
+}
+
+// architectures resolves the Architecture setting into the list of architectures
+// the host uses. auto resolves to the architecture of the host. pacman substitutes
+// the first architecture into server templates.
+func architectures(setting string) (arches []string) {
+	for _, arch := range strings.Fields(setting) {
+		if arch == "auto" {
+			arch = native()
+		}
+
+		if !contains(arches, arch) {
+			arches = append(arches, arch)
+		}
+	}
+
+	if len(arches) == 0 {
+		return []string{native()}
+	}
+
+	return arches
+}
+
+// native architecture of the host using pacman's naming.
+func native() string {
+	switch runtime.GOARCH {
+	case "amd64":
+		return "x86_64"
+	case "386":
+		return "i686"
+	case "arm64":
+		return "aarch64"
+	case "arm":
+		return "armv7h"
+	default:
+		return runtime.GOARCH
+	}
+}
+
+// fields splits every value on whitespace.
+func fields(values []string) (results []string) {
+	for _, v := range values {
+		results = append(results, strings.Fields(v)...)
+	}
+
+	return results
+}
+
+func contains(values []string, v string) bool {
+	for _, c := range values {
+		if c == v {
+			return true
+		}
+	}
+
+	return false
+}
+
+func stringOrDefault(s, d string) string {
+	if s == "" {
+		return d
+	}
+
+	return s
+}
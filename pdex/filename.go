@@ -0,0 +1,58 @@
+package pdex
+
+import (
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// compressions pacman supports for packages, the empty string is an uncompressed package.
+var compressions = map[string]bool{
+	"":     true,
+	".gz":  true,
+	".bz2": true,
+	".xz":  true,
+	".zst": true,
+	".lzo": true,
+	".lrz": true,
+	".lz4": true,
+	".lz":  true,
+	".Z":   true,
+}
+
+// Filename the components of a package's filename, i.e.) name-version-release-arch.pkg.tar.zst
+// the version includes the epoch when present.
+type Filename struct {
+	Name    string
+	Version string
+	Release string
+	Arch    string
+}
+
+// ParseFilename parses the package's filename, signatures and other files are an error.
+func ParseFilename(filename string) (f Filename, err error) {
+	idx := strings.LastIndex(filename, ".pkg.tar")
+	if idx < 0 || !compressions[filename[idx+len(".pkg.tar"):]] {
+		return f, errors.Errorf("%s is not a package", filename)
+	}
+
+	// names may contain dashes, the version, release and architecture never do.
+	fields := strings.Split(filename[:idx], "-")
+	if len(fields) < 4 {
+		return f, errors.Errorf("%s is not a package", filename)
+	}
+
+	n := len(fields)
+	f = Filename{
+		Name:    strings.Join(fields[:n-3], "-"),
+		Version: fields[n-3],
+		Release: fields[n-2],
+		Arch:    fields[n-1],
+	}
+
+	if f.Name == "" || f.Version == "" || f.Release == "" || f.Arch == "" {
+		return Filename{}, errors.Errorf("%s is not a package", filename)
+	}
+
+	return f, nil
+}
@@ -2,10 +2,28 @@
 
 package pdex
 
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
 type Record struct {
 	Digest []byte
 	SHA256 []byte
 	Name   string
+	// Size of the package in bytes.
+	Size int64
+	// Path of the package on disk.
+	Path string
+	// Modified time of the package.
+	Modified time.Time
+	// Shared identifiers of the package within each sharing backend.
+	Shared map[string]string `json:",omitempty"`
 }
 
 // DB package information db.
@@ -17,11 +35,55 @@ func New(dir string) *DB {
 	return &DB{root: dir}
 }
 
-func (t *DB) Insert(precord Record) error {
-	return nil
+// Insert the record, replacing any previous record for the package.
+func (t *DB) Insert(precord Record) (err error) {
+	var (
+		encoded []byte
+		dst     *os.File
+	)
+
+	if encoded, err = json.Marshal(precord); err != nil {
+		return errors.WithStack(err)
+	}
+
+	if err = os.MkdirAll(t.root, 0755); err != nil {
+		return errors.WithStack(err)
+	}
+
+	if dst, err = ioutil.TempFile(t.root, precord.Name+".*"); err != nil {
+		return errors.WithStack(err)
+	}
+	defer os.Remove(dst.Name())
+	defer dst.Close()
+
+	if _, err = dst.Write(encoded); err != nil {
+		return errors.WithStack(err)
+	}
+
+	if err = dst.Close(); err != nil {
+		return errors.WithStack(err)
+	}
+
+	return errors.WithStack(os.Rename(dst.Name(), t.path(precord.Name)))
 }
 
-func (t *DB) Get(name string) (Record, error) {
-	return Record{}, nil
+// Get the record of the named package.
+func (t *DB) Get(name string) (r Record, err error) {
+	var (
+		raw []byte
+	)
+
+	if raw, err = ioutil.ReadFile(t.path(name)); err != nil {
+		return r, errors.WithStack(err)
+	}
+
+	if err = json.Unmarshal(raw, &r); err != nil {
+		return r, errors.Wrapf(err, "corrupt record %s", name)
+	}
+
+	return r, nil
 }
 
+func (t *DB) path(name string) string {
+	return filepath.Join(t.root, filepath.Base(name)+".json")
+}
@@ -0,0 +1,160 @@
+package pdex_test
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/james-lawrence/pacmir/internal/testingx"
+	. "github.com/james-lawrence/pacmir/pdex"
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+
+	"github.com/stretchr/testify/require"
+)
+
+type nopwritecloser struct {
+	io.Writer
+}
+
+func (nopwritecloser) Close() error {
+	return nil
+}
+
+func TestPdex(t *testing.T) {
+	g := testingx.Init(t)
+
+	const pkgname = "example-1.0-1-x86_64.pkg.tar.zst"
+
+	g.Describe("ParseFilename", func() {
+		g.It("should parse the components of package filenames", func() {
+			f, err := ParseFilename("python-pip-20.3.1-1-any.pkg.tar.zst")
+			require.Nil(t, err)
+			require.Equal(t, Filename{Name: "python-pip", Version: "20.3.1", Release: "1", Arch: "any"}, f)
+
+			f, err = ParseFilename("ttf-dejavu-1:2.37+18+g9b5d1b2f-3-x86_64.pkg.tar.xz")
+			require.Nil(t, err)
+			require.Equal(t, Filename{Name: "ttf-dejavu", Version: "1:2.37+18+g9b5d1b2f", Release: "3", Arch: "x86_64"}, f)
+
+			f, err = ParseFilename("linux-5.10.1.arch1-1-x86_64.pkg.tar")
+			require.Nil(t, err)
+			require.Equal(t, Filename{Name: "linux", Version: "5.10.1.arch1", Release: "1", Arch: "x86_64"}, f)
+		})
+
+		g.It("should reject files that aren't packages", func() {
+			for _, name := range []string{
+				"python-pip-20.3.1-1-any.pkg.tar.zst.sig",
+				"core.db",
+				"pip-1-any.pkg.tar.zst",
+				".python-pip-20.3.1-1-any.pkg.tar.zst.123456",
+			} {
+				_, err := ParseFilename(name)
+				require.NotNil(t, err, name)
+			}
+		})
+	})
+
+	g.Describe("ReadSync", func() {
+		g.It("should index the packages by filename", func() {
+			contents := []byte("package")
+			pkgs, err := ReadSync(bytes.NewReader(testingx.SyncDB(map[string][]byte{pkgname: contents})))
+			require.Nil(t, err)
+
+			sum := sha256.Sum256(contents)
+			require.Equal(t, Package{
+				Filename: pkgname,
+				Name:     "example",
+				Version:  "1.0-1",
+				Arch:     "x86_64",
+				Size:     int64(len(contents)),
+				SHA256:   sum[:],
+			}, pkgs[pkgname])
+		})
+
+		g.It("should decompress the databases produced by repo-add", func() {
+			compressions := map[string]func(io.Writer) (io.WriteCloser, error){
+				"zstd": func(w io.Writer) (io.WriteCloser, error) {
+					return zstd.NewWriter(w)
+				},
+				"xz": func(w io.Writer) (io.WriteCloser, error) {
+					return xz.NewWriter(w)
+				},
+				"uncompressed": func(w io.Writer) (io.WriteCloser, error) {
+					return nopwritecloser{Writer: w}, nil
+				},
+			}
+
+			for name, compression := range compressions {
+				pkgs, err := ReadSync(bytes.NewReader(testingx.CompressedSyncDB(compression, map[string][]byte{pkgname: []byte("package")})))
+				require.Nil(t, err, name)
+				require.Equal(t, pkgname, pkgs[pkgname].Filename, name)
+			}
+		})
+
+		g.It("should reject unsupported compressions", func() {
+			_, err := ReadSync(bytes.NewReader([]byte{0x04, 0x22, 0x4d, 0x18, 0, 0}))
+			require.NotNil(t, err)
+			require.Contains(t, err.Error(), "unsupported compression lz4")
+		})
+
+		g.It("should reject malformed databases", func() {
+			_, err := ReadSync(bytes.NewReader([]byte{0x1f, 0x8b, 0, 0}))
+			require.NotNil(t, err)
+		})
+	})
+
+	g.Describe("Syncs", func() {
+		g.It("should reparse modified databases", func() {
+			dir, err := ioutil.TempDir("", "pdex.syncs.*")
+			require.Nil(t, err)
+			defer os.RemoveAll(dir)
+
+			path := filepath.Join(dir, "core.db")
+			require.Nil(t, ioutil.WriteFile(path, testingx.SyncDB(map[string][]byte{pkgname: []byte("package")}), 0600))
+
+			syncs := NewSyncs()
+			p, err := syncs.Lookup(path, pkgname)
+			require.Nil(t, err)
+			require.Equal(t, int64(7), p.Size)
+
+			_, err = syncs.Lookup(path, "missing-1.0-1-x86_64.pkg.tar.zst")
+			require.NotNil(t, err)
+
+			require.Nil(t, ioutil.WriteFile(path, testingx.SyncDB(map[string][]byte{pkgname: []byte("updated package")}), 0600))
+			require.Nil(t, os.Chtimes(path, time.Now().Add(time.Minute), time.Now().Add(time.Minute)))
+
+			p, err = syncs.Lookup(path, pkgname)
+			require.Nil(t, err)
+			require.Equal(t, int64(15), p.Size)
+		})
+	})
+
+	g.Describe("DB", func() {
+		g.It("should persist records", func() {
+			dir, err := ioutil.TempDir("", "pdex.db.*")
+			require.Nil(t, err)
+			defer os.RemoveAll(dir)
+
+			r := Record{
+				SHA256: []byte("checksum"),
+				Name:   pkgname,
+				Size:   7,
+				Path:   filepath.Join(dir, pkgname),
+				Shared: map[string]string{"swarm": "cid"},
+			}
+			require.Nil(t, New(dir).Insert(r))
+
+			found, err := New(dir).Get(pkgname)
+			require.Nil(t, err)
+			require.Equal(t, r, found)
+
+			_, err = New(dir).Get("missing-1.0-1-x86_64.pkg.tar.zst")
+			require.NotNil(t, err)
+		})
+	})
+}
@@ -0,0 +1,229 @@
+package pdex
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pkg/errors"
+	"github.com/ulikunitz/xz"
+)
+
+// Package metadata from a sync database.
+type Package struct {
+	Filename string
+	Name     string
+	Version  string
+	Arch     string
+	// Size of the compressed package.
+	Size   int64
+	SHA256 []byte
+}
+
+// ReadSync reads the packages of a sync database, indexed by filename. databases
+// are tar archives optionally compressed with gzip, zstd, xz or bzip2.
+func ReadSync(r io.Reader) (pkgs map[string]Package, err error) {
+	var (
+		hdr *tar.Header
+		p   Package
+		rc  io.ReadCloser
+	)
+
+	if rc, err = decompress(r); err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+
+	pkgs = map[string]Package{}
+	archive := tar.NewReader(rc)
+	for {
+		if hdr, err = archive.Next(); err == io.EOF {
+			return pkgs, nil
+		} else if err != nil {
+			return nil, errors.Wrap(err, "malformed sync database")
+		}
+
+		if path.Base(hdr.Name) != "desc" {
+			continue
+		}
+
+		if p, err = desc(archive); err != nil {
+			return nil, errors.Wrap(err, hdr.Name)
+		}
+
+		pkgs[p.Filename] = p
+	}
+}
+
+// compression formats identified by their magic bytes.
+var (
+	magicgzip  = []byte{0x1f, 0x8b}
+	magiczstd  = []byte{0x28, 0xb5, 0x2f, 0xfd}
+	magicxz    = []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}
+	magicbzip2 = []byte("BZh")
+	// formats supported by repo-add that can't be decompressed.
+	unsupported = map[string][]byte{
+		"lz4":      {0x04, 0x22, 0x4d, 0x18},
+		"lzip":     []byte("LZIP"),
+		"lrzip":    []byte("LRZI"),
+		"lzop":     {0x89, 'L', 'Z', 'O'},
+		"compress": {0x1f, 0x9d},
+	}
+)
+
+// decompress the sync database, the compression is detected from its magic bytes.
+// uncompressed databases are returned as is.
+func decompress(r io.Reader) (_ io.ReadCloser, err error) {
+	var (
+		magic []byte
+		br    = bufio.NewReader(r)
+	)
+
+	if magic, err = br.Peek(len(magicxz)); err != nil && err != io.EOF {
+		return nil, errors.WithStack(err)
+	}
+
+	switch {
+	case bytes.HasPrefix(magic, magicgzip):
+		gz, err := gzip.NewReader(br)
+		return gz, errors.WithStack(err)
+	case bytes.HasPrefix(magic, magiczstd):
+		d, err := zstd.NewReader(br)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		return d.IOReadCloser(), nil
+	case bytes.HasPrefix(magic, magicxz):
+		x, err := xz.NewReader(br)
+		return ioutil.NopCloser(x), errors.WithStack(err)
+	case bytes.HasPrefix(magic, magicbzip2):
+		return ioutil.NopCloser(bzip2.NewReader(br)), nil
+	}
+
+	for name, m := range unsupported {
+		if bytes.HasPrefix(magic, m) {
+			return nil, errors.Errorf("unsupported compression %s", name)
+		}
+	}
+
+	return ioutil.NopCloser(br), nil
+}
+
+// desc parses a package description, a series of %SECTION% headers each followed
+// by their values and terminated by an empty line.
+func desc(r io.Reader) (p Package, err error) {
+	var (
+		section string
+	)
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case line == "":
+			section = ""
+			continue
+		case strings.HasPrefix(line, "%") && strings.HasSuffix(line, "%"):
+			section = line
+			continue
+		}
+
+		switch section {
+		case "%FILENAME%":
+			p.Filename = line
+		case "%NAME%":
+			p.Name = line
+		case "%VERSION%":
+			p.Version = line
+		case "%ARCH%":
+			p.Arch = line
+		case "%CSIZE%":
+			if p.Size, err = strconv.ParseInt(line, 10, 64); err != nil {
+				return p, errors.Wrap(err, "invalid size")
+			}
+		case "%SHA256SUM%":
+			if p.SHA256, err = hex.DecodeString(line); err != nil {
+				return p, errors.Wrap(err, "invalid sha256")
+			}
+		}
+	}
+
+	if err = scanner.Err(); err != nil {
+		return p, errors.WithStack(err)
+	}
+
+	if p.Filename == "" {
+		return p, errors.New("missing filename")
+	}
+
+	return p, nil
+}
+
+// NewSyncs caches parsed sync databases, databases are reparsed when modified.
+func NewSyncs() *Syncs {
+	return &Syncs{
+		m:      &sync.Mutex{},
+		parsed: map[string]parsed{},
+	}
+}
+
+// Syncs parsed sync databases by path.
+type Syncs struct {
+	m      *sync.Mutex
+	parsed map[string]parsed
+}
+
+type parsed struct {
+	modified time.Time
+	size     int64
+	pkgs     map[string]Package
+}
+
+// Lookup the package with the given filename within the sync database at the path.
+func (t *Syncs) Lookup(path, filename string) (p Package, err error) {
+	var (
+		fi   os.FileInfo
+		f    *os.File
+		pkgs map[string]Package
+	)
+
+	if fi, err = os.Stat(path); err != nil {
+		return p, errors.WithStack(err)
+	}
+
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	if cached, ok := t.parsed[path]; ok && cached.modified.Equal(fi.ModTime()) && cached.size == fi.Size() {
+		pkgs = cached.pkgs
+	} else {
+		if f, err = os.Open(path); err != nil {
+			return p, errors.WithStack(err)
+		}
+		defer f.Close()
+
+		if pkgs, err = ReadSync(f); err != nil {
+			return p, errors.Wrapf(err, "unable to read %s", path)
+		}
+
+		t.parsed[path] = parsed{modified: fi.ModTime(), size: fi.Size(), pkgs: pkgs}
+	}
+
+	if p, ok := pkgs[filename]; ok {
+		return p, nil
+	}
+
+	return p, errors.Errorf("%s not found in %s", filename, path)
+}
@@ -0,0 +1,269 @@
+package pacmir
+
+import (
+	"strings"
+
+	paconf "github.com/Morganamilo/go-pacmanconf"
+	"github.com/Morganamilo/go-pacmanconf/ini"
+)
+
+// SigCheck whether or not signatures are checked.
+type SigCheck int
+
+// signature checking levels.
+const (
+	SigRequired SigCheck = iota
+	SigOptional
+	SigNever
+)
+
+func (t SigCheck) String() string {
+	switch t {
+	case SigOptional:
+		return "Optional"
+	case SigNever:
+		return "Never"
+	default:
+		return "Required"
+	}
+}
+
+// SigTrust which keys are trusted when checking signatures.
+type SigTrust int
+
+// signature trust levels.
+const (
+	SigTrustedOnly SigTrust = iota
+	SigTrustAll
+)
+
+func (t SigTrust) String() string {
+	switch t {
+	case SigTrustAll:
+		return "TrustAll"
+	default:
+		return "TrustedOnly"
+	}
+}
+
+// SigPolicy the signature policy for a single type of file.
+type SigPolicy struct {
+	Check SigCheck
+	Trust SigTrust
+}
+
+// Verified returns true if pacman will refuse files without a trusted signature.
+func (t SigPolicy) Verified() bool {
+	return t.Check == SigRequired && t.Trust == SigTrustedOnly
+}
+
+// SigLevel the signature policy for packages and databases.
+type SigLevel struct {
+	Package  SigPolicy
+	Database SigPolicy
+}
+
+// DefaultSigLevel pacman's compiled in signature level.
+func DefaultSigLevel() SigLevel {
+	return ParseSigLevel(SigLevel{}, "Required", "DatabaseOptional")
+}
+
+// ParseSigLevel applies the SigLevel values on top of the parent level.
+// matches pacman's behavior where repository levels override the global level.
+func ParseSigLevel(parent SigLevel, values ...string) SigLevel {
+	level := parent
+
+	for _, v := range values {
+		var (
+			policies []*SigPolicy
+		)
+
+		switch {
+		case strings.HasPrefix(v, "Package"):
+			v = strings.TrimPrefix(v, "Package")
+			policies = []*SigPolicy{&level.Package}
+		case strings.HasPrefix(v, "Database"):
+			v = strings.TrimPrefix(v, "Database")
+			policies = []*SigPolicy{&level.Database}
+		default:
+			policies = []*SigPolicy{&level.Package, &level.Database}
+		}
+
+		for _, p := range policies {
+			switch v {
+			case "Never":
+				p.Check = SigNever
+			case "Optional":
+				p.Check = SigOptional
+			case "Required":
+				p.Check = SigRequired
+			case "TrustedOnly":
+				p.Trust = SigTrustedOnly
+			case "TrustAll":
+				p.Trust = SigTrustAll
+			}
+		}
+	}
+
+	return level
+}
+
+// Usage of a repository.
+type Usage int
+
+// repository usage flags.
+const (
+	UsageSync Usage = 1 << iota
+	UsageSearch
+	UsageInstall
+	UsageUpgrade
+	UsageAll = UsageSync | UsageSearch | UsageInstall | UsageUpgrade
+)
+
+// ParseUsage parse a repository's usage values, defaults to UsageAll.
+func ParseUsage(values ...string) (u Usage) {
+	for _, v := range values {
+		switch v {
+		case "Sync":
+			u |= UsageSync
+		case "Search":
+			u |= UsageSearch
+		case "Install":
+			u |= UsageInstall
+		case "Upgrade":
+			u |= UsageUpgrade
+		case "All":
+			u |= UsageAll
+		}
+	}
+
+	if u == 0 {
+		return UsageAll
+	}
+
+	return u
+}
+
+// Has returns true if all of the given flags are set.
+func (t Usage) Has(flags Usage) bool {
+	return t&flags == flags
+}
+
+// Repository a resolved view of a repository within the pacman configuration.
+type Repository struct {
+	Name string
+	// Architecture the servers were resolved against.
+	Architecture string
+	// Architectures used by the host.
+	Architectures []string
+	// Servers primary mirrors for the repository, with $repo and $arch resolved.
+	Servers []string
+	// CacheServers (pacman >= 6.1) are tried before the servers and are not penalized
+	// by pacman when they fail, with $repo and $arch resolved.
+	CacheServers []string
+	SigLevel     SigLevel
+	Usage        Usage
+	servers      []string
+	cacheservers []string
+}
+
+// Sources returns every upstream for the repository in the order pacman would try them.
+func (t Repository) Sources() []string {
+	return append(append([]string(nil), t.CacheServers...), t.Servers...)
+}
+
+// Arch returns the view of the repository resolved for the given architecture.
+// returns false if the host does not use the architecture.
+func (t Repository) Arch(arch string) (Repository, bool) {
+	if !contains(t.Architectures, arch) {
+		return t, false
+	}
+
+	resolve := strings.NewReplacer("$repo", t.Name, "$arch", arch)
+	t.Architecture = arch
+	t.Servers = replace(resolve, t.servers...)
+	t.CacheServers = replace(resolve, t.cacheservers...)
+
+	return t, true
+}
+
+// Supports returns true if the package architecture can be installed by the host.
+func (t Repository) Supports(arch string) bool {
+	return arch == "any" || contains(t.Architectures, arch)
+}
+
+// repositories builds the repository views from the expanded configuration text.
+// go-pacmanconf discards directives it does not know about (CacheServer), so the
+// repository sections are parsed again.
+func repositories(c *paconf.Config, text string) (repos []Repository, err error) {
+	type raw struct {
+		name         string
+		servers      []string
+		cacheservers []string
+		siglevel     []string
+		usage        []string
+	}
+
+	var (
+		current  *raw
+		sections []*raw
+	)
+
+	cb := func(fileName string, line int, section string, key string, value string, data interface{}) error {
+		if section == "options" {
+			current = nil
+			return nil
+		}
+
+		if key == "" && value == "" {
+			current = &raw{name: section}
+			sections = append(sections, current)
+			return nil
+		}
+
+		if current == nil {
+			return nil
+		}
+
+		switch key {
+		case "Server":
+			current.servers = append(current.servers, value)
+		case "CacheServer":
+			current.cacheservers = append(current.cacheservers, value)
+		case "SigLevel":
+			current.siglevel = append(current.siglevel, strings.Fields(value)...)
+		case "Usage":
+			current.usage = append(current.usage, strings.Fields(value)...)
+		}
+
+		return nil
+	}
+
+	if err = ini.Parse(text, cb, nil); err != nil {
+		return nil, err
+	}
+
+	arches := architectures(c.Architecture)
+	global := ParseSigLevel(DefaultSigLevel(), c.SigLevel...)
+	for _, s := range sections {
+		repo, _ := Repository{
+			Name:          s.name,
+			Architectures: arches,
+			SigLevel:      ParseSigLevel(global, s.siglevel...),
+			Usage:         ParseUsage(s.usage...),
+			servers:       s.servers,
+			cacheservers:  s.cacheservers,
+		}.Arch(arches[0])
+		repos = append(repos, repo)
+	}
+
+	return repos, nil
+}
+
+func replace(r *strings.Replacer, values ...string) (results []string) {
+	for _, v := range values {
+		results = append(results, r.Replace(v))
+	}
+
+	return results
+}